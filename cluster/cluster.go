@@ -9,6 +9,8 @@ import (
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
 )
 
 type cluster struct {
@@ -19,6 +21,24 @@ type cluster struct {
 
 type NodeId string
 
+// maximum number of instances described by a single call to AWS
+const describeBatchSize = 500
+
+// InstanceType describes the compute resources of an EC2 instance type
+type InstanceType struct {
+	VCPUs     int64
+	MemoryMiB int64
+}
+
+// Capacity describes the size limits of the agent autoscaling group, along
+// with the number of instances it actually has
+type Capacity struct {
+	Desired int
+	Min     int
+	Max     int
+	Actual  int
+}
+
 // New returns a new Cluster object
 func New(asgName string, ec2 ec2iface.EC2API, asg autoscalingiface.AutoScalingAPI) Cluster {
 	return cluster{
@@ -28,52 +48,156 @@ func New(asgName string, ec2 ec2iface.EC2API, asg autoscalingiface.AutoScalingAP
 	}
 }
 
-// Add upscales the cluster by adding the given number of instances
-// to the autoscaling group
-func (c cluster) Add(ctx context.Context, count int) error {
+// ScaleTo sets the desired capacity of the autoscaling group to the given
+// target, clamped to the group's size limits. The group is described afresh
+// rather than from a snapshot, and is left untouched if its desired capacity
+// is neither the expected one nor the target, ie- something else changed it
+// since the target was computed. Scaling to a target the group already has
+// is a no-op, so the call can safely be retried.
+func (c cluster) ScaleTo(ctx context.Context, expected, target int) (ScaleResult, error) {
+	defer invalidate(ctx)
+
+	group, err := c.fetchSelfAsg(ctx)
+	if err != nil {
+		return ScaleResult{}, err
+	}
+
+	result := ScaleResult{
+		Previous:  int(aws.Int64Value(group.DesiredCapacity)),
+		Requested: target,
+		Desired:   clamp(target, int(aws.Int64Value(group.MinSize)), int(aws.Int64Value(group.MaxSize))),
+	}
+	if result.Previous == result.Desired {
+		log.
+			WithField("desired", result.Desired).
+			Debugln("Agent autoscaling group is already at target capacity")
+		return result, nil
+	}
+	if result.Previous != expected {
+		return result, &ConcurrentModificationError{Expected: expected, Actual: result.Previous}
+	}
+
+	log.
+		WithField("old", result.Previous).
+		WithField("new", result.Desired).
+		Infoln("Updating desired capacity of agent autoscaling group")
+
+	_, err = c.autoscale.SetDesiredCapacityWithContext(
+		ctx,
+		&autoscaling.SetDesiredCapacityInput{
+			DesiredCapacity:      aws.Int64(int64(result.Desired)),
+			AutoScalingGroupName: aws.String(c.asgName),
+		},
+	)
+	if err != nil {
+		return result, fmt.Errorf("failed to update autoscale group desired capacity: %w", err)
+	}
+	return result, nil
+}
+
+// SetCapacity sets the desired capacity of the autoscaling group to the
+// given number of instances, which must be within the group's size limits
+func (c cluster) SetCapacity(ctx context.Context, count int) error {
+	defer invalidate(ctx)
+
 	group, err := c.describeSelfAsg(ctx)
 	if err != nil {
 		return err
 	}
+	min, max := int(aws.Int64Value(group.MinSize)), int(aws.Int64Value(group.MaxSize))
+	if count < min || count > max {
+		return fmt.Errorf("desired capacity %d is outside the autoscale group's limits [%d, %d]", count, min, max)
+	}
 
-	desiredCap := *group.DesiredCapacity + int64(count)
 	log.
-		WithField("old", *group.DesiredCapacity).
-		WithField("new", desiredCap).
+		WithField("old", aws.Int64Value(group.DesiredCapacity)).
+		WithField("new", count).
 		Infoln("Updating desired capacity of agent autoscaling group")
 
-	_, err = c.autoscale.SetDesiredCapacity(
+	_, err = c.autoscale.SetDesiredCapacityWithContext(
+		ctx,
 		&autoscaling.SetDesiredCapacityInput{
-			DesiredCapacity:      aws.Int64(desiredCap),
+			DesiredCapacity:      aws.Int64(int64(count)),
 			AutoScalingGroupName: aws.String(c.asgName),
 		},
 	)
 	if err != nil {
-		return fmt.Errorf("failed to update autoscale group desired capacity: %v", err)
+		return fmt.Errorf("failed to update autoscale group desired capacity: %w", err)
 	}
 	return nil
 }
 
+// Capacity returns the desired capacity and size limits of the
+// autoscaling group
+func (c cluster) Capacity(ctx context.Context) (Capacity, error) {
+	group, err := c.describeSelfAsg(ctx)
+	if err != nil {
+		return Capacity{}, err
+	}
+	return Capacity{
+		Desired: int(aws.Int64Value(group.DesiredCapacity)),
+		Min:     int(aws.Int64Value(group.MinSize)),
+		Max:     int(aws.Int64Value(group.MaxSize)),
+		Actual:  len(group.Instances),
+	}, nil
+}
+
 // Destroy downscales the cluster by nuking the EC2 instances whose IDs
-// are given
-func (c cluster) Destroy(ctx context.Context, agents []NodeId) error {
-	for _, agent := range agents {
+// are given. Instances are terminated concurrently, and the outcome of
+// every termination is returned in the order of the given IDs. An error
+// is returned if any of them failed.
+func (c cluster) Destroy(ctx context.Context, agents []NodeId) ([]TerminationResult, error) {
+	defer invalidate(ctx)
+
+	results := make([]TerminationResult, len(agents))
+	sem := make(chan struct{}, terminateConcurrency)
+	var wg sync.WaitGroup
+	for i, agent := range agents {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, agent NodeId) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i] = c.terminate(ctx, agent)
+		}(i, agent)
+	}
+	wg.Wait()
+
+	if failed := FailedTerminations(results); len(failed) > 0 {
+		return results, fmt.Errorf("failed to terminate %d of %d agents: %v", len(failed), len(agents), failed)
+	}
+	return results, nil
+}
+
+// terminates a single agent, decrementing the desired capacity of the
+// autoscaling group
+func (c cluster) terminate(ctx context.Context, agent NodeId) TerminationResult {
+	log.
+		WithField("id", agent).
+		Debugln("Terminating agent node")
+
+	i := &autoscaling.TerminateInstanceInAutoScalingGroupInput{
+		InstanceId:                     aws.String(string(agent)),
+		ShouldDecrementDesiredCapacity: aws.Bool(true),
+	}
+	_, err := c.autoscale.TerminateInstanceInAutoScalingGroupWithContext(ctx, i)
+	switch {
+	case err == nil:
+		return TerminationResult{Id: agent, Status: Terminated}
+	case isInstanceGone(err):
 		log.
 			WithField("id", agent).
-			Debugln("Terminating agent node")
-
-		i := &autoscaling.TerminateInstanceInAutoScalingGroupInput{
-			InstanceId:                     aws.String(string(agent)),
-			ShouldDecrementDesiredCapacity: aws.Bool(true),
-		}
-		if _, err := c.autoscale.TerminateInstanceInAutoScalingGroup(i); err != nil {
-			log.
-				WithField("id", agent).
-				Errorln("Failed to terminate agent")
-			return err
-		}
+			Infoln("Agent is already gone")
+		return TerminationResult{Id: agent, Status: AlreadyGone}
+	default:
+		log.
+			WithError(err).
+			WithField("id", agent).
+			Errorln("Failed to terminate agent")
+		return TerminationResult{Id: agent, Status: TerminationFailed, Err: err}
 	}
-	return nil
 }
 
 // List returns IDs of running drone agent nodes
@@ -91,19 +215,72 @@ func (c cluster) List(ctx context.Context) ([]NodeId, error) {
 	return running, nil
 }
 
-// Describe returns information about agents whose IDs are given
+// Describe returns information about agents whose IDs are given.
+// Agents are described in batches, following every page of each batch.
 func (c cluster) Describe(ctx context.Context, ids []NodeId) ([]*ec2.Instance, error) {
 	agents := make([]*ec2.Instance, 0, len(ids))
-	response, err := c.ec2.DescribeInstances(&ec2.DescribeInstancesInput{
-		InstanceIds: NodeIdsToAwsStrings(ids),
-	})
+	for start := 0; start < len(ids); start += describeBatchSize {
+		end := start + describeBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		input := &ec2.DescribeInstancesInput{
+			InstanceIds: NodeIdsToAwsStrings(ids[start:end]),
+		}
+		for {
+			response, err := c.ec2.DescribeInstancesWithContext(ctx, input)
+			if err != nil {
+				return nil, err
+			}
+			for _, reservation := range response.Reservations {
+				agents = append(agents, reservation.Instances...)
+			}
+			if aws.StringValue(response.NextToken) == "" {
+				break
+			}
+			input.NextToken = response.NextToken
+		}
+	}
+	return agents, nil
+}
+
+// InstanceTypes returns the EC2 instance type of every running agent node
+func (c cluster) InstanceTypes(ctx context.Context) (map[NodeId]string, error) {
+	group, err := c.describeSelfAsg(ctx)
 	if err != nil {
 		return nil, err
 	}
-	for _, reservation := range response.Reservations {
-		agents = append(agents, reservation.Instances...)
+	types := make(map[NodeId]string, len(group.Instances))
+	for _, i := range group.Instances {
+		if *i.HealthStatus == "Healthy" {
+			types[NodeId(*i.InstanceId)] = aws.StringValue(i.InstanceType)
+		}
 	}
-	return agents, nil
+	return types, nil
+}
+
+// DescribeInstanceTypes returns the compute resources of the given EC2
+// instance types
+func (c cluster) DescribeInstanceTypes(ctx context.Context, types []string) (map[string]InstanceType, error) {
+	res := make(map[string]InstanceType, len(types))
+	response, err := c.ec2.DescribeInstanceTypesWithContext(ctx, &ec2.DescribeInstanceTypesInput{
+		InstanceTypes: aws.StringSlice(types),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe instance types: %w", err)
+	}
+	for _, info := range response.InstanceTypes {
+		t := InstanceType{}
+		if info.VCpuInfo != nil {
+			t.VCPUs = aws.Int64Value(info.VCpuInfo.DefaultVCpus)
+		}
+		if info.MemoryInfo != nil {
+			t.MemoryMiB = aws.Int64Value(info.MemoryInfo.SizeInMiB)
+		}
+		res[aws.StringValue(info.InstanceType)] = t
+	}
+	return res, nil
 }
 
 // ScalingActivityInProgress returns true if number of instances in
@@ -117,15 +294,75 @@ func (c cluster) ScalingActivityInProgress(ctx context.Context) (bool, error) {
 	return !reconciled, nil
 }
 
-// Describes the drone agent cluster's AWS autoscaling group
+// FailedScalingActivities returns the scaling activities of the autoscaling
+// group that started after the given time and failed or were cancelled,
+// along with their status messages. Only the most recent activities are
+// inspected.
+func (c cluster) FailedScalingActivities(ctx context.Context, since time.Time) ([]ScalingActivity, error) {
+	response, err := c.autoscale.DescribeScalingActivitiesWithContext(
+		ctx,
+		&autoscaling.DescribeScalingActivitiesInput{
+			AutoScalingGroupName: aws.String(c.asgName),
+			MaxRecords:           aws.Int64(scalingActivityRecords),
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch scaling activities of agent autoscale group: %w", err)
+	}
+
+	var failed []ScalingActivity
+	for _, a := range response.Activities {
+		started := aws.TimeValue(a.StartTime)
+		if started.Before(since) {
+			continue
+		}
+		switch aws.StringValue(a.StatusCode) {
+		case autoscaling.ScalingActivityStatusCodeFailed, autoscaling.ScalingActivityStatusCodeCancelled:
+			failed = append(failed, ScalingActivity{
+				Id:            aws.StringValue(a.ActivityId),
+				Description:   aws.StringValue(a.Description),
+				Status:        aws.StringValue(a.StatusCode),
+				StatusMessage: aws.StringValue(a.StatusMessage),
+				StartTime:     started,
+			})
+		}
+	}
+	return failed, nil
+}
+
+// Describes the drone agent cluster's AWS autoscaling group, serving the
+// description from the context's snapshot if it has one
 func (c cluster) describeSelfAsg(ctx context.Context) (*autoscaling.Group, error) {
-	response, err := c.autoscale.DescribeAutoScalingGroups(
+	s := snapshotOf(ctx)
+	if s == nil {
+		return c.fetchSelfAsg(ctx)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	group, ok := s.groups[c.asgName]
+	if !ok {
+		var err error
+		if group, err = c.fetchSelfAsg(ctx); err != nil {
+			return nil, err
+		}
+		s.groups[c.asgName] = group
+	}
+	return group, nil
+}
+
+func (c cluster) fetchSelfAsg(ctx context.Context) (*autoscaling.Group, error) {
+	response, err := c.autoscale.DescribeAutoScalingGroupsWithContext(
+		ctx,
 		&autoscaling.DescribeAutoScalingGroupsInput{
 			AutoScalingGroupNames: []*string{aws.String(c.asgName)},
 		},
 	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch info about agent autoscale group: %v", err)
+		return nil, fmt.Errorf("failed to fetch info about agent autoscale group: %w", err)
+	}
+	if len(response.AutoScalingGroups) == 0 {
+		return nil, fmt.Errorf("agent autoscale group %s not found", c.asgName)
 	}
 	return response.AutoScalingGroups[0], nil
 }
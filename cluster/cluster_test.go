@@ -1,3 +1,221 @@
 package cluster
 
-// TODO
+import (
+	"context"
+	"fmt"
+	"github.com/Shuttl-Tech/drone-autoscaler/mocks"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/golang/mock/gomock"
+	"reflect"
+	"testing"
+)
+
+// Verifies that agents are described in batches, following every page
+func TestCluster_Describe(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ids := make([]NodeId, describeBatchSize+1)
+	for i := range ids {
+		ids[i] = NodeId(fmt.Sprintf("i-%04d", i))
+	}
+
+	calls := 0
+	ec2Client := mocks.NewMockEC2API(ctrl)
+	ec2Client.
+		EXPECT().
+		DescribeInstancesWithContext(gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_ aws.Context, in *ec2.DescribeInstancesInput, _ ...request.Option) (
+			*ec2.DescribeInstancesOutput,
+			error,
+		) {
+			calls++
+			if len(in.InstanceIds) > describeBatchSize {
+				t.Errorf("Want at most %d IDs per call, got %d", describeBatchSize, len(in.InstanceIds))
+			}
+
+			// the first batch is split in 2 pages
+			requested := in.InstanceIds
+			out := &ec2.DescribeInstancesOutput{}
+			if len(requested) == describeBatchSize {
+				if in.NextToken == nil {
+					requested = requested[:10]
+					out.NextToken = aws.String("page-2")
+				} else {
+					requested = requested[10:]
+				}
+			}
+			reservation := &ec2.Reservation{}
+			for _, id := range requested {
+				reservation.Instances = append(reservation.Instances, &ec2.Instance{InstanceId: id})
+			}
+			out.Reservations = []*ec2.Reservation{reservation}
+			return out, nil
+		}).
+		Times(3)
+
+	c := New("test-asg", ec2Client, nil)
+	agents, err := c.Describe(context.TODO(), ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(agents) != len(ids) {
+		t.Fatalf("Want %d agents, got %d", len(ids), len(agents))
+	}
+	for i, agent := range agents {
+		if got := NodeId(aws.StringValue(agent.InstanceId)); got != ids[i] {
+			t.Errorf("Want agent %s at %d, got %s", ids[i], i, got)
+		}
+	}
+}
+
+// Verifies that the autoscaling group is described once within a snapshot,
+// afresh when scaling it, and again after the cluster has changed it
+func TestCluster_Snapshot(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	asg := mocks.NewMockAutoScalingAPI(ctrl)
+	asg.
+		EXPECT().
+		DescribeAutoScalingGroupsWithContext(gomock.Any(), gomock.Any()).
+		Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+			AutoScalingGroups: []*autoscaling.Group{
+				{
+					Instances: []*autoscaling.Instance{
+						{
+							HealthStatus: aws.String("Healthy"),
+							InstanceId:   aws.String("i-001"),
+							InstanceType: aws.String("c5.xlarge"),
+						},
+					},
+					DesiredCapacity: aws.Int64(1),
+					MaxSize:         aws.Int64(5),
+				},
+			},
+		}, nil).
+		Times(3)
+	asg.
+		EXPECT().
+		SetDesiredCapacityWithContext(gomock.Any(), gomock.Any()).
+		Return(nil, nil)
+
+	c := New("test-asg", nil, asg)
+	ctx := WithSnapshot(context.TODO())
+	if WithSnapshot(ctx) != ctx {
+		t.Error("Want nested snapshot to reuse the existing one")
+	}
+
+	if _, err := c.ScalingActivityInProgress(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.List(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.InstanceTypes(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ScaleTo(ctx, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	// the group changed, so it's described again
+	if _, err := c.List(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCluster_ScaleTo(t *testing.T) {
+	cases := []struct {
+		name     string
+		desired  int64
+		expected int
+		target   int
+		set      bool
+		want     ScaleResult
+		conflict bool
+	}{
+		{
+			name:     "upscale",
+			desired:  2,
+			expected: 2,
+			target:   4,
+			set:      true,
+			want:     ScaleResult{Previous: 2, Requested: 4, Desired: 4},
+		},
+		{
+			name:     "clamped to max size",
+			desired:  2,
+			expected: 2,
+			target:   12,
+			set:      true,
+			want:     ScaleResult{Previous: 2, Requested: 12, Desired: 10},
+		},
+		{
+			name:     "clamped to min size",
+			desired:  2,
+			expected: 2,
+			target:   0,
+			set:      true,
+			want:     ScaleResult{Previous: 2, Requested: 0, Desired: 1},
+		},
+		{
+			name:     "already at target",
+			desired:  4,
+			expected: 2,
+			target:   4,
+			want:     ScaleResult{Previous: 4, Requested: 4, Desired: 4},
+		},
+		{
+			name:     "modified concurrently",
+			desired:  3,
+			expected: 2,
+			target:   4,
+			want:     ScaleResult{Previous: 3, Requested: 4, Desired: 4},
+			conflict: true,
+		},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			asg := mocks.NewMockAutoScalingAPI(ctrl)
+			asg.
+				EXPECT().
+				DescribeAutoScalingGroupsWithContext(gomock.Any(), gomock.Any()).
+				Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+					AutoScalingGroups: []*autoscaling.Group{
+						{
+							DesiredCapacity: aws.Int64(test.desired),
+							MinSize:         aws.Int64(1),
+							MaxSize:         aws.Int64(10),
+						},
+					},
+				}, nil)
+			if test.set {
+				asg.
+					EXPECT().
+					SetDesiredCapacityWithContext(gomock.Any(), &autoscaling.SetDesiredCapacityInput{
+						DesiredCapacity:      aws.Int64(int64(test.want.Desired)),
+						AutoScalingGroupName: aws.String("test-asg"),
+					}).
+					Return(nil, nil)
+			}
+
+			got, err := New("test-asg", nil, asg).ScaleTo(context.TODO(), test.expected, test.target)
+			if _, ok := err.(*ConcurrentModificationError); ok != test.conflict {
+				t.Errorf("Want concurrent modification %v, got error %v", test.conflict, err)
+			}
+			if !test.conflict && err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Want result %+v, got %+v", test.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"strconv"
+)
+
+// OutdatedAgents returns IDs of running agents that were launched from a
+// launch template version or launch configuration other than the one the
+// autoscaling group currently launches instances from. The group's launch
+// template version is resolved if it's $Default or $Latest.
+func (c cluster) OutdatedAgents(ctx context.Context) ([]NodeId, error) {
+	group, err := c.describeSelfAsg(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	template := launchTemplateOf(group)
+	if template != nil {
+		if template, err = c.resolveLaunchTemplate(ctx, template); err != nil {
+			return nil, err
+		}
+	}
+
+	var res []NodeId
+	for _, i := range group.Instances {
+		if aws.StringValue(i.HealthStatus) != "Healthy" {
+			continue
+		}
+		if isOutdated(i, group, template) {
+			res = append(res, NodeId(aws.StringValue(i.InstanceId)))
+		}
+	}
+	return res, nil
+}
+
+// returns the launch template of the given group, either its own or the
+// one of its mixed instances policy. It's nil if the group launches
+// instances from a launch configuration.
+func launchTemplateOf(group *autoscaling.Group) *autoscaling.LaunchTemplateSpecification {
+	if group.LaunchTemplate != nil {
+		return group.LaunchTemplate
+	}
+	if p := group.MixedInstancesPolicy; p != nil && p.LaunchTemplate != nil {
+		return p.LaunchTemplate.LaunchTemplateSpecification
+	}
+	return nil
+}
+
+// returns the given launch template with its $Default or $Latest version,
+// or no version at all, resolved to the version number
+func (c cluster) resolveLaunchTemplate(
+	ctx context.Context,
+	template *autoscaling.LaunchTemplateSpecification,
+) (*autoscaling.LaunchTemplateSpecification, error) {
+	version := aws.StringValue(template.Version)
+	if version != "" && version != "$Default" && version != "$Latest" {
+		return template, nil
+	}
+
+	input := &ec2.DescribeLaunchTemplatesInput{}
+	if template.LaunchTemplateId != nil {
+		input.LaunchTemplateIds = []*string{template.LaunchTemplateId}
+	} else {
+		input.LaunchTemplateNames = []*string{template.LaunchTemplateName}
+	}
+	response, err := c.ec2.DescribeLaunchTemplatesWithContext(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe launch template of agent autoscale group: %w", err)
+	}
+	if len(response.LaunchTemplates) == 0 {
+		return nil, fmt.Errorf("launch template of agent autoscale group %s not found", c.asgName)
+	}
+
+	lt := response.LaunchTemplates[0]
+	number := aws.Int64Value(lt.DefaultVersionNumber)
+	if version == "$Latest" {
+		number = aws.Int64Value(lt.LatestVersionNumber)
+	}
+	return &autoscaling.LaunchTemplateSpecification{
+		LaunchTemplateId:   lt.LaunchTemplateId,
+		LaunchTemplateName: lt.LaunchTemplateName,
+		Version:            aws.String(strconv.FormatInt(number, 10)),
+	}, nil
+}
+
+// returns true if the given instance wasn't launched from the given current
+// launch template of its group, or the group's launch configuration if
+// there's no template
+func isOutdated(i *autoscaling.Instance, group *autoscaling.Group, current *autoscaling.LaunchTemplateSpecification) bool {
+	if current == nil {
+		return aws.StringValue(i.LaunchConfigurationName) != aws.StringValue(group.LaunchConfigurationName)
+	}
+	if i.LaunchTemplate == nil {
+		return true
+	}
+	return !sameLaunchTemplate(i.LaunchTemplate, current) ||
+		aws.StringValue(i.LaunchTemplate.Version) != aws.StringValue(current.Version)
+}
+
+// returns true if both specifications refer to the same launch template,
+// by ID if both have one and by name otherwise
+func sameLaunchTemplate(a, b *autoscaling.LaunchTemplateSpecification) bool {
+	if a.LaunchTemplateId != nil && b.LaunchTemplateId != nil {
+		return aws.StringValue(a.LaunchTemplateId) == aws.StringValue(b.LaunchTemplateId)
+	}
+	return aws.StringValue(a.LaunchTemplateName) == aws.StringValue(b.LaunchTemplateName)
+}
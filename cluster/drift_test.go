@@ -0,0 +1,73 @@
+package cluster
+
+import (
+	"context"
+	"github.com/Shuttl-Tech/drone-autoscaler/mocks"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/golang/mock/gomock"
+	"reflect"
+	"testing"
+)
+
+func TestCluster_OutdatedAgents(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	agent := func(id, version string) *autoscaling.Instance {
+		return &autoscaling.Instance{
+			InstanceId:   aws.String(id),
+			HealthStatus: aws.String("Healthy"),
+			LaunchTemplate: &autoscaling.LaunchTemplateSpecification{
+				LaunchTemplateId:   aws.String("lt-123"),
+				LaunchTemplateName: aws.String("agents"),
+				Version:            aws.String(version),
+			},
+		}
+	}
+	asg := mocks.NewMockAutoScalingAPI(ctrl)
+	asg.
+		EXPECT().
+		DescribeAutoScalingGroupsWithContext(gomock.Any(), gomock.Any()).
+		Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+			AutoScalingGroups: []*autoscaling.Group{
+				{
+					LaunchTemplate: &autoscaling.LaunchTemplateSpecification{
+						LaunchTemplateId: aws.String("lt-123"),
+						Version:          aws.String("$Latest"),
+					},
+					Instances: []*autoscaling.Instance{
+						agent("i-100", "3"),
+						agent("i-200", "4"),
+						{InstanceId: aws.String("i-300"), HealthStatus: aws.String("Healthy"), LaunchConfigurationName: aws.String("old")},
+					},
+				},
+			},
+		}, nil)
+
+	ec2Client := mocks.NewMockEC2API(ctrl)
+	ec2Client.
+		EXPECT().
+		DescribeLaunchTemplatesWithContext(gomock.Any(), &ec2.DescribeLaunchTemplatesInput{
+			LaunchTemplateIds: aws.StringSlice([]string{"lt-123"}),
+		}).
+		Return(&ec2.DescribeLaunchTemplatesOutput{
+			LaunchTemplates: []*ec2.LaunchTemplate{
+				{
+					LaunchTemplateId:     aws.String("lt-123"),
+					LaunchTemplateName:   aws.String("agents"),
+					DefaultVersionNumber: aws.Int64(3),
+					LatestVersionNumber:  aws.Int64(4),
+				},
+			},
+		}, nil)
+
+	got, err := New("test-asg", ec2Client, asg).OutdatedAgents(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []NodeId{"i-100", "i-300"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Want outdated agents %v, got %v", want, got)
+	}
+}
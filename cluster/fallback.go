@@ -0,0 +1,412 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+// fallbackCluster spreads the agent cluster over an ordered list of
+// autoscaling groups, the primary one being first. Capacity is added to the
+// first group that isn't short of capacity, and the capacity that a group
+// short of it fails to launch is redirected to the next ones. A group is
+// short of capacity while it has failed to launch instances due to
+// insufficient capacity within the cooldown, so new capacity returns to the
+// primary group once it recovers.
+type fallbackCluster struct {
+	groups   []cluster
+	cooldown time.Duration
+	now      func() time.Time
+}
+
+// the state of an autoscaling group as seen by the fallback cluster
+type groupState struct {
+	name     string
+	min      int
+	max      int
+	actual   int
+	desired  int
+	short    bool
+	reclaims int
+}
+
+// NewWithFallbacks returns a Cluster spread over the given autoscaling
+// groups in order of preference. It's the same as New for a single group.
+func NewWithFallbacks(
+	asgNames []string,
+	cooldown time.Duration,
+	ec2 ec2iface.EC2API,
+	asg autoscalingiface.AutoScalingAPI,
+) Cluster {
+	if len(asgNames) == 1 {
+		return New(asgNames[0], ec2, asg)
+	}
+	f := fallbackCluster{cooldown: cooldown, now: time.Now}
+	for _, name := range asgNames {
+		f.groups = append(f.groups, cluster{asgName: name, ec2: ec2, autoscale: asg})
+	}
+	return f
+}
+
+// ScaleTo sets the total desired capacity of the autoscaling groups to the
+// given target, clamped to their combined size limits. Capacity that groups
+// short of it fail to launch is moved to the next groups that aren't, and
+// the rest of an increase is added to the first groups with room for it. A
+// decrease is taken from the last groups first. The groups are described
+// afresh, and left untouched if their total desired capacity is neither the
+// expected one nor the target.
+func (f fallbackCluster) ScaleTo(ctx context.Context, expected, target int) (ScaleResult, error) {
+	defer invalidate(ctx)
+
+	states, err := f.states(ctx, f.fetch, true)
+	if err != nil {
+		return ScaleResult{}, err
+	}
+	previous := effectiveDesired(states)
+	min, max := 0, 0
+	for _, s := range states {
+		min += s.min
+		max += s.max
+	}
+
+	result := ScaleResult{Previous: previous, Requested: target, Desired: clamp(target, min, max)}
+	if previous != expected && previous != result.Desired {
+		return result, &ConcurrentModificationError{Expected: expected, Actual: previous}
+	}
+
+	planned := distribute(states, result.Desired)
+	result.Desired = 0
+	for i, s := range states {
+		result.Desired += planned[i]
+		if planned[i] == s.desired {
+			continue
+		}
+		log.
+			WithField("group", s.name).
+			WithField("old", s.desired).
+			WithField("new", planned[i]).
+			Infoln("Updating desired capacity of agent autoscaling group")
+
+		_, err := f.groups[i].autoscale.SetDesiredCapacityWithContext(
+			ctx,
+			&autoscaling.SetDesiredCapacityInput{
+				DesiredCapacity:      aws.Int64(int64(planned[i])),
+				AutoScalingGroupName: aws.String(s.name),
+			},
+		)
+		if err != nil {
+			return result, fmt.Errorf("failed to update desired capacity of autoscale group %s: %w", s.name, err)
+		}
+	}
+	return result, nil
+}
+
+// SetCapacity sets the total desired capacity of the autoscaling groups to
+// the given number of instances, which must be within their combined size
+// limits. Capacity is spread over the groups like ScaleTo does.
+func (f fallbackCluster) SetCapacity(ctx context.Context, count int) error {
+	capacity, err := f.Capacity(ctx)
+	if err != nil {
+		return err
+	}
+	if count < capacity.Min || count > capacity.Max {
+		return fmt.Errorf(
+			"desired capacity %d is outside the autoscale groups' limits [%d, %d]",
+			count,
+			capacity.Min,
+			capacity.Max,
+		)
+	}
+	_, err = f.ScaleTo(ctx, capacity.Desired, count)
+	return err
+}
+
+// Capacity returns the combined capacity of the autoscaling groups. The
+// desired capacity excludes the instances that groups short of capacity
+// fail to launch, since they aren't expected to come up.
+func (f fallbackCluster) Capacity(ctx context.Context) (Capacity, error) {
+	states, err := f.states(ctx, f.describe, false)
+	if err != nil {
+		return Capacity{}, err
+	}
+	res := Capacity{Desired: effectiveDesired(states)}
+	for _, s := range states {
+		res.Min += s.min
+		res.Max += s.max
+		res.Actual += s.actual
+	}
+	return res, nil
+}
+
+// Destroy terminates the given agents, no matter which group they belong
+// to, decrementing the desired capacity of their groups
+func (f fallbackCluster) Destroy(ctx context.Context, agents []NodeId) ([]TerminationResult, error) {
+	return f.groups[0].Destroy(ctx, agents)
+}
+
+// List returns IDs of the running agents of all groups. Agents of the
+// fallback groups come first, in reverse order of preference, so that
+// they're retired first when retaining the order of agents.
+func (f fallbackCluster) List(ctx context.Context) ([]NodeId, error) {
+	var res []NodeId
+	for i := len(f.groups) - 1; i >= 0; i-- {
+		agents, err := f.groups[i].List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, agents...)
+	}
+	return res, nil
+}
+
+func (f fallbackCluster) Describe(ctx context.Context, ids []NodeId) ([]*ec2.Instance, error) {
+	return f.groups[0].Describe(ctx, ids)
+}
+
+func (f fallbackCluster) InstanceTypes(ctx context.Context) (map[NodeId]string, error) {
+	res := make(map[NodeId]string)
+	for _, c := range f.groups {
+		types, err := c.InstanceTypes(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for id, t := range types {
+			res[id] = t
+		}
+	}
+	return res, nil
+}
+
+func (f fallbackCluster) DescribeInstanceTypes(ctx context.Context, types []string) (map[string]InstanceType, error) {
+	return f.groups[0].DescribeInstanceTypes(ctx, types)
+}
+
+// ScalingActivityInProgress returns true if any group is launching or
+// terminating instances, ignoring the instances that groups short of
+// capacity fail to launch
+func (f fallbackCluster) ScalingActivityInProgress(ctx context.Context) (bool, error) {
+	states, err := f.states(ctx, f.describe, false)
+	if err != nil {
+		return false, err
+	}
+	for _, s := range states {
+		if s.desired-s.reclaims != s.actual {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (f fallbackCluster) FailedScalingActivities(ctx context.Context, since time.Time) ([]ScalingActivity, error) {
+	var res []ScalingActivity
+	for _, c := range f.groups {
+		failed, err := c.FailedScalingActivities(ctx, since)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, failed...)
+	}
+	return res, nil
+}
+
+func (f fallbackCluster) OutdatedAgents(ctx context.Context) ([]NodeId, error) {
+	var res []NodeId
+	for _, c := range f.groups {
+		outdated, err := c.OutdatedAgents(ctx)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, outdated...)
+	}
+	return res, nil
+}
+
+// Unprotect removes the scale-in protection of the given agents in every
+// group they belong to
+func (f fallbackCluster) Unprotect(ctx context.Context, ids []NodeId) error {
+	for _, c := range f.groups {
+		if err := c.Unprotect(ctx, ids); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MarkUnhealthy marks the given agents unhealthy, no matter which group
+// they belong to
+func (f fallbackCluster) MarkUnhealthy(ctx context.Context, ids []NodeId) error {
+	return f.groups[0].MarkUnhealthy(ctx, ids)
+}
+
+// Quarantine quarantines the given agents from every group they belong to
+func (f fallbackCluster) Quarantine(ctx context.Context, ids []NodeId, at time.Time) error {
+	for _, c := range f.groups {
+		if err := c.Quarantine(ctx, ids, at); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Quarantined returns the agents quarantined from all groups
+func (f fallbackCluster) Quarantined(ctx context.Context) (map[NodeId]time.Time, error) {
+	res := make(map[NodeId]time.Time)
+	for _, c := range f.groups {
+		agents, err := c.Quarantined(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for id, at := range agents {
+			res[id] = at
+		}
+	}
+	return res, nil
+}
+
+// TerminateQuarantined terminates the given quarantined agents, no matter
+// which group they were quarantined from
+func (f fallbackCluster) TerminateQuarantined(ctx context.Context, ids []NodeId) error {
+	return f.groups[0].TerminateQuarantined(ctx, ids)
+}
+
+// Tag sets the given tags on the given agents, no matter which group they
+// belong to
+func (f fallbackCluster) Tag(ctx context.Context, ids []NodeId, tags map[string]string) error {
+	return f.groups[0].Tag(ctx, ids, tags)
+}
+
+func (f fallbackCluster) TagsOf(ctx context.Context, ids []NodeId, keys []string) (map[NodeId]map[string]string, error) {
+	return f.groups[0].TagsOf(ctx, ids, keys)
+}
+
+func (f fallbackCluster) describe(ctx context.Context, c cluster) (*autoscaling.Group, error) {
+	return c.describeSelfAsg(ctx)
+}
+
+func (f fallbackCluster) fetch(ctx context.Context, c cluster) (*autoscaling.Group, error) {
+	return c.fetchSelfAsg(ctx)
+}
+
+// returns the state of every group, described via the given func. Groups
+// that have instances yet to be launched are checked for a shortage of
+// capacity, and so are all groups when scaling.
+func (f fallbackCluster) states(
+	ctx context.Context,
+	describe func(context.Context, cluster) (*autoscaling.Group, error),
+	scaling bool,
+) ([]groupState, error) {
+	states := make([]groupState, len(f.groups))
+	for i, c := range f.groups {
+		group, err := describe(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		s := groupState{
+			name:    c.asgName,
+			min:     int(aws.Int64Value(group.MinSize)),
+			max:     int(aws.Int64Value(group.MaxSize)),
+			actual:  len(group.Instances),
+			desired: int(aws.Int64Value(group.DesiredCapacity)),
+		}
+		if scaling || s.desired > s.actual {
+			if s.short, err = c.shortOfCapacity(ctx, f.now().Add(-f.cooldown)); err != nil {
+				return nil, err
+			}
+		}
+		if s.short && s.desired > s.actual {
+			// the group can't go below its min size
+			s.reclaims = s.desired - maxInt(s.actual, s.min)
+		}
+		states[i] = s
+	}
+	return states, nil
+}
+
+// returns the total desired capacity of the given groups, excluding the
+// instances that groups short of capacity fail to launch
+func effectiveDesired(states []groupState) int {
+	res := 0
+	for _, s := range states {
+		res += s.desired - s.reclaims
+	}
+	return res
+}
+
+// returns the desired capacity of every group that adds up to the given
+// target, which must be within the groups' combined size limits. Increases
+// go to the first groups with room that aren't short of capacity, and
+// decreases are taken from the last groups first. An increase that only
+// groups short of capacity have room for is left unfulfilled.
+func distribute(states []groupState, target int) []int {
+	planned := make([]int, len(states))
+	total := 0
+	for i, s := range states {
+		planned[i] = s.desired - s.reclaims
+		total += planned[i]
+	}
+
+	for i := 0; i < len(states) && total < target; i++ {
+		if states[i].short {
+			continue
+		}
+		add := minInt(states[i].max-planned[i], target-total)
+		if add > 0 {
+			planned[i] += add
+			total += add
+		}
+	}
+	for i := len(states) - 1; i >= 0 && total > target; i-- {
+		remove := minInt(planned[i]-states[i].min, total-target)
+		if remove > 0 {
+			planned[i] -= remove
+			total -= remove
+		}
+	}
+	return planned
+}
+
+// shortOfCapacity returns true if the autoscaling group failed to launch
+// instances due to insufficient EC2 capacity since the given time
+func (c cluster) shortOfCapacity(ctx context.Context, since time.Time) (bool, error) {
+	failed, err := c.FailedScalingActivities(ctx, since)
+	if err != nil {
+		return false, err
+	}
+	for _, a := range failed {
+		if isCapacityShortage(a) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// returns true if the given failed activity couldn't launch an instance
+// because EC2 didn't have enough capacity of its type, on-demand or spot
+func isCapacityShortage(a ScalingActivity) bool {
+	msg := strings.ToLower(a.StatusMessage)
+	return strings.Contains(msg, "insufficientinstancecapacity") ||
+		strings.Contains(msg, "do not have sufficient") ||
+		strings.Contains(msg, "no spot capacity available") ||
+		strings.Contains(msg, "capacity-not-available")
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
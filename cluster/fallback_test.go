@@ -0,0 +1,178 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"github.com/Shuttl-Tech/drone-autoscaler/mocks"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/golang/mock/gomock"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// returns an autoscaling API mock serving the given groups and the failed
+// activities of each group, keyed by group name
+func mockFallbackGroups(
+	ctrl *gomock.Controller,
+	groups map[string]*autoscaling.Group,
+	failed map[string][]*autoscaling.Activity,
+) *mocks.MockAutoScalingAPI {
+	asg := mocks.NewMockAutoScalingAPI(ctrl)
+	asg.
+		EXPECT().
+		DescribeAutoScalingGroupsWithContext(gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_ aws.Context, in *autoscaling.DescribeAutoScalingGroupsInput, _ ...request.Option) (
+			*autoscaling.DescribeAutoScalingGroupsOutput,
+			error,
+		) {
+			group := groups[aws.StringValue(in.AutoScalingGroupNames[0])]
+			return &autoscaling.DescribeAutoScalingGroupsOutput{AutoScalingGroups: []*autoscaling.Group{group}}, nil
+		}).
+		AnyTimes()
+	asg.
+		EXPECT().
+		DescribeScalingActivitiesWithContext(gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_ aws.Context, in *autoscaling.DescribeScalingActivitiesInput, _ ...request.Option) (
+			*autoscaling.DescribeScalingActivitiesOutput,
+			error,
+		) {
+			return &autoscaling.DescribeScalingActivitiesOutput{
+				Activities: failed[aws.StringValue(in.AutoScalingGroupName)],
+			}, nil
+		}).
+		AnyTimes()
+	return asg
+}
+
+func instances(count int) []*autoscaling.Instance {
+	res := make([]*autoscaling.Instance, count)
+	for i := range res {
+		res[i] = &autoscaling.Instance{HealthStatus: aws.String("Healthy"), InstanceId: aws.String(fmt.Sprintf("i-%03d", i))}
+	}
+	return res
+}
+
+// Verifies that capacity the primary group fails to launch is redirected to
+// the fallback group, along with the rest of the increase
+func TestFallback_Redirect(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	asg := mockFallbackGroups(
+		ctrl,
+		map[string]*autoscaling.Group{
+			"primary": {
+				Instances:       instances(2),
+				DesiredCapacity: aws.Int64(5),
+				MaxSize:         aws.Int64(10),
+			},
+			"fallback": {
+				DesiredCapacity: aws.Int64(0),
+				MaxSize:         aws.Int64(10),
+			},
+		},
+		map[string][]*autoscaling.Activity{
+			"primary": {
+				{
+					ActivityId:    aws.String("a-001"),
+					StatusCode:    aws.String(autoscaling.ScalingActivityStatusCodeFailed),
+					StatusMessage: aws.String("We currently do not have sufficient c5.xlarge capacity in the Availability Zone you requested"),
+					StartTime:     aws.Time(time.Now().Add(-time.Minute)),
+				},
+			},
+		},
+	)
+	asg.
+		EXPECT().
+		SetDesiredCapacityWithContext(gomock.Any(), &autoscaling.SetDesiredCapacityInput{
+			DesiredCapacity:      aws.Int64(2),
+			AutoScalingGroupName: aws.String("primary"),
+		}).
+		Return(nil, nil)
+	asg.
+		EXPECT().
+		SetDesiredCapacityWithContext(gomock.Any(), &autoscaling.SetDesiredCapacityInput{
+			DesiredCapacity:      aws.Int64(2),
+			AutoScalingGroupName: aws.String("fallback"),
+		}).
+		Return(nil, nil)
+
+	c := NewWithFallbacks([]string{"primary", "fallback"}, 10*time.Minute, nil, asg)
+
+	capacity, err := c.Capacity(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Capacity{Desired: 2, Max: 20, Actual: 2}); capacity != want {
+		t.Errorf("Want capacity without the instances failing to launch %+v, got %+v", want, capacity)
+	}
+	inProgress, err := c.ScalingActivityInProgress(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inProgress {
+		t.Error("Want no scaling activity in progress for instances failing to launch")
+	}
+
+	result, err := c.ScaleTo(context.TODO(), 2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ScaleResult{Previous: 2, Requested: 4, Desired: 4}); result != want {
+		t.Errorf("Want result %+v, got %+v", want, result)
+	}
+}
+
+// Verifies that capacity is added to the primary group once it recovers,
+// and taken from the fallback group first
+func TestFallback_ReturnToPrimary(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	asg := mockFallbackGroups(
+		ctrl,
+		map[string]*autoscaling.Group{
+			"primary": {
+				Instances:       instances(2),
+				DesiredCapacity: aws.Int64(2),
+				MaxSize:         aws.Int64(10),
+			},
+			"fallback": {
+				Instances:       instances(2),
+				DesiredCapacity: aws.Int64(2),
+				MaxSize:         aws.Int64(10),
+			},
+		},
+		map[string][]*autoscaling.Activity{
+			// the shortage is older than the cooldown
+			"primary": {
+				{
+					ActivityId:    aws.String("a-001"),
+					StatusCode:    aws.String(autoscaling.ScalingActivityStatusCodeFailed),
+					StatusMessage: aws.String("InsufficientInstanceCapacity"),
+					StartTime:     aws.Time(time.Now().Add(-time.Hour)),
+				},
+			},
+		},
+	)
+	asg.
+		EXPECT().
+		SetDesiredCapacityWithContext(gomock.Any(), &autoscaling.SetDesiredCapacityInput{
+			DesiredCapacity:      aws.Int64(5),
+			AutoScalingGroupName: aws.String("primary"),
+		}).
+		Return(nil, nil)
+
+	c := NewWithFallbacks([]string{"primary", "fallback"}, 10*time.Minute, nil, asg)
+	if _, err := c.ScaleTo(context.TODO(), 4, 7); err != nil {
+		t.Fatal(err)
+	}
+
+	states := []groupState{{max: 10, desired: 5}, {max: 10, desired: 2}}
+	if got := distribute(states, 4); !reflect.DeepEqual(got, []int{4, 0}) {
+		t.Errorf("Want capacity to be taken from the fallback group first, got %v", got)
+	}
+}
@@ -0,0 +1,33 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+// health status that makes the autoscaling group replace an instance
+const healthStatusUnhealthy = "Unhealthy"
+
+// MarkUnhealthy sets the health status of the given agents to unhealthy,
+// regardless of the health check grace period, so that the autoscaling
+// group terminates and replaces them
+func (c cluster) MarkUnhealthy(ctx context.Context, ids []NodeId) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	defer invalidate(ctx)
+
+	for _, id := range ids {
+		_, err := c.autoscale.SetInstanceHealthWithContext(ctx, &autoscaling.SetInstanceHealthInput{
+			InstanceId:               aws.String(string(id)),
+			HealthStatus:             aws.String(healthStatusUnhealthy),
+			ShouldRespectGracePeriod: aws.Bool(false),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to mark agent %s unhealthy: %w", id, err)
+		}
+	}
+	return nil
+}
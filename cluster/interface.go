@@ -3,18 +3,29 @@ package cluster
 import (
 	"context"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"time"
 )
 
 // Cluster is used to communicate with a Drone agent cluster managed
 // by an AWS autoscaling group.
 type Cluster interface {
-	// Add upscales the cluster by adding the given number of instances
-	// to the autoscaling group
-	Add(context.Context, int) error
+	// ScaleTo sets the desired capacity of the autoscaling group to the
+	// given target, clamped to the group's size limits, as long as the
+	// group's desired capacity is still the expected one
+	ScaleTo(ctx context.Context, expected, target int) (ScaleResult, error)
+
+	// SetCapacity sets the desired capacity of the autoscaling group to the
+	// given number of instances, which must be within the group's size limits
+	SetCapacity(context.Context, int) error
+
+	// Capacity returns the desired capacity and size limits of the
+	// autoscaling group
+	Capacity(context.Context) (Capacity, error)
 
 	// Destroy downscales the cluster by nuking the EC2 instances whose IDs
-	// are given
-	Destroy(context.Context, []NodeId) error
+	// are given, returning the outcome of every termination. An error is
+	// returned if any of them failed.
+	Destroy(context.Context, []NodeId) ([]TerminationResult, error)
 
 	// List returns IDs of running drone agent nodes
 	List(context.Context) ([]NodeId, error)
@@ -22,7 +33,49 @@ type Cluster interface {
 	// Describe returns information about agents whose IDs are given
 	Describe(context.Context, []NodeId) ([]*ec2.Instance, error)
 
+	// InstanceTypes returns the EC2 instance type of every running agent node
+	InstanceTypes(context.Context) (map[NodeId]string, error)
+
+	// DescribeInstanceTypes returns the compute resources of the given EC2
+	// instance types
+	DescribeInstanceTypes(context.Context, []string) (map[string]InstanceType, error)
+
 	// ScalingActivityInProgress returns true if number of instances in
 	// cluster ASG is not the same as its desired capacity
 	ScalingActivityInProgress(context.Context) (bool, error)
+
+	// FailedScalingActivities returns the scaling activities of the ASG
+	// that started after the given time and failed or were cancelled
+	FailedScalingActivities(context.Context, time.Time) ([]ScalingActivity, error)
+
+	// OutdatedAgents returns IDs of running agents launched from a launch
+	// template version or launch configuration other than the current one
+	// of the autoscaling group
+	OutdatedAgents(context.Context) ([]NodeId, error)
+
+	// Unprotect removes the scale-in protection of the given agents
+	Unprotect(ctx context.Context, ids []NodeId) error
+
+	// MarkUnhealthy marks the given agents unhealthy, so that the
+	// autoscaling group replaces them
+	MarkUnhealthy(ctx context.Context, ids []NodeId) error
+
+	// Quarantine detaches the given agents from the autoscaling group,
+	// which replaces them, tags them as quarantined at the given time and
+	// stops them so that they can be inspected
+	Quarantine(ctx context.Context, ids []NodeId, at time.Time) error
+
+	// Quarantined returns the time every agent quarantined from the
+	// autoscaling group and not yet terminated was quarantined at
+	Quarantined(context.Context) (map[NodeId]time.Time, error)
+
+	// TerminateQuarantined terminates the given quarantined agents
+	TerminateQuarantined(ctx context.Context, ids []NodeId) error
+
+	// Tag sets the given tags on the agents whose IDs are given
+	Tag(ctx context.Context, ids []NodeId, tags map[string]string) error
+
+	// TagsOf returns the values of the given tag keys of the agents whose
+	// IDs are given, keyed by agent ID
+	TagsOf(ctx context.Context, ids []NodeId, keys []string) (map[NodeId]map[string]string, error)
 }
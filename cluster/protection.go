@@ -0,0 +1,52 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+// maximum number of instances whose scale-in protection is set by a single
+// call to AWS
+const protectionBatchSize = 50
+
+// Unprotect removes the scale-in protection of the given agents that have
+// it, so that the autoscaling group may terminate them when scaling in.
+// Agents that don't belong to the group are ignored.
+func (c cluster) Unprotect(ctx context.Context, ids []NodeId) error {
+	group, err := c.describeSelfAsg(ctx)
+	if err != nil {
+		return err
+	}
+	wanted := make(map[NodeId]struct{}, len(ids))
+	for _, id := range ids {
+		wanted[id] = struct{}{}
+	}
+	var protected []NodeId
+	for _, i := range group.Instances {
+		if _, ok := wanted[NodeId(aws.StringValue(i.InstanceId))]; ok && aws.BoolValue(i.ProtectedFromScaleIn) {
+			protected = append(protected, NodeId(aws.StringValue(i.InstanceId)))
+		}
+	}
+	if len(protected) == 0 {
+		return nil
+	}
+	defer invalidate(ctx)
+
+	for start := 0; start < len(protected); start += protectionBatchSize {
+		end := start + protectionBatchSize
+		if end > len(protected) {
+			end = len(protected)
+		}
+		_, err := c.autoscale.SetInstanceProtectionWithContext(ctx, &autoscaling.SetInstanceProtectionInput{
+			AutoScalingGroupName: aws.String(c.asgName),
+			InstanceIds:          NodeIdsToAwsStrings(protected[start:end]),
+			ProtectedFromScaleIn: aws.Bool(false),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to remove scale-in protection of agents: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"time"
+)
+
+// Tags of quarantined agents
+const (
+	// TagQuarantinedAt is the time the agent was quarantined, in RFC 3339
+	// format
+	TagQuarantinedAt = "drone-autoscaler:quarantined-at"
+
+	// TagQuarantinedFrom is the name of the autoscaling group the agent
+	// was detached from
+	TagQuarantinedFrom = "drone-autoscaler:quarantined-from"
+)
+
+// AgentStateQuarantined marks agents taken out of service for inspection
+const AgentStateQuarantined = "quarantined"
+
+// maximum number of instances detached from the autoscaling group by a
+// single call to AWS
+const detachBatchSize = 20
+
+// Quarantine takes the given agents out of service for inspection. They're
+// tagged as quarantined at the given time, detached from the autoscaling
+// group, which launches their replacements, and stopped so that their
+// runners no longer accept builds while their volumes are kept. Agents that
+// don't belong to the group are ignored.
+func (c cluster) Quarantine(ctx context.Context, ids []NodeId, at time.Time) error {
+	group, err := c.describeSelfAsg(ctx)
+	if err != nil {
+		return err
+	}
+	wanted := make(map[NodeId]struct{}, len(ids))
+	for _, id := range ids {
+		wanted[id] = struct{}{}
+	}
+	var members []NodeId
+	for _, i := range group.Instances {
+		if _, ok := wanted[NodeId(aws.StringValue(i.InstanceId))]; ok {
+			members = append(members, NodeId(aws.StringValue(i.InstanceId)))
+		}
+	}
+	if len(members) == 0 {
+		return nil
+	}
+	defer invalidate(ctx)
+
+	// agents are tagged first, so that they can be told apart and cleaned
+	// up even if they couldn't be detached or stopped
+	err = c.Tag(ctx, members, map[string]string{
+		TagState:           AgentStateQuarantined,
+		TagQuarantinedAt:   at.UTC().Format(time.RFC3339),
+		TagQuarantinedFrom: c.asgName,
+	})
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < len(members); start += detachBatchSize {
+		end := start + detachBatchSize
+		if end > len(members) {
+			end = len(members)
+		}
+		_, err := c.autoscale.DetachInstancesWithContext(ctx, &autoscaling.DetachInstancesInput{
+			AutoScalingGroupName:           aws.String(c.asgName),
+			InstanceIds:                    NodeIdsToAwsStrings(members[start:end]),
+			ShouldDecrementDesiredCapacity: aws.Bool(false),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to detach agents from autoscaling group: %w", err)
+		}
+	}
+
+	_, err = c.ec2.StopInstancesWithContext(ctx, &ec2.StopInstancesInput{
+		InstanceIds: NodeIdsToAwsStrings(members),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to stop quarantined agents: %w", err)
+	}
+	return nil
+}
+
+// Quarantined returns the time every agent quarantined from the autoscaling
+// group was quarantined at, keyed by agent ID. Terminated agents are left
+// out.
+func (c cluster) Quarantined(ctx context.Context) (map[NodeId]time.Time, error) {
+	input := &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("tag:" + TagState), Values: aws.StringSlice([]string{AgentStateQuarantined})},
+			{Name: aws.String("tag:" + TagQuarantinedFrom), Values: aws.StringSlice([]string{c.asgName})},
+			{
+				Name: aws.String("instance-state-name"),
+				Values: aws.StringSlice([]string{
+					ec2.InstanceStateNamePending,
+					ec2.InstanceStateNameRunning,
+					ec2.InstanceStateNameStopping,
+					ec2.InstanceStateNameStopped,
+				}),
+			},
+		},
+	}
+	res := make(map[NodeId]time.Time)
+	for {
+		response, err := c.ec2.DescribeInstancesWithContext(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe quarantined agents: %w", err)
+		}
+		for _, reservation := range response.Reservations {
+			for _, i := range reservation.Instances {
+				res[NodeId(aws.StringValue(i.InstanceId))] = quarantinedAt(i)
+			}
+		}
+		if aws.StringValue(response.NextToken) == "" {
+			return res, nil
+		}
+		input.NextToken = response.NextToken
+	}
+}
+
+// returns the time the given instance was quarantined at as per its tag,
+// or the zero time if it's missing or malformed
+func quarantinedAt(i *ec2.Instance) time.Time {
+	for _, tag := range i.Tags {
+		if aws.StringValue(tag.Key) != TagQuarantinedAt {
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339, aws.StringValue(tag.Value)); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// TerminateQuarantined terminates the given quarantined agents, which no
+// longer belong to the autoscaling group
+func (c cluster) TerminateQuarantined(ctx context.Context, ids []NodeId) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := c.ec2.TerminateInstancesWithContext(ctx, &ec2.TerminateInstancesInput{
+		InstanceIds: NodeIdsToAwsStrings(ids),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to terminate quarantined agents: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package cluster
+
+import (
+	"context"
+	"github.com/Shuttl-Tech/drone-autoscaler/mocks"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/golang/mock/gomock"
+	"testing"
+	"time"
+)
+
+// Verifies that only members of the group are quarantined, by tagging,
+// detaching them with replacement and stopping them
+func TestCluster_Quarantine(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	at := time.Unix(1600000000, 0).UTC()
+	asg := mocks.NewMockAutoScalingAPI(ctrl)
+	asg.
+		EXPECT().
+		DescribeAutoScalingGroupsWithContext(gomock.Any(), gomock.Any()).
+		Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+			AutoScalingGroups: []*autoscaling.Group{
+				{
+					Instances: []*autoscaling.Instance{
+						{InstanceId: aws.String("i-001"), HealthStatus: aws.String("Healthy")},
+						{InstanceId: aws.String("i-002"), HealthStatus: aws.String("Healthy")},
+					},
+				},
+			},
+		}, nil)
+	asg.
+		EXPECT().
+		DetachInstancesWithContext(gomock.Any(), &autoscaling.DetachInstancesInput{
+			AutoScalingGroupName:           aws.String("test-asg"),
+			InstanceIds:                    aws.StringSlice([]string{"i-001"}),
+			ShouldDecrementDesiredCapacity: aws.Bool(false),
+		}).
+		Return(&autoscaling.DetachInstancesOutput{}, nil)
+
+	ec2Client := mocks.NewMockEC2API(ctrl)
+	ec2Client.
+		EXPECT().
+		CreateTagsWithContext(gomock.Any(), &ec2.CreateTagsInput{
+			Resources: aws.StringSlice([]string{"i-001"}),
+			Tags: []*ec2.Tag{
+				{Key: aws.String(TagQuarantinedAt), Value: aws.String("2020-09-13T12:26:40Z")},
+				{Key: aws.String(TagQuarantinedFrom), Value: aws.String("test-asg")},
+				{Key: aws.String(TagState), Value: aws.String(AgentStateQuarantined)},
+			},
+		}).
+		Return(&ec2.CreateTagsOutput{}, nil)
+	ec2Client.
+		EXPECT().
+		StopInstancesWithContext(gomock.Any(), &ec2.StopInstancesInput{
+			InstanceIds: aws.StringSlice([]string{"i-001"}),
+		}).
+		Return(&ec2.StopInstancesOutput{}, nil)
+
+	c := New("test-asg", ec2Client, asg)
+	if err := c.Quarantine(context.TODO(), []NodeId{"i-001", "i-999"}, at); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCluster_Quarantined(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ec2Client := mocks.NewMockEC2API(ctrl)
+	ec2Client.
+		EXPECT().
+		DescribeInstancesWithContext(gomock.Any(), gomock.Any()).
+		Return(&ec2.DescribeInstancesOutput{
+			Reservations: []*ec2.Reservation{
+				{
+					Instances: []*ec2.Instance{
+						{
+							InstanceId: aws.String("i-001"),
+							Tags: []*ec2.Tag{
+								{Key: aws.String(TagQuarantinedAt), Value: aws.String("2020-09-13T12:26:40Z")},
+							},
+						},
+						{InstanceId: aws.String("i-002")},
+					},
+				},
+			},
+		}, nil)
+
+	c := New("test-asg", ec2Client, nil)
+	got, err := c.Quarantined(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || !got["i-001"].Equal(time.Unix(1600000000, 0)) || !got["i-002"].IsZero() {
+		t.Errorf("Want quarantine time of i-001 and zero time of i-002, got %v", got)
+	}
+}
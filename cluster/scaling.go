@@ -0,0 +1,68 @@
+package cluster
+
+import (
+	"fmt"
+	"time"
+)
+
+// maximum number of recent scaling activities inspected for failures
+const scalingActivityRecords = 20
+
+// ScaleResult describes the outcome of scaling the autoscaling group to a
+// target capacity
+type ScaleResult struct {
+	// Previous is the desired capacity of the group before scaling
+	Previous int
+	// Requested is the target capacity asked for
+	Requested int
+	// Desired is the target capacity after clamping it to the group's
+	// size limits
+	Desired int
+}
+
+// Clamped returns true if the requested capacity was outside the group's
+// size limits
+func (r ScaleResult) Clamped() bool {
+	return r.Desired != r.Requested
+}
+
+// ConcurrentModificationError is returned when the desired capacity of the
+// autoscaling group was changed by something else since the target
+// capacity was computed
+type ConcurrentModificationError struct {
+	Expected int
+	Actual   int
+}
+
+func (e *ConcurrentModificationError) Error() string {
+	return fmt.Sprintf(
+		"desired capacity of autoscale group changed concurrently, expected %d but found %d",
+		e.Expected,
+		e.Actual,
+	)
+}
+
+// ScalingActivity describes a scaling activity of the autoscaling group,
+// eg- launching or terminating an instance
+type ScalingActivity struct {
+	Id          string
+	Description string
+
+	// Status code of the activity, eg- "Failed", along with the reason
+	// behind it
+	Status        string
+	StatusMessage string
+
+	StartTime time.Time
+}
+
+// returns the given value limited to the range [min, max]
+func clamp(value, min, max int) int {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
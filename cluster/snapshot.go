@@ -0,0 +1,44 @@
+package cluster
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"sync"
+)
+
+type snapshotKey struct{}
+
+// snapshot holds the description of the autoscaling groups for the
+// lifetime of a context, keyed by group name
+type snapshot struct {
+	mu     sync.Mutex
+	groups map[string]*autoscaling.Group
+}
+
+// WithSnapshot returns a context within which the cluster describes its
+// autoscaling group at most once, and serves all subsequent reads from that
+// description. Changes made by the cluster invalidate the snapshot. This
+// allows a single autoscaler cycle to make one describe call, no matter how
+// many cluster methods it calls.
+func WithSnapshot(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(snapshotKey{}).(*snapshot); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, snapshotKey{}, &snapshot{groups: make(map[string]*autoscaling.Group)})
+}
+
+// returns the snapshot of the given context, if any
+func snapshotOf(ctx context.Context) *snapshot {
+	s, _ := ctx.Value(snapshotKey{}).(*snapshot)
+	return s
+}
+
+// invalidate discards the snapshot of the given context, if any, so that the
+// next read describes the autoscaling group again
+func invalidate(ctx context.Context) {
+	if s := snapshotOf(ctx); s != nil {
+		s.mu.Lock()
+		s.groups = make(map[string]*autoscaling.Group)
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,103 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"sort"
+)
+
+// Well-known tags of agents with which the autoscaler persists their state,
+// so that it survives restarts and is visible in the EC2 console
+const (
+	// TagLastBusy is the time the agent was last seen running a build, in
+	// RFC 3339 format
+	TagLastBusy = "drone-autoscaler:last-busy"
+
+	// TagState is one of the AgentState* constants
+	TagState = "drone-autoscaler:state"
+)
+
+// States of agents as seen by the autoscaler
+const (
+	// AgentStateBusy marks agents running builds
+	AgentStateBusy = "busy"
+
+	// AgentStateIdle marks agents that stopped running builds
+	AgentStateIdle = "idle"
+
+	// AgentStateDraining marks agents being retired
+	AgentStateDraining = "draining"
+)
+
+// maximum number of agents whose tags are described by a single call to
+// AWS, as limited by the number of values of a filter
+const tagBatchSize = 200
+
+// Tag sets the given tags on the agents whose IDs are given, overwriting
+// the existing values of the same keys. Agents are tagged in batches.
+func (c cluster) Tag(ctx context.Context, ids []NodeId, tags map[string]string) error {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	ec2Tags := make([]*ec2.Tag, 0, len(tags))
+	for _, k := range keys {
+		ec2Tags = append(ec2Tags, &ec2.Tag{Key: aws.String(k), Value: aws.String(tags[k])})
+	}
+
+	for start := 0; start < len(ids); start += describeBatchSize {
+		end := start + describeBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		_, err := c.ec2.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+			Resources: NodeIdsToAwsStrings(ids[start:end]),
+			Tags:      ec2Tags,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to tag agents: %w", err)
+		}
+	}
+	return nil
+}
+
+// TagsOf returns the values of the given tag keys of the agents whose IDs
+// are given, keyed by agent ID. Agents without any of the tags are left out.
+// Tags are described in batches, following every page of each batch.
+func (c cluster) TagsOf(ctx context.Context, ids []NodeId, keys []string) (map[NodeId]map[string]string, error) {
+	res := make(map[NodeId]map[string]string)
+	for start := 0; start < len(ids); start += tagBatchSize {
+		end := start + tagBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		input := &ec2.DescribeTagsInput{
+			Filters: []*ec2.Filter{
+				{Name: aws.String("resource-id"), Values: NodeIdsToAwsStrings(ids[start:end])},
+				{Name: aws.String("key"), Values: aws.StringSlice(keys)},
+			},
+		}
+		for {
+			response, err := c.ec2.DescribeTagsWithContext(ctx, input)
+			if err != nil {
+				return nil, fmt.Errorf("failed to describe tags of agents: %w", err)
+			}
+			for _, t := range response.Tags {
+				id := NodeId(aws.StringValue(t.ResourceId))
+				if res[id] == nil {
+					res[id] = make(map[string]string)
+				}
+				res[id][aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+			}
+			if aws.StringValue(response.NextToken) == "" {
+				break
+			}
+			input.NextToken = response.NextToken
+		}
+	}
+	return res, nil
+}
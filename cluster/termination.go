@@ -0,0 +1,55 @@
+package cluster
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"strings"
+)
+
+// maximum number of agents terminated at the same time
+const terminateConcurrency = 10
+
+// TerminationStatus is the outcome of terminating a single agent
+type TerminationStatus string
+
+const (
+	// Terminated means the agent was terminated
+	Terminated TerminationStatus = "terminated"
+
+	// AlreadyGone means the agent was no longer part of the autoscaling
+	// group, eg- because it had already been terminated
+	AlreadyGone TerminationStatus = "already_gone"
+
+	// TerminationFailed means the agent couldn't be terminated
+	TerminationFailed TerminationStatus = "failed"
+)
+
+// TerminationResult describes the outcome of terminating a single agent.
+// Err is set only if the termination failed.
+type TerminationResult struct {
+	Id     NodeId
+	Status TerminationStatus
+	Err    error
+}
+
+// FailedTerminations returns the IDs of agents that couldn't be terminated
+func FailedTerminations(results []TerminationResult) []NodeId {
+	res := make([]NodeId, 0)
+	for _, r := range results {
+		if r.Status == TerminationFailed {
+			res = append(res, r.Id)
+		}
+	}
+	return res
+}
+
+// returns true if AWS rejected terminating an instance because it isn't
+// part of the autoscaling group anymore
+func isInstanceGone(err error) bool {
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) || awsErr.Code() != "ValidationError" {
+		return false
+	}
+	msg := strings.ToLower(awsErr.Message())
+	return strings.Contains(msg, "not found") || strings.Contains(msg, "no managed instance")
+}
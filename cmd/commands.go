@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/Shuttl-Tech/drone-autoscaler/cluster"
+	"github.com/Shuttl-Tech/drone-autoscaler/config"
+	"github.com/Shuttl-Tech/drone-autoscaler/engine"
+	"github.com/Shuttl-Tech/drone-autoscaler/events"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands = []command{
+	{"run", "", "Run the autoscaler (default)", runCmd},
+	{"plan", "", "Print a one-shot scaling plan as JSON", planCmd},
+	{"status", "", "Print the agent autoscaling group and its busy & idle agents", statusCmd},
+	{"drain", "<agent-id>", "Retire the given agent if it's idle", drainCmd},
+	{"quarantine", "[--reason <text>] <agent-id>", "Take the given agent out of service for inspection if it's idle", quarantineCmd},
+	{"scale", "--to <count>", "Set the desired capacity of the agent autoscaling group", scaleCmd},
+	{"validate", "", "Check the configuration, reporting every invalid parameter", validateCmd},
+	{"version", "", "Print the version", versionCmd},
+}
+
+func findCommand(name string) (command, bool) {
+	for _, c := range commands {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return command{}, false
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: drone-autoscaler [command]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %s %s\t%s\n", c.name, c.args, c.summary)
+	}
+	w.Flush()
+}
+
+// parses the flags of the given command, expecting exactly nargs
+// positional arguments
+func parseFlags(fs *flag.FlagSet, args []string, nargs int) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != nargs {
+		return fmt.Errorf("%s expects %d arguments, got %d", fs.Name(), nargs, fs.NArg())
+	}
+	return nil
+}
+
+// loads the configuration for one-shot commands, which log to stderr so
+// that their output on stdout can be consumed by other programs
+func loadOneShotConfig() (config.Config, error) {
+	conf, err := config.Load()
+	if err != nil {
+		return conf, err
+	}
+	setupLogging(conf, os.Stderr)
+	return conf, nil
+}
+
+func runCmd(args []string) error {
+	if err := parseFlags(flag.NewFlagSet("run", flag.ExitOnError), args, 0); err != nil {
+		return err
+	}
+	ctx := signalContext()
+
+	conf, err := config.Load()
+	if err != nil {
+		return err
+	}
+
+	setupLogging(conf, os.Stdout)
+	setupMetricsServer(conf)
+	client := setupDroneClient(ctx, conf)
+	fleet := setupAgentClusterClient(conf)
+	notifier, err := setupNotifier(conf)
+	if err != nil {
+		return err
+	}
+
+	log.
+		WithField("version", Version).
+		Info("Starting Drone autoscaler")
+	eng := engine.New(conf, client, fleet, notifier, setupStateStore(conf, fleet))
+	go reloadOnHangup(eng, conf)
+	if conf.EventStream {
+		go setupEventStream(ctx, conf).Subscribe(ctx, func(ev events.Event) {
+			log.
+				WithField("repo", ev.Repo).
+				WithField("build", ev.Build).
+				WithField("status", ev.Status).
+				Debugln("Build changed, planning soon")
+			eng.Wake()
+		})
+	}
+	eng.Start(ctx)
+	return nil
+}
+
+func planCmd(args []string) error {
+	if err := parseFlags(flag.NewFlagSet("plan", flag.ExitOnError), args, 0); err != nil {
+		return err
+	}
+	ctx := signalContext()
+	conf, err := loadOneShotConfig()
+	if err != nil {
+		return err
+	}
+
+	// operators aren't notified about events observed by one-shot commands
+	fleet := setupAgentClusterClient(conf)
+	eng := engine.New(conf, setupDroneClient(ctx, conf), fleet, nil, setupStateStore(conf, fleet))
+	plan, err := eng.Plan(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create scaling plan: %v", err)
+	}
+	out, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+func statusCmd(args []string) error {
+	if err := parseFlags(flag.NewFlagSet("status", flag.ExitOnError), args, 0); err != nil {
+		return err
+	}
+	ctx := signalContext()
+	conf, err := loadOneShotConfig()
+	if err != nil {
+		return err
+	}
+
+	fleet := setupAgentClusterClient(conf)
+	eng := engine.New(conf, setupDroneClient(ctx, conf), fleet, nil, setupStateStore(conf, fleet))
+	status, err := eng.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	busy := 0
+	for _, a := range status.Agents {
+		if a.Busy() {
+			busy++
+		}
+	}
+	fmt.Printf("Autoscaling group: %s\n", conf.Agent.AutoscalingGroup)
+	fmt.Printf(
+		"Capacity: %d desired, %d actual (min %d, max %d)\n",
+		status.Capacity.Desired,
+		status.Capacity.Actual,
+		status.Capacity.Min,
+		status.Capacity.Max,
+	)
+	fmt.Printf("Agents: %d running, %d busy, %d idle\n", len(status.Agents), busy, len(status.Agents)-busy)
+	if conf.Agent.ReplacementRate > 0 {
+		fmt.Printf(
+			"Rolling replacement: %d of %d agents outdated, replacing up to %d idle ones per cycle\n",
+			status.Outdated,
+			len(status.Agents),
+			conf.Agent.ReplacementRate,
+		)
+	}
+	fmt.Println()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTYPE\tZONE\tAGE\tSTATE\tBUILDS")
+	for _, a := range status.Agents {
+		state := "idle"
+		if a.Busy() {
+			state = "busy"
+		}
+		if a.Outdated {
+			state += ", outdated"
+		}
+		fmt.Fprintf(
+			w,
+			"%s\t%s\t%s\t%s\t%s\t%d\n",
+			a.Id,
+			a.InstanceType,
+			a.Zone,
+			time.Since(a.LaunchTime).Truncate(time.Minute),
+			state,
+			a.RunningBuilds,
+		)
+	}
+	return w.Flush()
+}
+
+func drainCmd(args []string) error {
+	fs := flag.NewFlagSet("drain", flag.ExitOnError)
+	if err := parseFlags(fs, args, 1); err != nil {
+		return err
+	}
+	ctx := signalContext()
+	conf, err := loadOneShotConfig()
+	if err != nil {
+		return err
+	}
+
+	agent := cluster.NodeId(fs.Arg(0))
+	fleet := setupAgentClusterClient(conf)
+	eng := engine.New(conf, setupDroneClient(ctx, conf), fleet, nil, setupStateStore(conf, fleet))
+	if err := eng.Drain(ctx, agent); err != nil {
+		return fmt.Errorf("failed to drain agent: %v", err)
+	}
+	fmt.Printf("Agent %s retired\n", agent)
+	return nil
+}
+
+func quarantineCmd(args []string) error {
+	fs := flag.NewFlagSet("quarantine", flag.ExitOnError)
+	reason := fs.String("reason", "quarantined manually", "reason reported for quarantining the agent")
+	if err := parseFlags(fs, args, 1); err != nil {
+		return err
+	}
+	ctx := signalContext()
+	conf, err := loadOneShotConfig()
+	if err != nil {
+		return err
+	}
+
+	agent := cluster.NodeId(fs.Arg(0))
+	fleet := setupAgentClusterClient(conf)
+	eng := engine.New(conf, setupDroneClient(ctx, conf), fleet, nil, setupStateStore(conf, fleet))
+	if err := eng.Quarantine(ctx, agent, *reason); err != nil {
+		return fmt.Errorf("failed to quarantine agent: %v", err)
+	}
+	fmt.Printf("Agent %s quarantined\n", agent)
+	return nil
+}
+
+func scaleCmd(args []string) error {
+	fs := flag.NewFlagSet("scale", flag.ExitOnError)
+	to := fs.Int("to", -1, "desired number of agents")
+	if err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+	if *to < 0 {
+		return fmt.Errorf("scale expects a non-negative --to")
+	}
+	ctx := signalContext()
+	conf, err := loadOneShotConfig()
+	if err != nil {
+		return err
+	}
+
+	// note that a running autoscaler adjusts the capacity again in its
+	// next cycle as per the build queue
+	if err := setupAgentClusterClient(conf).SetCapacity(ctx, *to); err != nil {
+		return err
+	}
+	fmt.Printf("Desired capacity of %s set to %d\n", conf.Agent.AutoscalingGroup, *to)
+	return nil
+}
+
+func validateCmd(args []string) error {
+	if err := parseFlags(flag.NewFlagSet("validate", flag.ExitOnError), args, 0); err != nil {
+		return err
+	}
+	_, err := config.Load()
+	if err == nil {
+		fmt.Println("Configuration is valid")
+		return nil
+	}
+	if errs, ok := err.(config.ValidationErrors); ok {
+		for _, e := range errs {
+			fmt.Fprintln(os.Stderr, e)
+		}
+		return fmt.Errorf("found %d invalid parameters", len(errs))
+	}
+	return err
+}
+
+func versionCmd(args []string) error {
+	if err := parseFlags(flag.NewFlagSet("version", flag.ExitOnError), args, 0); err != nil {
+		return err
+	}
+	fmt.Println(Version)
+	return nil
+}
@@ -2,49 +2,117 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"github.com/Shuttl-Tech/drone-autoscaler/cluster"
 	"github.com/Shuttl-Tech/drone-autoscaler/config"
 	"github.com/Shuttl-Tech/drone-autoscaler/engine"
+	"github.com/Shuttl-Tech/drone-autoscaler/events"
+	"github.com/Shuttl-Tech/drone-autoscaler/notify"
+	"github.com/Shuttl-Tech/drone-autoscaler/resilience"
+	"github.com/Shuttl-Tech/drone-autoscaler/state"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/drone/drone-go/drone"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/oauth2"
+	"io"
+	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
 )
 
 const Version = "1.0.2"
 
 func main() {
+	name, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	cmd, ok := findCommand(name)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// returns a context that's cancelled when the app receives an interrupt or
+// is asked to terminate. Calls in progress are cancelled along with it, so
+// that shutdown is prompt.
+func signalContext() context.Context {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	signalCh := make(chan os.Signal, 1)
-	signal.Notify(signalCh, os.Interrupt)
+	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-signalCh
 		cancel()
 	}()
+	return ctx
+}
 
-	conf, err := config.Load()
-	if err != nil {
-		panic(err)
+// reloadOnHangup reloads the configuration every time the app receives
+// SIGHUP. Invalid configurations are rejected and the current one is kept.
+func reloadOnHangup(eng *engine.Engine, current config.Config) {
+	hangupCh := make(chan os.Signal, 1)
+	signal.Notify(hangupCh, syscall.SIGHUP)
+	for range hangupCh {
+		conf, err := config.Load()
+		if err != nil {
+			log.WithError(err).Errorln("Failed to reload configuration")
+			continue
+		}
+		if requiresRestart(current, conf) {
+			log.Warnln("Changes to the drone server, agent autoscaling group, " +
+				"metrics address or notification sinks take effect only after a restart")
+		}
+		setupLogging(conf, os.Stdout)
+		eng.Reload(conf)
+		current = conf
 	}
+}
 
-	setupLogging(conf)
-	client := setupDroneClient(ctx, conf)
-	fleet := setupAgentClusterClient(conf)
-
-	log.
-		WithField("version", Version).
-		Info("Starting Drone autoscaler")
-	engine.New(conf, client, fleet).Start(ctx)
+// returns true if the new configuration changes settings that are only
+// read at startup
+func requiresRestart(prev, next config.Config) bool {
+	return prev.Server != next.Server ||
+		prev.Agent.AutoscalingGroup != next.Agent.AutoscalingGroup ||
+		!reflect.DeepEqual(prev.Agent.FallbackAutoscalingGroups, next.Agent.FallbackAutoscalingGroups) ||
+		prev.Agent.FallbackCooldown != next.Agent.FallbackCooldown ||
+		prev.MetricsAddress != next.MetricsAddress ||
+		prev.Notify.WebhookURL != next.Notify.WebhookURL ||
+		prev.Notify.SlackWebhookURL != next.Notify.SlackWebhookURL ||
+		prev.Notify.UpscaleTemplate != next.Notify.UpscaleTemplate ||
+		prev.Notify.DownscaleFailedTemplate != next.Notify.DownscaleFailedTemplate ||
+		prev.Notify.QueuePausedTemplate != next.Notify.QueuePausedTemplate ||
+		prev.Notify.ScalingStuckTemplate != next.Notify.ScalingStuckTemplate ||
+		prev.Notify.StagesDiscardedTemplate != next.Notify.StagesDiscardedTemplate ||
+		prev.Notify.BuildCancelledTemplate != next.Notify.BuildCancelledTemplate ||
+		prev.Notify.QueueResumeFailedTemplate != next.Notify.QueueResumeFailedTemplate ||
+		prev.Notify.ScalingFailedTemplate != next.Notify.ScalingFailedTemplate ||
+		prev.Notify.ScalingTimedOutTemplate != next.Notify.ScalingTimedOutTemplate ||
+		prev.Notify.ZombieAgentsTemplate != next.Notify.ZombieAgentsTemplate ||
+		prev.Notify.AgentQuarantinedTemplate != next.Notify.AgentQuarantinedTemplate ||
+		prev.Retry != next.Retry ||
+		prev.CallTimeout != next.CallTimeout ||
+		prev.EventStream != next.EventStream ||
+		prev.StateFile != next.StateFile ||
+		prev.StateTags != next.StateTags
 }
 
-func setupLogging(c config.Config) {
-	log.SetOutput(os.Stdout)
+func setupLogging(c config.Config, out io.Writer) {
+	log.SetOutput(out)
 
 	if c.LogFormat == "json" {
 		log.SetFormatter(&log.JSONFormatter{})
@@ -57,6 +125,19 @@ func setupLogging(c config.Config) {
 	}
 }
 
+func setupMetricsServer(c config.Config) {
+	if c.MetricsAddress == "" {
+		return
+	}
+	// metrics are published via expvar, which registers its handler
+	// on the default mux
+	go func() {
+		if err := http.ListenAndServe(c.MetricsAddress, nil); err != nil {
+			log.WithError(err).Errorln("Metrics server stopped")
+		}
+	}()
+}
+
 func setupDroneClient(ctx context.Context, c config.Config) drone.Client {
 	oauth2Config := new(oauth2.Config)
 	authenticator := oauth2Config.Client(
@@ -65,17 +146,109 @@ func setupDroneClient(ctx context.Context, c config.Config) drone.Client {
 			AccessToken: c.Server.AuthToken,
 		},
 	)
+	// the drone client doesn't accept a context, so calls are bound by
+	// the http client's timeout instead
+	authenticator.Timeout = c.CallTimeout
+
+	uri := new(url.URL)
+	uri.Scheme = c.Server.Proto
+	uri.Host = c.Server.Host
+	return resilience.NewDroneClient(
+		ctx,
+		drone.NewClient(uri.String(), authenticator),
+		newDependency("drone", c),
+		resilience.Policy{
+			MaxAttempts: c.Retry.QueueResumeAttempts,
+			BaseDelay:   c.Retry.BaseDelay,
+			MaxDelay:    c.Retry.MaxDelay,
+		},
+	)
+}
+
+// returns a subscription to the event stream of the drone server. Unlike
+// other calls to drone, the stream isn't bound by the call timeout since
+// it's a long-lived connection.
+func setupEventStream(ctx context.Context, c config.Config) *events.Stream {
+	oauth2Config := new(oauth2.Config)
+	authenticator := oauth2Config.Client(
+		ctx,
+		&oauth2.Token{
+			AccessToken: c.Server.AuthToken,
+		},
+	)
+
 	uri := new(url.URL)
 	uri.Scheme = c.Server.Proto
 	uri.Host = c.Server.Host
-	return drone.NewClient(uri.String(), authenticator)
+	return events.NewStream(uri.String(), authenticator)
 }
 
 func setupAgentClusterClient(c config.Config) cluster.Cluster {
 	sess := session.Must(session.NewSession())
-	return cluster.New(
-		c.Agent.AutoscalingGroup,
-		ec2.New(sess),
-		autoscaling.New(sess),
+	return resilience.NewCluster(
+		cluster.NewWithFallbacks(
+			append([]string{c.Agent.AutoscalingGroup}, c.Agent.FallbackAutoscalingGroups...),
+			c.Agent.FallbackCooldown,
+			ec2.New(sess),
+			autoscaling.New(sess),
+		),
+		newDependency("aws", c),
 	)
 }
+
+// returns the store of the state of agents of the given cluster, or nil if
+// it's only kept in memory
+func setupStateStore(c config.Config, fleet cluster.Cluster) state.Store {
+	switch {
+	case c.StateTags:
+		return state.NewTagStore(fleet)
+	case c.StateFile != "":
+		return state.NewFileStore(c.StateFile)
+	default:
+		return nil
+	}
+}
+
+// returns a guard with retries and a circuit breaker of its own for calls
+// to the named external service
+func newDependency(name string, c config.Config) *resilience.Dependency {
+	return resilience.NewDependency(
+		name,
+		resilience.Policy{
+			MaxAttempts: c.Retry.MaxAttempts,
+			BaseDelay:   c.Retry.BaseDelay,
+			MaxDelay:    c.Retry.MaxDelay,
+			Timeout:     c.CallTimeout,
+		},
+		resilience.NewBreaker(name, c.Retry.BreakerThreshold, c.Retry.BreakerCooldown),
+	)
+}
+
+func setupNotifier(c config.Config) (notify.Notifier, error) {
+	templates, err := notify.ParseTemplates(map[notify.EventType]string{
+		notify.EventUpscale:           c.Notify.UpscaleTemplate,
+		notify.EventDownscaleFailed:   c.Notify.DownscaleFailedTemplate,
+		notify.EventQueuePaused:       c.Notify.QueuePausedTemplate,
+		notify.EventScalingStuck:      c.Notify.ScalingStuckTemplate,
+		notify.EventStagesDiscarded:   c.Notify.StagesDiscardedTemplate,
+		notify.EventBuildCancelled:    c.Notify.BuildCancelledTemplate,
+		notify.EventQueueResumeFailed: c.Notify.QueueResumeFailedTemplate,
+		notify.EventScalingFailed:     c.Notify.ScalingFailedTemplate,
+		notify.EventScalingTimedOut:   c.Notify.ScalingTimedOutTemplate,
+		notify.EventZombieAgents:      c.Notify.ZombieAgentsTemplate,
+		notify.EventAgentQuarantined:  c.Notify.AgentQuarantinedTemplate,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	sinks := make([]notify.Notifier, 0, 2)
+	if c.Notify.WebhookURL != "" {
+		sinks = append(sinks, notify.NewWebhook(c.Notify.WebhookURL, client))
+	}
+	if c.Notify.SlackWebhookURL != "" {
+		sinks = append(sinks, notify.NewSlack(c.Notify.SlackWebhookURL, client))
+	}
+	return notify.New(templates, sinks...), nil
+}
@@ -1,25 +1,90 @@
 package config
 
 import (
-	"github.com/kelseyhightower/envconfig"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
 	"time"
 )
 
+const (
+	// FileEnvVar is the environment variable containing the path to an
+	// optional YAML config file
+	FileEnvVar = "SCALER_CONFIG_FILE"
+
+	envPrefix = "SCALER"
+)
+
+var (
+	logFormats   = []string{"text", "json"}
+	serverProtos = []string{"http", "https"}
+)
+
+// ValidationErrors lists every invalid field of a configuration
+type ValidationErrors []error
+
+func (v ValidationErrors) Error() string {
+	msgs := make([]string, len(v))
+	for i, err := range v {
+		msgs[i] = err.Error()
+	}
+	return "invalid configuration: " + strings.Join(msgs, "; ")
+}
+
 type Config struct {
 	// The time interval between 2 consecutive runs of the autoscaler.
 	// Value can be any string parseable by time.ParseDuration()
-	ProbeInterval time.Duration `default:"30s" split_words:"true"`
+	ProbeInterval time.Duration `default:"30s" split_words:"true" yaml:"probe_interval"`
+
+	// Bounds of the interval between runs when it adapts to the load.
+	// The interval drops to the minimum while builds are pending or the
+	// agent cluster is scaling, and grows up to the maximum while the
+	// cluster is idle. The probe interval is used as is unless both are set.
+	ProbeIntervalMin time.Duration `default:"0s" split_words:"true" yaml:"probe_interval_min"`
+	ProbeIntervalMax time.Duration `default:"0s" split_words:"true" yaml:"probe_interval_max"`
+
+	// Maximum duration of a single run of the autoscaler, including
+	// planning and acting upon the plan. Calls that are still in progress
+	// are cancelled once it has passed.
+	CycleTimeout time.Duration `default:"5m" split_words:"true" yaml:"cycle_timeout"`
+
+	// Maximum duration of a single call to AWS or Drone. Calls that time
+	// out are retried.
+	CallTimeout time.Duration `default:"30s" split_words:"true" yaml:"call_timeout"`
+
+	// Subscribe to Drone's event stream to plan soon after builds change,
+	// rather than only once every probe interval
+	EventStream bool `default:"true" split_words:"true" yaml:"event_stream"`
+
+	// Duration to wait after an event from Drone's event stream before
+	// planning, so that a burst of events triggers a single run
+	EventDebounce time.Duration `default:"2s" split_words:"true" yaml:"event_debounce"`
 
 	// Valid values are "text" and "json"
-	LogFormat string `default:"json" split_words:"true"`
+	LogFormat string `default:"json" split_words:"true" yaml:"log_format"`
 
 	// Allows running the app in debug mode for development environments
-	Debug bool `default:"false"`
+	Debug bool `default:"false" yaml:"debug"`
 
 	// If true, the app runs in DRY mode. Only the plan phase is run.
 	// The final scaling plan generated is logged and no actual changes
 	// are made to the infrastructure.
-	Dry bool `default:"false"`
+	Dry bool `default:"false" yaml:"dry"`
+
+	// Address on which the app's metrics are served at /debug/vars,
+	// eg- ":9102". Metrics are not served when empty.
+	MetricsAddress string `split_words:"true" yaml:"metrics_address"`
+
+	// Path of the file in which state tracked across cycles, like when
+	// agents were last busy, is kept so that it survives restarts. The
+	// state is only kept in memory when empty.
+	StateFile string `split_words:"true" yaml:"state_file"`
+
+	// If true, the state of every agent is kept in its EC2 tags instead,
+	// where operators can see it too. Agents are also tagged while they're
+	// being retired.
+	StateTags bool `default:"false" split_words:"true" yaml:"state_tags"`
 
 	Build struct {
 		// The maximum duration for which a build is allowed to be in
@@ -29,7 +94,7 @@ type Config struct {
 		// are stuck in pending state.
 		// A negative value indicates that there is no upper limit on
 		// the duration of a pending build.
-		PendingMaxDuration time.Duration `envconfig:"DRONE_BUILD_PENDING_MAX_DURATION" default:"-1s"`
+		PendingMaxDuration time.Duration `envconfig:"DRONE_BUILD_PENDING_MAX_DURATION" default:"-1s" yaml:"pending_max_duration"`
 
 		// The maximum duration for which a build is allowed to be in
 		// running state. Once the build has crossed this threshold,
@@ -38,38 +103,388 @@ type Config struct {
 		// are stuck in running state.
 		// A negative value indicates that there is no upper limit on
 		// the duration of a running build.
-		RunningMaxDuration time.Duration `envconfig:"DRONE_BUILD_RUNNING_MAX_DURATION" default:"-1s"`
-	}
+		RunningMaxDuration time.Duration `envconfig:"DRONE_BUILD_RUNNING_MAX_DURATION" default:"-1s" yaml:"running_max_duration"`
+
+		// The hard limit on the duration for which a build is allowed to
+		// be in pending or running state. Once a build has crossed it,
+		// autoscaler cancels the build so that zombie builds don't keep
+		// agents busy forever.
+		// A zero or negative value disables cancellation of builds.
+		CancelMaxDuration time.Duration `envconfig:"DRONE_BUILD_CANCEL_MAX_DURATION" default:"-1s" yaml:"cancel_max_duration"`
+
+		// Rules that customise the slot weight, max pending duration or
+		// exclusion of stages based on their repository. Supplied as a
+		// list in the config file, or a JSON array via environment, eg-
+		// [{"repo": "octocat/heavy-*", "weight": 4}, {"namespace": "lint", "exclude": true}]
+		// The first rule matching a stage's repository applies to it.
+		Rules BuildRules `envconfig:"DRONE_BUILD_RULES" yaml:"rules"`
+	} `yaml:"build"`
 
 	Agent struct {
 		// Minimum amount of time for which an Agent node should've been
 		// up before it can be considered for destruction during downscaling.
 		// This avoids accidentally deleting an agent that's not running
 		// any workloads only because it was provisioned very recently
-		MinRetirementAge time.Duration `envconfig:"DRONE_AGENT_MIN_RETIREMENT_AGE" default:"10m"`
+		MinRetirementAge time.Duration `envconfig:"DRONE_AGENT_MIN_RETIREMENT_AGE" default:"10m" yaml:"min_retirement_age"`
+
+		// Minimum amount of time for which an agent must have run no
+		// builds before it can be retired, so that agents that just
+		// finished a build aren't retired only to be launched again
+		MinIdleDuration time.Duration `envconfig:"DRONE_AGENT_MIN_IDLE_DURATION" default:"5m" yaml:"min_idle_duration"`
+
+		// Maximum amount of time since launch after which an agent is
+		// recycled as soon as it's idle, so that long-lived agents don't
+		// accumulate garbage. Agents don't expire when 0.
+		MaxAge time.Duration `envconfig:"DRONE_AGENT_MAX_AGE" default:"0s" yaml:"max_age"`
+
+		// Maximum number of idle agents launched from an outdated launch
+		// template version or launch configuration to replace per cycle,
+		// until the fleet converges. Outdated agents aren't replaced when 0.
+		ReplacementRate int `envconfig:"DRONE_AGENT_REPLACEMENT_RATE" default:"0" yaml:"replacement_rate"`
+
+		// Number of consecutive cycles an agent may stay idle while builds
+		// are pending before it's considered a zombie, whose runner is
+		// broken, and marked unhealthy so that the autoscaling group
+		// replaces it. Zombie agents aren't detected when 0.
+		ZombieCycles int `envconfig:"DRONE_AGENT_ZOMBIE_CYCLES" default:"0" yaml:"zombie_cycles"`
+
+		// Fraction of the recent stages run by an agent that must have
+		// errored, eg- due to Docker daemon failures, for the agent to be
+		// quarantined for inspection. Agents are only quarantined manually
+		// when 0.
+		QuarantineErrorRate float64 `envconfig:"DRONE_AGENT_QUARANTINE_ERROR_RATE" default:"0" yaml:"quarantine_error_rate"`
+
+		// Number of the most recent stages of an agent the error rate is
+		// computed over, once the agent has run that many
+		QuarantineWindow int `envconfig:"DRONE_AGENT_QUARANTINE_WINDOW" default:"10" yaml:"quarantine_window"`
+
+		// Duration after which quarantined agents are terminated. They're
+		// kept until terminated manually when 0.
+		QuarantineRetention time.Duration `envconfig:"DRONE_AGENT_QUARANTINE_RETENTION" default:"72h" yaml:"quarantine_retention"`
 
 		// Max number of builds that can run on an agent at any point
-		// of time
-		MaxBuilds int `envconfig:"DRONE_AGENT_MAX_BUILDS" required:"true"`
+		// of time. This is also the assumed capacity of newly launched
+		// agents when capacity varies by instance type.
+		MaxBuilds int `envconfig:"DRONE_AGENT_MAX_BUILDS" yaml:"max_builds"`
+
+		// Number of builds that can run on agents of specific EC2
+		// instance types, eg- "c5.xlarge:2,c5.4xlarge:8". Takes
+		// precedence over capacity derived from instance resources.
+		InstanceCapacity map[string]int `envconfig:"DRONE_AGENT_INSTANCE_CAPACITY" yaml:"instance_capacity"`
+
+		// Number of vCPUs & MiB of memory needed by a single build. When
+		// set, the capacity of agents of instance types not listed in
+		// InstanceCapacity is derived from their resources. Agents fall
+		// back to MaxBuilds when neither is set.
+		VCPUsPerBuild  float64 `envconfig:"DRONE_AGENT_VCPUS_PER_BUILD" default:"0" yaml:"vcpus_per_build"`
+		MemoryPerBuild int64   `envconfig:"DRONE_AGENT_MEMORY_PER_BUILD" default:"0" yaml:"memory_per_build"`
+
+		// Strategy used to choose which idle agents to retire first
+		// when downscaling. See the Retirement* constants for valid values.
+		RetirementStrategy string `envconfig:"DRONE_AGENT_RETIREMENT_STRATEGY" default:"default" yaml:"retirement_strategy"`
+
+		// Hourly price of EC2 instance types, eg- "c5.xlarge:0.17,c5.4xlarge:0.68".
+		// Used by the most-expensive retirement strategy.
+		InstancePrices map[string]float64 `envconfig:"DRONE_AGENT_INSTANCE_PRICES" yaml:"instance_prices"`
+
+		// Duration after which the planner stops waiting on a scaling
+		// activity of the agent autoscaling group that hasn't finished,
+		// eg- because instances are failing to launch. Disabled when 0.
+		ScalingTimeout time.Duration `envconfig:"DRONE_AGENT_SCALING_TIMEOUT" default:"30m" yaml:"scaling_timeout"`
+
+		// Reset the desired capacity of the agent autoscaling group to
+		// the number of running agents once a scaling activity times out,
+		// so that the group stops attempting to launch instances
+		ResetStuckCapacity bool `envconfig:"DRONE_AGENT_RESET_STUCK_CAPACITY" default:"false" yaml:"reset_stuck_capacity"`
 
 		// Minimum number of agents to maintain in the cluster,
 		// regardless of the number of builds running
-		MinCount int `envconfig:"DRONE_AGENT_MIN_COUNT" default:"1"`
+		MinCount int `envconfig:"DRONE_AGENT_MIN_COUNT" default:"1" yaml:"min_count"`
+
+		// Free build slots to keep available at all times, so that new
+		// builds don't wait for agents to boot. It's the greater of the
+		// absolute number of slots and the percentage of in-use slots.
+		HeadroomSlots   int     `envconfig:"DRONE_AGENT_HEADROOM_SLOTS" default:"0" yaml:"headroom_slots"`
+		HeadroomPercent float64 `envconfig:"DRONE_AGENT_HEADROOM_PERCENT" default:"0" yaml:"headroom_percent"`
 
 		// Name of the AWS autoscaling group containing agent nodes
-		AutoscalingGroup string `envconfig:"DRONE_AGENT_AUTOSCALING_GROUP" required:"true"`
-	}
+		AutoscalingGroup string `envconfig:"DRONE_AGENT_AUTOSCALING_GROUP" yaml:"autoscaling_group"`
+
+		// Names of autoscaling groups to add agents to, in order of
+		// preference, when the primary group can't launch instances due
+		// to insufficient EC2 capacity, eg- "ci-agents-m5,ci-agents-c4"
+		FallbackAutoscalingGroups []string `envconfig:"DRONE_AGENT_FALLBACK_AUTOSCALING_GROUPS" yaml:"fallback_autoscaling_groups"`
+
+		// Duration for which a group that failed to launch instances due
+		// to insufficient capacity is skipped in favour of the next one
+		FallbackCooldown time.Duration `envconfig:"DRONE_AGENT_FALLBACK_COOLDOWN" default:"10m" yaml:"fallback_cooldown"`
+	} `yaml:"agent"`
+
+	Notify struct {
+		// URL of a webhook that receives a generic JSON payload for
+		// every scaling event. Notifications are disabled when empty.
+		WebhookURL string `envconfig:"SCALER_NOTIFY_WEBHOOK_URL" yaml:"webhook_url"`
+
+		// URL of a Slack-compatible incoming webhook that receives a
+		// message for every scaling event. Disabled when empty.
+		SlackWebhookURL string `envconfig:"SCALER_NOTIFY_SLACK_WEBHOOK_URL" yaml:"slack_webhook_url"`
+
+		// Minimum number of agents that must be added in a single
+		// cycle for an upscale to be notified
+		UpscaleThreshold int `envconfig:"SCALER_NOTIFY_UPSCALE_THRESHOLD" default:"5" yaml:"upscale_threshold"`
+
+		// Minimum duration for which the build queue must remain
+		// paused while downscaling for it to be notified
+		QueuePauseThreshold time.Duration `envconfig:"SCALER_NOTIFY_QUEUE_PAUSE_THRESHOLD" default:"30s" yaml:"queue_pause_threshold"`
+
+		// Minimum duration for which a scaling activity must remain in
+		// progress in the agent autoscaling group for it to be notified
+		ScalingStuckThreshold time.Duration `envconfig:"SCALER_NOTIFY_SCALING_STUCK_THRESHOLD" default:"15m" yaml:"scaling_stuck_threshold"`
+
+		// Go text/template overrides for the message of each event.
+		// Templates are executed against the event, so event data
+		// is available via .Fields
+		UpscaleTemplate           string `envconfig:"SCALER_NOTIFY_UPSCALE_TEMPLATE" yaml:"upscale_template"`
+		DownscaleFailedTemplate   string `envconfig:"SCALER_NOTIFY_DOWNSCALE_FAILED_TEMPLATE" yaml:"downscale_failed_template"`
+		QueuePausedTemplate       string `envconfig:"SCALER_NOTIFY_QUEUE_PAUSED_TEMPLATE" yaml:"queue_paused_template"`
+		ScalingStuckTemplate      string `envconfig:"SCALER_NOTIFY_SCALING_STUCK_TEMPLATE" yaml:"scaling_stuck_template"`
+		StagesDiscardedTemplate   string `envconfig:"SCALER_NOTIFY_STAGES_DISCARDED_TEMPLATE" yaml:"stages_discarded_template"`
+		BuildCancelledTemplate    string `envconfig:"SCALER_NOTIFY_BUILD_CANCELLED_TEMPLATE" yaml:"build_cancelled_template"`
+		QueueResumeFailedTemplate string `envconfig:"SCALER_NOTIFY_QUEUE_RESUME_FAILED_TEMPLATE" yaml:"queue_resume_failed_template"`
+		ScalingFailedTemplate     string `envconfig:"SCALER_NOTIFY_SCALING_FAILED_TEMPLATE" yaml:"scaling_failed_template"`
+		ScalingTimedOutTemplate   string `envconfig:"SCALER_NOTIFY_SCALING_TIMED_OUT_TEMPLATE" yaml:"scaling_timed_out_template"`
+		ZombieAgentsTemplate      string `envconfig:"SCALER_NOTIFY_ZOMBIE_AGENTS_TEMPLATE" yaml:"zombie_agents_template"`
+		AgentQuarantinedTemplate  string `envconfig:"SCALER_NOTIFY_AGENT_QUARANTINED_TEMPLATE" yaml:"agent_quarantined_template"`
+	} `yaml:"notify"`
+
+	// Scaling policy that decides when to add or retire agents
+	Policy struct {
+		// Name of the policy. See the Policy* constants for valid values.
+		Name string `envconfig:"SCALER_POLICY" default:"reactive" yaml:"name"`
+
+		// Fraction of build slots the target-utilization policy keeps
+		// occupied by pending & running builds
+		TargetUtilization float64 `envconfig:"SCALER_POLICY_TARGET_UTILIZATION" default:"0.8" yaml:"target_utilization"`
+
+		// Time the oldest pending stage may wait before the queue-wait
+		// policy adds agents
+		QueueWaitSLO time.Duration `envconfig:"SCALER_POLICY_QUEUE_WAIT_SLO" default:"2m" yaml:"queue_wait_slo"`
+	} `yaml:"policy"`
+
+	Retry struct {
+		// Maximum number of attempts of a call to AWS or Drone that fails
+		// due to throttling, server or network errors
+		MaxAttempts int `envconfig:"SCALER_RETRY_MAX_ATTEMPTS" default:"3" yaml:"max_attempts"`
+
+		// Upper bound of the random delay before the first retry. It
+		// doubles with every subsequent retry, up to the max delay.
+		BaseDelay time.Duration `envconfig:"SCALER_RETRY_BASE_DELAY" default:"200ms" yaml:"base_delay"`
+		MaxDelay  time.Duration `envconfig:"SCALER_RETRY_MAX_DELAY" default:"5s" yaml:"max_delay"`
+
+		// Maximum number of attempts to resume the build queue after
+		// downscaling. The app exits once they're exhausted, since the
+		// queue must then be resumed manually.
+		QueueResumeAttempts int `envconfig:"SCALER_RETRY_QUEUE_RESUME_ATTEMPTS" default:"10" yaml:"queue_resume_attempts"`
+
+		// Number of consecutive failed calls after which calls to AWS or
+		// Drone fail immediately, for the cooldown duration
+		BreakerThreshold int           `envconfig:"SCALER_RETRY_BREAKER_THRESHOLD" default:"5" yaml:"breaker_threshold"`
+		BreakerCooldown  time.Duration `envconfig:"SCALER_RETRY_BREAKER_COOLDOWN" default:"1m" yaml:"breaker_cooldown"`
+	} `yaml:"retry"`
 
 	// Information about the Drone server the app will talk to
 	Server struct {
-		Proto     string `envconfig:"DRONE_SERVER_PROTO" default:"http"`
-		Host      string `envconfig:"DRONE_SERVER_HOST" required:"true"`
-		AuthToken string `envconfig:"DRONE_SERVER_AUTH_TOKEN" required:"true"`
-	}
+		Proto     string `envconfig:"DRONE_SERVER_PROTO" default:"http" yaml:"proto"`
+		Host      string `envconfig:"DRONE_SERVER_HOST" yaml:"host"`
+		AuthToken string `envconfig:"DRONE_SERVER_AUTH_TOKEN" yaml:"auth_token"`
+	} `yaml:"server"`
+}
+
+// Strategies to choose which idle agents are retired first when downscaling
+const (
+	// RetirementDefault retires agents in the order AWS returns them
+	RetirementDefault = "default"
+
+	// RetirementOldestFirst retires agents with the oldest launch time first
+	RetirementOldestFirst = "oldest-first"
+
+	// RetirementNewestFirst retires agents with the newest launch time first
+	RetirementNewestFirst = "newest-first"
+
+	// RetirementBillingHour retires agents closest to the end of their
+	// current billing hour first
+	RetirementBillingHour = "billing-hour"
+
+	// RetirementMostExpensive retires agents of the instance types with
+	// the highest configured price first
+	RetirementMostExpensive = "most-expensive"
+
+	// RetirementSpotFirst retires spot agents before on-demand ones
+	RetirementSpotFirst = "spot-first"
+
+	// RetirementBalanceZones retires agents such that the fleet remains
+	// balanced across availability zones
+	RetirementBalanceZones = "az-balance"
+)
+
+var retirementStrategies = []string{
+	RetirementDefault,
+	RetirementOldestFirst,
+	RetirementNewestFirst,
+	RetirementBillingHour,
+	RetirementMostExpensive,
+	RetirementSpotFirst,
+	RetirementBalanceZones,
+}
+
+// Policies that decide when to add or retire agents
+const (
+	// PolicyReactive adds agents for builds that don't fit in the free
+	// build slots, and retires idle agents once no builds are pending
+	PolicyReactive = "reactive"
+
+	// PolicyTargetUtilization keeps the share of build slots occupied by
+	// pending & running builds at the target utilization
+	PolicyTargetUtilization = "target-utilization"
+
+	// PolicyQueueWait adds agents once the oldest pending stage has waited
+	// for longer than the queue wait SLO
+	PolicyQueueWait = "queue-wait"
+)
+
+var policies = []string{
+	PolicyReactive,
+	PolicyTargetUtilization,
+	PolicyQueueWait,
 }
 
+// Load reads the app's configuration from the file referred to by
+// SCALER_CONFIG_FILE, if any, and the environment
 func Load() (Config, error) {
+	return LoadFile(os.Getenv(FileEnvVar))
+}
+
+// LoadFile reads the app's configuration from the given YAML file and the
+// environment. Values set via environment take precedence over the ones
+// in the file, which in turn take precedence over defaults. An empty path
+// loads the configuration from the environment alone.
+func LoadFile(path string) (Config, error) {
+	// envconfig can't tell explicitly set values apart from defaults, so
+	// defaults are applied first and the variables that are set are
+	// layered on top of the file
 	conf := Config{}
-	err := envconfig.Process("SCALER", &conf)
-	return conf, err
+	v := reflect.ValueOf(&conf).Elem()
+	errs := applyEnv(v, envPrefix, false)
+	if path != "" {
+		if err := readFile(path, &conf); err != nil {
+			return conf, err
+		}
+	}
+	errs = append(errs, applyEnv(v, envPrefix, true)...)
+	return conf, conf.validate(errs...)
+}
+
+// validates every field of the configuration, reporting all invalid
+// fields at once along with the given errors met while loading it
+func (c Config) validate(loadErrs ...error) error {
+	errs := ValidationErrors(loadErrs)
+	check := func(valid bool, format string, args ...interface{}) {
+		if !valid {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.ProbeInterval > 0, "probe interval must be positive, got %v", c.ProbeInterval)
+	check(c.ProbeIntervalMin >= 0, "probe interval min cannot be negative, got %v", c.ProbeIntervalMin)
+	check(
+		c.ProbeIntervalMax >= c.ProbeIntervalMin,
+		"probe interval max %v cannot be less than min %v",
+		c.ProbeIntervalMax,
+		c.ProbeIntervalMin,
+	)
+	check(c.CycleTimeout > 0, "cycle timeout must be positive, got %v", c.CycleTimeout)
+	check(c.CallTimeout > 0, "call timeout must be positive, got %v", c.CallTimeout)
+	check(!c.StateTags || c.StateFile == "", "state file and state tags cannot be used together")
+	check(c.EventDebounce >= 0, "event debounce cannot be negative, got %v", c.EventDebounce)
+	check(oneOf(c.LogFormat, logFormats), "invalid log format %q, must be one of %v", c.LogFormat, logFormats)
+
+	check(c.Agent.MaxBuilds > 0, "agent max builds must be at least 1, got %d", c.Agent.MaxBuilds)
+	check(c.Agent.MinCount >= 0, "agent min count cannot be negative, got %d", c.Agent.MinCount)
+	check(c.Agent.MinIdleDuration >= 0, "agent min idle duration cannot be negative, got %v", c.Agent.MinIdleDuration)
+	check(c.Agent.MaxAge >= 0, "agent max age cannot be negative, got %v", c.Agent.MaxAge)
+	check(c.Agent.ReplacementRate >= 0, "agent replacement rate cannot be negative, got %d", c.Agent.ReplacementRate)
+	check(c.Agent.ZombieCycles >= 0, "agent zombie cycles cannot be negative, got %d", c.Agent.ZombieCycles)
+	check(
+		c.Agent.QuarantineErrorRate >= 0 && c.Agent.QuarantineErrorRate <= 1,
+		"agent quarantine error rate must be between 0 and 1, got %v",
+		c.Agent.QuarantineErrorRate,
+	)
+	check(c.Agent.QuarantineWindow > 0, "agent quarantine window must be at least 1, got %d", c.Agent.QuarantineWindow)
+	check(
+		c.Agent.QuarantineRetention >= 0,
+		"agent quarantine retention cannot be negative, got %v",
+		c.Agent.QuarantineRetention,
+	)
+	check(c.Agent.HeadroomSlots >= 0, "agent headroom slots cannot be negative, got %d", c.Agent.HeadroomSlots)
+	check(c.Agent.HeadroomPercent >= 0, "agent headroom percent cannot be negative, got %v", c.Agent.HeadroomPercent)
+	check(c.Agent.AutoscalingGroup != "", "agent autoscaling group is required")
+	seen := map[string]bool{c.Agent.AutoscalingGroup: true}
+	for _, g := range c.Agent.FallbackAutoscalingGroups {
+		check(g != "" && !seen[g], "fallback autoscaling group %q must be named and distinct from the other groups", g)
+		seen[g] = true
+	}
+	check(c.Agent.FallbackCooldown > 0, "agent fallback cooldown must be positive, got %v", c.Agent.FallbackCooldown)
+	check(c.Agent.VCPUsPerBuild >= 0, "agent vcpus per build cannot be negative, got %v", c.Agent.VCPUsPerBuild)
+	check(c.Agent.MemoryPerBuild >= 0, "agent memory per build cannot be negative, got %d", c.Agent.MemoryPerBuild)
+	check(c.Agent.ScalingTimeout >= 0, "agent scaling timeout cannot be negative, got %v", c.Agent.ScalingTimeout)
+	for t, capacity := range c.Agent.InstanceCapacity {
+		check(capacity > 0, "capacity of instance type %s must be at least 1, got %d", t, capacity)
+	}
+	check(
+		oneOf(c.Agent.RetirementStrategy, retirementStrategies),
+		"invalid agent retirement strategy %q, must be one of %v",
+		c.Agent.RetirementStrategy,
+		retirementStrategies,
+	)
+
+	check(oneOf(c.Policy.Name, policies), "invalid scaling policy %q, must be one of %v", c.Policy.Name, policies)
+	check(
+		c.Policy.TargetUtilization > 0 && c.Policy.TargetUtilization <= 1,
+		"policy target utilization must be within (0, 1], got %v",
+		c.Policy.TargetUtilization,
+	)
+	check(c.Policy.QueueWaitSLO > 0, "policy queue wait SLO must be positive, got %v", c.Policy.QueueWaitSLO)
+
+	for i, r := range c.Build.Rules {
+		if err := r.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("build rule %d: %v", i+1, err))
+		}
+	}
+
+	check(c.Notify.UpscaleThreshold >= 0, "upscale notification threshold cannot be negative, got %d", c.Notify.UpscaleThreshold)
+
+	check(c.Retry.MaxAttempts > 0, "retry max attempts must be at least 1, got %d", c.Retry.MaxAttempts)
+	check(c.Retry.BaseDelay >= 0, "retry base delay cannot be negative, got %v", c.Retry.BaseDelay)
+	check(c.Retry.MaxDelay >= c.Retry.BaseDelay, "retry max delay %v cannot be less than base delay %v", c.Retry.MaxDelay, c.Retry.BaseDelay)
+	check(c.Retry.QueueResumeAttempts > 0, "queue resume attempts must be at least 1, got %d", c.Retry.QueueResumeAttempts)
+	check(c.Retry.BreakerThreshold > 0, "breaker threshold must be at least 1, got %d", c.Retry.BreakerThreshold)
+	check(c.Retry.BreakerCooldown > 0, "breaker cooldown must be positive, got %v", c.Retry.BreakerCooldown)
+
+	check(oneOf(c.Server.Proto, serverProtos), "invalid drone server protocol %q, must be one of %v", c.Server.Proto, serverProtos)
+	check(c.Server.Host != "", "drone server host is required")
+	check(c.Server.AuthToken != "", "drone server auth token is required")
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func oneOf(value string, valid []string) bool {
+	for _, v := range valid {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }
@@ -2,7 +2,9 @@ package config
 
 import (
 	"encoding/json"
+	"github.com/kelseyhightower/envconfig"
 	"github.com/kr/pretty"
+	"io/ioutil"
 	"os"
 	"reflect"
 	"testing"
@@ -21,6 +23,21 @@ func TestDefaults(t *testing.T) {
 	if got, want := conf.ProbeInterval, time.Second*30; got != want {
 		t.Errorf("Want default probe interval %v, got %v", want, got)
 	}
+	if conf.ProbeIntervalMin != 0 || conf.ProbeIntervalMax != 0 {
+		t.Errorf("Want adaptive probe interval disabled by default, got [%v, %v]", conf.ProbeIntervalMin, conf.ProbeIntervalMax)
+	}
+	if got, want := conf.CycleTimeout, time.Minute*5; got != want {
+		t.Errorf("Want default cycle timeout %v, got %v", want, got)
+	}
+	if got, want := conf.CallTimeout, time.Second*30; got != want {
+		t.Errorf("Want default call timeout %v, got %v", want, got)
+	}
+	if got, want := conf.EventStream, true; got != want {
+		t.Errorf("Want default event stream %v, got %v", want, got)
+	}
+	if got, want := conf.EventDebounce, time.Second*2; got != want {
+		t.Errorf("Want default event debounce %v, got %v", want, got)
+	}
 	if got, want := conf.LogFormat, "json"; got != want {
 		t.Errorf("Want default log format %v, got %v", want, got)
 	}
@@ -36,12 +53,96 @@ func TestDefaults(t *testing.T) {
 	if got, want := conf.Build.RunningMaxDuration, time.Second*-1; got != want {
 		t.Errorf("Want default running build max duration %v, got %v", want, got)
 	}
+	if got, want := conf.Build.CancelMaxDuration, time.Second*-1; got != want {
+		t.Errorf("Want default build cancel max duration %v, got %v", want, got)
+	}
+	if got, want := conf.MetricsAddress, ""; got != want {
+		t.Errorf("Want default metrics address %q, got %q", want, got)
+	}
 	if got, want := conf.Agent.MinRetirementAge, time.Minute*10; got != want {
 		t.Errorf("Want default minimum retirement age of agent %v, got %v", want, got)
 	}
+	if got, want := conf.Agent.MinIdleDuration, time.Minute*5; got != want {
+		t.Errorf("Want default minimum idle duration of agent %v, got %v", want, got)
+	}
+	if conf.Agent.MaxAge != 0 {
+		t.Errorf("Want agents to never expire by default, got max age %v", conf.Agent.MaxAge)
+	}
+	if conf.Agent.ReplacementRate != 0 {
+		t.Errorf("Want outdated agents to not be replaced by default, got rate %d", conf.Agent.ReplacementRate)
+	}
+	if conf.Agent.ZombieCycles != 0 {
+		t.Errorf("Want zombie agents to not be detected by default, got %d cycles", conf.Agent.ZombieCycles)
+	}
+	if conf.Agent.QuarantineErrorRate != 0 {
+		t.Errorf("Want agents to not be quarantined by default, got error rate %v", conf.Agent.QuarantineErrorRate)
+	}
+	if got, want := conf.Agent.QuarantineWindow, 10; got != want {
+		t.Errorf("Want default agent quarantine window %d, got %d", want, got)
+	}
+	if got, want := conf.Agent.QuarantineRetention, time.Hour*72; got != want {
+		t.Errorf("Want default agent quarantine retention %v, got %v", want, got)
+	}
+	if conf.StateFile != "" {
+		t.Errorf("Want no state file by default, got %q", conf.StateFile)
+	}
+	if conf.StateTags {
+		t.Error("Want state tags disabled by default")
+	}
+	if conf.Agent.HeadroomSlots != 0 || conf.Agent.HeadroomPercent != 0 {
+		t.Errorf("Want no agent headroom by default, got %d slots & %v%%", conf.Agent.HeadroomSlots, conf.Agent.HeadroomPercent)
+	}
+	if got, want := conf.Agent.RetirementStrategy, "default"; got != want {
+		t.Errorf("Want default agent retirement strategy %v, got %v", want, got)
+	}
 	if got, want := conf.Agent.MinCount, 1; got != want {
 		t.Errorf("Want default minimum agent count %v, got %v", want, got)
 	}
+	if got, want := conf.Agent.ScalingTimeout, time.Minute*30; got != want {
+		t.Errorf("Want default agent scaling timeout %v, got %v", want, got)
+	}
+	if got, want := conf.Agent.ResetStuckCapacity, false; got != want {
+		t.Errorf("Want default reset of stuck capacity %v, got %v", want, got)
+	}
+	if got, want := conf.Agent.FallbackCooldown, time.Minute*10; got != want {
+		t.Errorf("Want default agent fallback cooldown %v, got %v", want, got)
+	}
+	if got, want := conf.Notify.UpscaleThreshold, 5; got != want {
+		t.Errorf("Want default upscale notification threshold %v, got %v", want, got)
+	}
+	if got, want := conf.Notify.QueuePauseThreshold, time.Second*30; got != want {
+		t.Errorf("Want default queue pause notification threshold %v, got %v", want, got)
+	}
+	if got, want := conf.Notify.ScalingStuckThreshold, time.Minute*15; got != want {
+		t.Errorf("Want default stuck scaling notification threshold %v, got %v", want, got)
+	}
+	if got, want := conf.Policy.Name, PolicyReactive; got != want {
+		t.Errorf("Want default scaling policy %v, got %v", want, got)
+	}
+	if got, want := conf.Policy.TargetUtilization, 0.8; got != want {
+		t.Errorf("Want default policy target utilization %v, got %v", want, got)
+	}
+	if got, want := conf.Policy.QueueWaitSLO, time.Minute*2; got != want {
+		t.Errorf("Want default policy queue wait SLO %v, got %v", want, got)
+	}
+	if got, want := conf.Retry.MaxAttempts, 3; got != want {
+		t.Errorf("Want default retry max attempts %v, got %v", want, got)
+	}
+	if got, want := conf.Retry.BaseDelay, time.Millisecond*200; got != want {
+		t.Errorf("Want default retry base delay %v, got %v", want, got)
+	}
+	if got, want := conf.Retry.MaxDelay, time.Second*5; got != want {
+		t.Errorf("Want default retry max delay %v, got %v", want, got)
+	}
+	if got, want := conf.Retry.QueueResumeAttempts, 10; got != want {
+		t.Errorf("Want default queue resume attempts %v, got %v", want, got)
+	}
+	if got, want := conf.Retry.BreakerThreshold, 5; got != want {
+		t.Errorf("Want default breaker threshold %v, got %v", want, got)
+	}
+	if got, want := conf.Retry.BreakerCooldown, time.Minute; got != want {
+		t.Errorf("Want default breaker cooldown %v, got %v", want, got)
+	}
 	if got, want := conf.Server.Proto, "http"; got != want {
 		t.Errorf("Want default drone server protocl %v, got %v", want, got)
 	}
@@ -66,6 +167,157 @@ func TestLoad(t *testing.T) {
 	}
 }
 
+func TestLoad_InvalidRetirementStrategy(t *testing.T) {
+	setEnvVars(required)
+	defer unsetEnvVars(required)
+
+	os.Setenv("DRONE_AGENT_RETIREMENT_STRATEGY", "random")
+	defer os.Unsetenv("DRONE_AGENT_RETIREMENT_STRATEGY")
+
+	if _, err := Load(); err == nil {
+		t.Error("Want error for invalid retirement strategy")
+	}
+}
+
+func TestLoad_InvalidPolicy(t *testing.T) {
+	setEnvVars(required)
+	defer unsetEnvVars(required)
+
+	os.Setenv("SCALER_POLICY", "predictive")
+	defer os.Unsetenv("SCALER_POLICY")
+
+	if _, err := Load(); err == nil {
+		t.Error("Want error for invalid scaling policy")
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "scaler-*.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString(`
+probe_interval: 1m
+agent:
+  max_builds: 4
+  min_count: 2
+  autoscaling_group: ci-agent-cluster
+  instance_capacity:
+    c5.4xlarge: 8
+build:
+  rules:
+    - repo: octocat/heavy-*
+      weight: 4
+      pending_max_duration: 30m
+server:
+  host: drone.company.com
+  auth_token: 1234567890abcdxyz
+`)
+	f.Close()
+
+	// environment takes precedence over the file
+	os.Setenv("DRONE_AGENT_MIN_COUNT", "5")
+	defer os.Unsetenv("DRONE_AGENT_MIN_COUNT")
+
+	conf, err := LoadFile(f.Name())
+	if err != nil {
+		t.Fatalf("Did not expect loader error: %v", err)
+	}
+	if got, want := conf.ProbeInterval, time.Minute; got != want {
+		t.Errorf("Want probe interval %v from file, got %v", want, got)
+	}
+	if got, want := conf.Agent.MaxBuilds, 4; got != want {
+		t.Errorf("Want max builds %v from file, got %v", want, got)
+	}
+	if got, want := conf.Agent.MinCount, 5; got != want {
+		t.Errorf("Want min count %v from environment, got %v", want, got)
+	}
+	if got, want := conf.Agent.InstanceCapacity["c5.4xlarge"], 8; got != want {
+		t.Errorf("Want instance capacity %v from file, got %v", want, got)
+	}
+	if got, want := conf.Agent.MinRetirementAge, time.Minute*10; got != want {
+		t.Errorf("Want default minimum retirement age %v, got %v", want, got)
+	}
+	want := BuildRules{{Repo: "octocat/heavy-*", Weight: 4, PendingMaxDuration: 30 * time.Minute}}
+	if !reflect.DeepEqual(conf.Build.Rules, want) {
+		t.Errorf("Want build rules %+v from file, got %+v", want, conf.Build.Rules)
+	}
+	if got, want := conf.Server.Host, "drone.company.com"; got != want {
+		t.Errorf("Want drone server host %v from file, got %v", want, got)
+	}
+}
+
+func TestLoadFile_UnknownKey(t *testing.T) {
+	setEnvVars(required)
+	defer unsetEnvVars(required)
+
+	f, err := ioutil.TempFile("", "scaler-*.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("agent:\n  max_bulids: 4\n")
+	f.Close()
+
+	if _, err := LoadFile(f.Name()); err == nil {
+		t.Error("Want error for unknown key in config file")
+	}
+}
+
+func TestLoad_ValidationErrors(t *testing.T) {
+	invalid := map[string]string{
+		"DRONE_AGENT_MAX_BUILDS":          "0",
+		"DRONE_AGENT_MIN_COUNT":           "-1",
+		"DRONE_AGENT_RETIREMENT_STRATEGY": "random",
+		"DRONE_SERVER_PROTO":              "ftp",
+		"SCALER_LOG_FORMAT":               "xml",
+	}
+	setEnvVars(invalid)
+	defer unsetEnvVars(invalid)
+
+	_, err := Load()
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("Want validation errors, got %v", err)
+	}
+	// every invalid field plus the missing host, auth token and
+	// autoscaling group is reported
+	if got, want := len(errs), 8; got != want {
+		t.Errorf("Want %d validation errors, got %d: %v", want, got, errs)
+	}
+}
+
+func TestLoad_ParseErrors(t *testing.T) {
+	invalid := map[string]string{
+		"DRONE_AGENT_MAX_AGE":           "forever",
+		"DRONE_AGENT_MIN_COUNT":         "one",
+		"DRONE_AGENT_MAX_BUILDS":        "0",
+		"DRONE_SERVER_HOST":             "drone.example.com",
+		"DRONE_SERVER_AUTH_TOKEN":       "token",
+		"DRONE_AGENT_AUTOSCALING_GROUP": "test-asg",
+	}
+	setEnvVars(invalid)
+	defer unsetEnvVars(invalid)
+
+	_, err := Load()
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("Want validation errors, got %v", err)
+	}
+	// both malformed variables are reported along with the invalid field
+	var parseErrs int
+	for _, err := range errs {
+		if _, ok := err.(*envconfig.ParseError); ok {
+			parseErrs++
+		}
+	}
+	if len(errs) != 3 || parseErrs != 2 {
+		t.Errorf("Want 2 parse errors and 1 validation error, got %v", errs)
+	}
+}
+
 func setEnvVars(vars map[string]string) {
 	for k, v := range vars {
 		os.Setenv(k, v)
@@ -86,31 +338,131 @@ var required = map[string]string{
 }
 
 var optional = map[string]string{
-	"SCALER_PROBE_INTERVAL":            "5m",
-	"SCALER_LOG_FORMAT":                "text",
-	"SCALER_DEBUG":                     "true",
-	"SCALER_DRY":                       "true",
-	"DRONE_SERVER_PROTO":               "https",
-	"DRONE_AGENT_MIN_COUNT":            "3",
-	"DRONE_AGENT_MIN_RETIREMENT_AGE":   "25m",
-	"DRONE_BUILD_PENDING_MAX_DURATION": "4h",
-	"DRONE_BUILD_RUNNING_MAX_DURATION": "1h",
+	"SCALER_PROBE_INTERVAL":                   "5m",
+	"SCALER_PROBE_INTERVAL_MIN":               "10s",
+	"SCALER_PROBE_INTERVAL_MAX":               "10m",
+	"SCALER_CYCLE_TIMEOUT":                    "2m",
+	"SCALER_CALL_TIMEOUT":                     "10s",
+	"SCALER_EVENT_STREAM":                     "false",
+	"SCALER_EVENT_DEBOUNCE":                   "5s",
+	"SCALER_LOG_FORMAT":                       "text",
+	"SCALER_DEBUG":                            "true",
+	"SCALER_DRY":                              "true",
+	"DRONE_SERVER_PROTO":                      "https",
+	"DRONE_AGENT_MIN_COUNT":                   "3",
+	"DRONE_AGENT_HEADROOM_SLOTS":              "2",
+	"DRONE_AGENT_HEADROOM_PERCENT":            "25",
+	"DRONE_AGENT_MIN_RETIREMENT_AGE":          "25m",
+	"DRONE_AGENT_MIN_IDLE_DURATION":           "3m",
+	"DRONE_AGENT_MAX_AGE":                     "24h",
+	"DRONE_AGENT_REPLACEMENT_RATE":            "2",
+	"DRONE_AGENT_ZOMBIE_CYCLES":               "5",
+	"DRONE_AGENT_QUARANTINE_ERROR_RATE":       "0.5",
+	"DRONE_AGENT_QUARANTINE_WINDOW":           "6",
+	"DRONE_AGENT_QUARANTINE_RETENTION":        "24h",
+	"DRONE_AGENT_INSTANCE_CAPACITY":           "c5.xlarge:2,c5.4xlarge:8",
+	"DRONE_AGENT_VCPUS_PER_BUILD":             "1.5",
+	"DRONE_AGENT_MEMORY_PER_BUILD":            "3072",
+	"DRONE_AGENT_RETIREMENT_STRATEGY":         "az-balance",
+	"DRONE_AGENT_INSTANCE_PRICES":             "c5.xlarge:0.17,c5.4xlarge:0.68",
+	"DRONE_AGENT_SCALING_TIMEOUT":             "45m",
+	"DRONE_AGENT_RESET_STUCK_CAPACITY":        "true",
+	"DRONE_AGENT_FALLBACK_AUTOSCALING_GROUPS": "ci-agent-cluster-m5,ci-agent-cluster-c4",
+	"DRONE_AGENT_FALLBACK_COOLDOWN":           "5m",
+	"DRONE_BUILD_PENDING_MAX_DURATION":        "4h",
+	"DRONE_BUILD_RUNNING_MAX_DURATION":        "1h",
+	"DRONE_BUILD_CANCEL_MAX_DURATION":         "12h",
+	"DRONE_BUILD_RULES":                       `[{"repo": "octocat/heavy-*", "weight": 4, "pending_max_duration": "30m"}, {"namespace": "lint", "exclude": true}]`,
+	"SCALER_METRICS_ADDRESS":                  ":9102",
+	"SCALER_STATE_FILE":                       "/var/lib/scaler/state.json",
+
+	"SCALER_NOTIFY_WEBHOOK_URL":             "https://hooks.company.com/drone",
+	"SCALER_NOTIFY_SLACK_WEBHOOK_URL":       "https://hooks.slack.com/services/T0/B0/X",
+	"SCALER_NOTIFY_UPSCALE_THRESHOLD":       "10",
+	"SCALER_NOTIFY_QUEUE_PAUSE_THRESHOLD":   "1m",
+	"SCALER_NOTIFY_SCALING_STUCK_THRESHOLD": "20m",
+	"SCALER_NOTIFY_UPSCALE_TEMPLATE":        "+{{.Fields.count}} agents",
+	"SCALER_NOTIFY_SCALING_FAILED_TEMPLATE": "{{.Fields.message}}",
+
+	"SCALER_POLICY":                    "queue-wait",
+	"SCALER_POLICY_TARGET_UTILIZATION": "0.6",
+	"SCALER_POLICY_QUEUE_WAIT_SLO":     "5m",
+
+	"SCALER_RETRY_MAX_ATTEMPTS":          "4",
+	"SCALER_RETRY_BASE_DELAY":            "100ms",
+	"SCALER_RETRY_MAX_DELAY":             "2s",
+	"SCALER_RETRY_QUEUE_RESUME_ATTEMPTS": "20",
+	"SCALER_RETRY_BREAKER_THRESHOLD":     "3",
+	"SCALER_RETRY_BREAKER_COOLDOWN":      "30s",
 }
 
 var jsonConfig = []byte(`{
   "ProbeInterval": 300000000000,
+  "ProbeIntervalMin": 10000000000,
+  "ProbeIntervalMax": 600000000000,
+  "CycleTimeout": 120000000000,
+  "CallTimeout": 10000000000,
+  "EventStream": false,
+  "EventDebounce": 5000000000,
   "LogFormat": "text",
   "Debug": true,
   "Dry": true,
+  "MetricsAddress": ":9102",
+  "StateFile": "/var/lib/scaler/state.json",
   "Build": {
     "PendingMaxDuration": 14400000000000,
-    "RunningMaxDuration": 3600000000000
+    "RunningMaxDuration": 3600000000000,
+    "CancelMaxDuration": 43200000000000,
+    "Rules": [
+      {"repo": "octocat/heavy-*", "weight": 4, "pending_max_duration": "30m"},
+      {"namespace": "lint", "exclude": true}
+    ]
   },
   "Agent": {
     "MinRetirementAge": 1500000000000,
+    "MinIdleDuration": 180000000000,
+    "MaxAge": 86400000000000,
+    "ReplacementRate": 2,
+    "ZombieCycles": 5,
+    "QuarantineErrorRate": 0.5,
+    "QuarantineWindow": 6,
+    "QuarantineRetention": 86400000000000,
     "MaxBuilds": 10,
+    "InstanceCapacity": {"c5.xlarge": 2, "c5.4xlarge": 8},
+    "VCPUsPerBuild": 1.5,
+    "MemoryPerBuild": 3072,
+    "RetirementStrategy": "az-balance",
+    "InstancePrices": {"c5.xlarge": 0.17, "c5.4xlarge": 0.68},
+    "ScalingTimeout": 2700000000000,
+    "ResetStuckCapacity": true,
     "MinCount": 3,
-    "AutoscalingGroup": "ci-agent-cluster"
+    "HeadroomSlots": 2,
+    "HeadroomPercent": 25,
+    "AutoscalingGroup": "ci-agent-cluster",
+    "FallbackAutoscalingGroups": ["ci-agent-cluster-m5", "ci-agent-cluster-c4"],
+    "FallbackCooldown": 300000000000
+  },
+  "Notify": {
+    "WebhookURL": "https://hooks.company.com/drone",
+    "SlackWebhookURL": "https://hooks.slack.com/services/T0/B0/X",
+    "UpscaleThreshold": 10,
+    "QueuePauseThreshold": 60000000000,
+    "ScalingStuckThreshold": 1200000000000,
+    "UpscaleTemplate": "+{{.Fields.count}} agents",
+    "ScalingFailedTemplate": "{{.Fields.message}}"
+  },
+  "Policy": {
+    "Name": "queue-wait",
+    "TargetUtilization": 0.6,
+    "QueueWaitSLO": 300000000000
+  },
+  "Retry": {
+    "MaxAttempts": 4,
+    "BaseDelay": 100000000,
+    "MaxDelay": 2000000000,
+    "QueueResumeAttempts": 20,
+    "BreakerThreshold": 3,
+    "BreakerCooldown": 30000000000
   },
   "Server": {
     "Proto": "https",
@@ -0,0 +1,93 @@
+package config
+
+import (
+	"fmt"
+	"github.com/kelseyhightower/envconfig"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// same as the ones envconfig uses to split camel cased field names
+var (
+	gatherRegexp  = regexp.MustCompile("([^A-Z]+|[A-Z]+[^A-Z]+|[A-Z]+)")
+	acronymRegexp = regexp.MustCompile("([A-Z]+)([A-Z][^A-Z]+)")
+)
+
+// reads the YAML config file at the given path into conf. Unknown keys
+// are rejected so that typos don't go unnoticed.
+func readFile(path string, conf *Config) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("couldn't read config file: %v", err)
+	}
+	if err := yaml.UnmarshalStrict(data, conf); err != nil {
+		return fmt.Errorf("couldn't parse config file %s: %v", path, err)
+	}
+	return nil
+}
+
+// applyEnv sets the fields of dst from the environment the way envconfig
+// does. With set false, fields whose variable is unset get their default;
+// with set true, fields whose variable is set get its value. Fields are
+// processed one at a time so that every malformed variable is reported,
+// rather than only the first. Fields whose variable is malformed are left
+// as they are.
+func applyEnv(dst reflect.Value, prefix string, set bool) ValidationErrors {
+	var errs ValidationErrors
+	t := dst.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !dst.Field(i).CanSet() {
+			continue
+		}
+
+		key, alt := envKeys(field, prefix)
+		if field.Type.Kind() == reflect.Struct {
+			errs = append(errs, applyEnv(dst.Field(i), key, set)...)
+			continue
+		}
+		if set != (isSet(key) || (alt != "" && isSet(alt))) {
+			continue
+		}
+		spec := reflect.New(reflect.StructOf([]reflect.StructField{
+			{Name: field.Name, Type: field.Type, Tag: field.Tag},
+		}))
+		if err := envconfig.Process(prefix, spec.Interface()); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		dst.Field(i).Set(spec.Elem().Field(0))
+	}
+	return errs
+}
+
+// returns the environment variables envconfig reads the given field from
+func envKeys(field reflect.StructField, prefix string) (string, string) {
+	key := field.Name
+	if field.Tag.Get("split_words") == "true" {
+		var words []string
+		for _, w := range gatherRegexp.FindAllString(field.Name, -1) {
+			if m := acronymRegexp.FindStringSubmatch(w); len(m) == 3 {
+				words = append(words, m[1], m[2])
+			} else {
+				words = append(words, w)
+			}
+		}
+		key = strings.Join(words, "_")
+	}
+
+	alt := strings.ToUpper(field.Tag.Get("envconfig"))
+	if alt != "" {
+		key = alt
+	}
+	return strings.ToUpper(prefix + "_" + key), alt
+}
+
+func isSet(key string) bool {
+	_, ok := os.LookupEnv(key)
+	return ok
+}
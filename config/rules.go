@@ -0,0 +1,94 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"time"
+)
+
+// BuildRule customises how the stages of matching repositories are treated
+// while generating scaling plans
+type BuildRule struct {
+	// Glob pattern matched against the repository slug, eg- "octocat/*".
+	// An empty value matches all repositories.
+	Repo string `yaml:"repo"`
+
+	// Repository namespace (owner) to match. An empty value matches all
+	// namespaces.
+	Namespace string `yaml:"namespace"`
+
+	// Number of build slots occupied by a single stage of a matching
+	// repository. Heavy builds that need an agent to themselves can set
+	// this to the agent's max builds, while tiny jobs can use a fraction.
+	// Zero means the default weight of 1.
+	Weight float64 `yaml:"weight"`
+
+	// Overrides DRONE_BUILD_PENDING_MAX_DURATION for matching stages.
+	// Zero means the global value applies.
+	PendingMaxDuration time.Duration `yaml:"pending_max_duration"`
+
+	// If true, stages of matching repositories are ignored entirely while
+	// generating scaling plans
+	Exclude bool `yaml:"exclude"`
+}
+
+// json representation of a rule, where durations are human-readable strings
+type buildRuleJSON struct {
+	Repo               string  `json:"repo"`
+	Namespace          string  `json:"namespace"`
+	Weight             float64 `json:"weight"`
+	PendingMaxDuration string  `json:"pending_max_duration"`
+	Exclude            bool    `json:"exclude"`
+}
+
+func (r *BuildRule) UnmarshalJSON(data []byte) error {
+	var raw buildRuleJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	var d time.Duration
+	if raw.PendingMaxDuration != "" {
+		var err error
+		if d, err = time.ParseDuration(raw.PendingMaxDuration); err != nil {
+			return fmt.Errorf("invalid build rule pending max duration: %v", err)
+		}
+	}
+
+	*r = BuildRule{
+		Repo:               raw.Repo,
+		Namespace:          raw.Namespace,
+		Weight:             raw.Weight,
+		PendingMaxDuration: d,
+		Exclude:            raw.Exclude,
+	}
+	return r.validate()
+}
+
+func (r BuildRule) validate() error {
+	if r.Repo == "" && r.Namespace == "" {
+		return fmt.Errorf("build rule must match on repo or namespace")
+	}
+	if _, err := path.Match(r.Repo, ""); err != nil {
+		return fmt.Errorf("invalid build rule repo pattern %q: %v", r.Repo, err)
+	}
+	if r.Weight < 0 {
+		return fmt.Errorf("build rule weight cannot be %v", r.Weight)
+	}
+	return nil
+}
+
+// BuildRules is an ordered list of build rules. The first rule matching a
+// stage's repository applies to it.
+type BuildRules []BuildRule
+
+// Decode parses build rules from a JSON array, allowing them to be
+// supplied via an environment variable
+func (r *BuildRules) Decode(value string) error {
+	var rules []BuildRule
+	if err := json.Unmarshal([]byte(value), &rules); err != nil {
+		return fmt.Errorf("invalid build rules: %v", err)
+	}
+	*r = rules
+	return nil
+}
@@ -0,0 +1,39 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBuildRules_Decode(t *testing.T) {
+	var rules BuildRules
+	err := rules.Decode(`[
+		{"repo": "octocat/*", "weight": 0.5},
+		{"namespace": "infra", "pending_max_duration": "2h", "exclude": true}
+	]`)
+	if err != nil {
+		t.Fatalf("Did not expect decode error: %v", err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("Want 2 rules, got %d", len(rules))
+	}
+	if got, want := rules[0], (BuildRule{Repo: "octocat/*", Weight: 0.5}); got != want {
+		t.Errorf("Want rule %+v, got %+v", want, got)
+	}
+	want := BuildRule{Namespace: "infra", PendingMaxDuration: 2 * time.Hour, Exclude: true}
+	if got := rules[1]; got != want {
+		t.Errorf("Want rule %+v, got %+v", want, got)
+	}
+
+	invalid := []string{
+		`{"repo": "octocat/*"}`,
+		`[{"weight": 2}]`,
+		`[{"repo": "octocat/*", "weight": -1}]`,
+		`[{"repo": "octocat/*", "pending_max_duration": "forever"}]`,
+	}
+	for _, v := range invalid {
+		if err := rules.Decode(v); err == nil {
+			t.Errorf("Want error decoding %s", v)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package engine
+
+import (
+	"context"
+	"github.com/Shuttl-Tech/drone-autoscaler/cluster"
+	"github.com/Shuttl-Tech/drone-autoscaler/metrics"
+	"github.com/Shuttl-Tech/drone-autoscaler/notify"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// reportFailedScalingActivities logs and notifies operators about every
+// scaling activity of the agent autoscaling group that failed since the
+// ongoing activity was observed. Every failed activity is reported once.
+func (e *Engine) reportFailedScalingActivities(ctx context.Context) {
+	// the activity may have started up to a cycle before it was observed
+	since := e.scaling.since.Add(-e.probeInterval)
+	failed, err := e.drone.agent.cluster.FailedScalingActivities(ctx, since)
+	if err != nil {
+		log.WithError(err).Warnln("Failed to fetch scaling activities of agent cluster")
+		return
+	}
+
+	for _, a := range failed {
+		if _, ok := e.scaling.reported[a.Id]; ok {
+			continue
+		}
+		if e.scaling.reported == nil {
+			e.scaling.reported = make(map[string]struct{})
+		}
+		e.scaling.reported[a.Id] = struct{}{}
+
+		metrics.FailedScalingActivities.Add(1)
+		log.
+			WithField("activity", a.Id).
+			WithField("status", a.Status).
+			WithField("reason", a.StatusMessage).
+			Warnln(a.Description)
+		e.emit(ctx, notify.EventScalingFailed, map[string]interface{}{
+			"activity":    a.Id,
+			"description": a.Description,
+			"status":      a.Status,
+			"message":     a.StatusMessage,
+			"started":     a.StartTime,
+		})
+	}
+}
+
+// scalingTimedOut returns true if the ongoing scaling activity of the agent
+// autoscaling group has been in progress for longer than the scaling timeout
+func (e *Engine) scalingTimedOut() bool {
+	timeout := e.drone.agent.scalingTimeout
+	if timeout <= 0 || e.scaling.since.IsZero() {
+		return false
+	}
+	return time.Since(e.scaling.since) > timeout
+}
+
+// notifyScalingTimedOut notifies operators once per scaling activity that
+// the planner stopped waiting on
+func (e *Engine) notifyScalingTimedOut(ctx context.Context, capacity cluster.Capacity) {
+	if e.scaling.timedOut {
+		return
+	}
+	e.scaling.timedOut = true
+	e.emit(ctx, notify.EventScalingTimedOut, map[string]interface{}{
+		"duration": time.Since(e.scaling.since).Round(time.Second).String(),
+		"since":    e.scaling.since,
+		"desired":  capacity.Desired,
+		"actual":   capacity.Actual,
+		"reset":    e.drone.agent.resetStuckCapacity,
+	})
+}
@@ -0,0 +1,198 @@
+package engine
+
+import (
+	"context"
+	"github.com/Shuttl-Tech/drone-autoscaler/cluster"
+	"github.com/Shuttl-Tech/drone-autoscaler/mocks"
+	"github.com/Shuttl-Tech/drone-autoscaler/notify"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/drone/drone-go/drone"
+	"github.com/golang/mock/gomock"
+	"testing"
+	"time"
+)
+
+// Verifies that every failed scaling activity is notified only once, and
+// that activities started before the ongoing one are ignored
+func TestActivity_ReportFailed(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	now := time.Now().UTC()
+	asg := mocks.NewMockAutoScalingAPI(ctrl)
+	asg.
+		EXPECT().
+		DescribeScalingActivitiesWithContext(gomock.Any(), gomock.Any()).
+		Return(&autoscaling.DescribeScalingActivitiesOutput{
+			Activities: []*autoscaling.Activity{
+				{
+					ActivityId:    aws.String("a-003"),
+					Description:   aws.String("Launching a new EC2 instance. Status Reason: Insufficient capacity"),
+					StatusCode:    aws.String(autoscaling.ScalingActivityStatusCodeFailed),
+					StatusMessage: aws.String("We currently do not have sufficient c5.xlarge capacity"),
+					StartTime:     aws.Time(now.Add(-time.Minute)),
+				},
+				{
+					ActivityId: aws.String("a-002"),
+					StatusCode: aws.String(autoscaling.ScalingActivityStatusCodeInProgress),
+					StartTime:  aws.Time(now.Add(-2 * time.Minute)),
+				},
+				{
+					ActivityId: aws.String("a-001"),
+					StatusCode: aws.String(autoscaling.ScalingActivityStatusCodeFailed),
+					StartTime:  aws.Time(now.Add(-time.Hour)),
+				},
+			},
+		}, nil).
+		Times(2)
+
+	rec := &recordingNotifier{}
+	e := &Engine{
+		drone: &droneConfig{
+			agent: &droneAgentConfig{cluster: cluster.New("test-asg", nil, asg)},
+		},
+		notify:        &notifyConfig{notifier: rec},
+		probeInterval: time.Minute,
+	}
+	e.scaling.since = now.Add(-5 * time.Minute)
+
+	e.reportFailedScalingActivities(context.TODO())
+	e.reportFailedScalingActivities(context.TODO())
+	if len(rec.events) != 1 {
+		t.Fatalf("Want a single scaling failed event, got %v", rec.events)
+	}
+	if got := rec.events[0]; got.Type != notify.EventScalingFailed || got.Fields["activity"] != "a-003" {
+		t.Errorf("Want failed activity a-003 to be notified, got %v", got)
+	}
+}
+
+// Verifies that the planner stops waiting on a scaling activity that
+// timed out, and resets the desired capacity when configured to
+func TestActivity_ScalingTimedOut(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	asg := mocks.NewMockAutoScalingAPI(ctrl)
+	asg.
+		EXPECT().
+		DescribeAutoScalingGroupsWithContext(gomock.Any(), gomock.Any()).
+		Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+			AutoScalingGroups: []*autoscaling.Group{
+				{
+					Instances: []*autoscaling.Instance{
+						{
+							HealthStatus: aws.String("Healthy"),
+							InstanceId:   aws.String("i-001"),
+						},
+						{
+							HealthStatus: aws.String("Healthy"),
+							InstanceId:   aws.String("i-002"),
+						},
+					},
+					DesiredCapacity: aws.Int64(5),
+					MaxSize:         aws.Int64(10),
+				},
+			},
+		}, nil)
+	asg.
+		EXPECT().
+		DescribeScalingActivitiesWithContext(gomock.Any(), gomock.Any()).
+		Return(&autoscaling.DescribeScalingActivitiesOutput{}, nil)
+
+	rec := &recordingNotifier{}
+	e := &Engine{
+		drone: &droneConfig{
+			agent: &droneAgentConfig{
+				cluster:            cluster.New("test-asg", nil, asg),
+				scalingTimeout:     30 * time.Minute,
+				resetStuckCapacity: true,
+			},
+		},
+		notify: &notifyConfig{notifier: rec},
+	}
+	e.scaling.since = time.Now().Add(-time.Hour)
+
+	p, err := e.Plan(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.RequiresCapacityReset() || p.CurrentCapacity() != 5 || p.TargetCapacity() != 2 {
+		t.Errorf("Want plan to reset capacity from 5 to 2, got %v", p)
+	}
+	if len(rec.events) != 1 || rec.events[0].Type != notify.EventScalingTimedOut {
+		t.Errorf("Want scaling timed out event, got %v", rec.events)
+	}
+}
+
+// Verifies that agents are added on top of the running agents once a
+// scaling activity timed out, so that the desired capacity stuck above
+// them doesn't grow on every cycle
+func TestActivity_ScalingTimedOutUpscale(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	desired := int64(5)
+	asg := mocks.NewMockAutoScalingAPI(ctrl)
+	asg.
+		EXPECT().
+		DescribeAutoScalingGroupsWithContext(gomock.Any(), gomock.Any()).
+		DoAndReturn(func(aws.Context, *autoscaling.DescribeAutoScalingGroupsInput, ...request.Option) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+			return &autoscaling.DescribeAutoScalingGroupsOutput{
+				AutoScalingGroups: []*autoscaling.Group{
+					{
+						Instances: []*autoscaling.Instance{
+							{
+								HealthStatus: aws.String("Healthy"),
+								InstanceId:   aws.String("i-001"),
+							},
+						},
+						DesiredCapacity: aws.Int64(desired),
+						MaxSize:         aws.Int64(20),
+					},
+				},
+			}, nil
+		}).
+		Times(2)
+	asg.
+		EXPECT().
+		DescribeScalingActivitiesWithContext(gomock.Any(), gomock.Any()).
+		Return(&autoscaling.DescribeScalingActivitiesOutput{}, nil).
+		Times(2)
+
+	// 12 pending builds need 5 agents besides the running one
+	stages := make([]*drone.Stage, 12)
+	for i := range stages {
+		stages[i] = &drone.Stage{Status: drone.StatusPending, Created: time.Now().Unix()}
+	}
+	droneClient := mocks.NewMockClient(ctrl)
+	droneClient.EXPECT().Queue().Return(stages, nil).Times(2)
+
+	e := &Engine{
+		drone: &droneConfig{
+			client: droneClient,
+			build:  &droneBuildConfig{pendingMaxDuration: time.Hour},
+			agent: &droneAgentConfig{
+				cluster:        cluster.New("test-asg", nil, asg),
+				maxBuilds:      2,
+				scalingTimeout: 30 * time.Minute,
+			},
+		},
+		notify: &notifyConfig{},
+	}
+	e.scaling.since = time.Now().Add(-time.Hour)
+
+	// the autoscaling group takes on the target of every plan, yet still
+	// doesn't launch the agents
+	for cycle := 1; cycle <= 2; cycle++ {
+		p, err := e.Plan(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !p.RequiresUpscaling() || p.TargetCapacity() != 6 {
+			t.Errorf("Want plan to upscale to 6 in cycle %d, got %v", cycle, p)
+		}
+		desired = int64(p.TargetCapacity())
+	}
+}
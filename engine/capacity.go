@@ -0,0 +1,127 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"github.com/Shuttl-Tech/drone-autoscaler/cluster"
+	log "github.com/sirupsen/logrus"
+	"math"
+)
+
+// returns true if the number of build slots of an agent depends on its
+// instance type rather than being the same for all agents
+func (e *Engine) capacityByInstanceType() bool {
+	a := e.drone.agent
+	return len(a.instanceCapacity) > 0 || a.vcpusPerBuild > 0 || a.memoryPerBuild > 0
+}
+
+// fleetCapacity returns the number of build slots of every given agent
+func (e *Engine) fleetCapacity(ctx context.Context, agents []cluster.NodeId) (map[cluster.NodeId]int, error) {
+	res := make(map[cluster.NodeId]int, len(agents))
+	if !e.capacityByInstanceType() {
+		for _, agent := range agents {
+			res[agent] = e.drone.agent.maxBuilds
+		}
+		return res, nil
+	}
+
+	types, err := e.drone.agent.cluster.InstanceTypes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't fetch instance types of agents: %v", err)
+	}
+	set := make(map[string]struct{}, len(types))
+	for _, t := range types {
+		set[t] = struct{}{}
+	}
+	unique := make([]string, 0, len(set))
+	for t := range set {
+		unique = append(unique, t)
+	}
+	capacities, err := e.instanceTypeCapacity(ctx, unique)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, agent := range agents {
+		c, ok := capacities[types[agent]]
+		if !ok {
+			c = e.drone.agent.maxBuilds
+		}
+		res[agent] = c
+	}
+	return res, nil
+}
+
+// instanceTypeCapacity returns the number of build slots of agents of the
+// given instance types. Explicitly configured capacities take precedence,
+// followed by the ones derived from the instance type's resources. Max
+// builds per agent applies to instance types that match neither.
+func (e *Engine) instanceTypeCapacity(ctx context.Context, types []string) (map[string]int, error) {
+	a := e.drone.agent
+	res := make(map[string]int, len(types))
+	unresolved := make([]string, 0, len(types))
+	for _, t := range types {
+		if c, ok := a.instanceCapacity[t]; ok {
+			res[t] = c
+		} else if c, ok := e.derivedCapacity[t]; ok {
+			res[t] = c
+		} else {
+			unresolved = append(unresolved, t)
+		}
+	}
+
+	if len(unresolved) > 0 && (a.vcpusPerBuild > 0 || a.memoryPerBuild > 0) {
+		resources, err := a.cluster.DescribeInstanceTypes(ctx, unresolved)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't derive capacity of instance types: %v", err)
+		}
+		if e.derivedCapacity == nil {
+			e.derivedCapacity = make(map[string]int, len(resources))
+		}
+		for t, r := range resources {
+			c := capacityFromResources(r, a.vcpusPerBuild, a.memoryPerBuild)
+			log.
+				WithField("type", t).
+				WithField("capacity", c).
+				Debugln("Derived build capacity of instance type")
+			// instance types don't change, so derived capacity is
+			// cached for the app's lifetime
+			e.derivedCapacity[t] = c
+			res[t] = c
+		}
+	}
+
+	for _, t := range unresolved {
+		if _, ok := res[t]; !ok {
+			res[t] = a.maxBuilds
+		}
+	}
+	return res, nil
+}
+
+// returns the number of builds that fit on an instance with the given
+// resources. Every agent can run at least 1 build.
+func capacityFromResources(r cluster.InstanceType, vcpusPerBuild float64, memoryPerBuild int64) int {
+	c := math.MaxInt32
+	if vcpusPerBuild > 0 {
+		c = int(math.Floor(float64(r.VCPUs) / vcpusPerBuild))
+	}
+	if memoryPerBuild > 0 {
+		if m := int(r.MemoryMiB / memoryPerBuild); m < c {
+			c = m
+		}
+	}
+	if c < 1 {
+		return 1
+	}
+	return c
+}
+
+// returns the total number of build slots in the given fleet
+func totalCapacity(capacities map[cluster.NodeId]int) int {
+	total := 0
+	for _, c := range capacities {
+		total += c
+	}
+	return total
+}
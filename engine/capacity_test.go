@@ -0,0 +1,144 @@
+package engine
+
+import (
+	"context"
+	"github.com/Shuttl-Tech/drone-autoscaler/cluster"
+	"github.com/Shuttl-Tech/drone-autoscaler/mocks"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/golang/mock/gomock"
+	"testing"
+)
+
+func TestCapacity_FromResources(t *testing.T) {
+	tests := []struct {
+		resources      cluster.InstanceType
+		vcpusPerBuild  float64
+		memoryPerBuild int64
+		want           int
+	}{
+		{cluster.InstanceType{VCPUs: 4, MemoryMiB: 8192}, 2, 0, 2},
+		{cluster.InstanceType{VCPUs: 16, MemoryMiB: 32768}, 2, 0, 8},
+		{cluster.InstanceType{VCPUs: 16, MemoryMiB: 32768}, 0, 8192, 4},
+		{cluster.InstanceType{VCPUs: 16, MemoryMiB: 32768}, 1, 2048, 16},
+		{cluster.InstanceType{VCPUs: 16, MemoryMiB: 32768}, 4, 2048, 4},
+		{cluster.InstanceType{VCPUs: 2, MemoryMiB: 4096}, 1.5, 0, 1},
+		{cluster.InstanceType{VCPUs: 1, MemoryMiB: 512}, 2, 1024, 1},
+	}
+	for _, test := range tests {
+		got := capacityFromResources(test.resources, test.vcpusPerBuild, test.memoryPerBuild)
+		if got != test.want {
+			t.Errorf("Want capacity %d for %+v, got %d", test.want, test, got)
+		}
+	}
+}
+
+func TestCapacity_CalcUpscaleCount(t *testing.T) {
+	e := Engine{
+		drone: &droneConfig{
+			agent: &droneAgentConfig{maxBuilds: 4},
+		},
+	}
+	tests := []struct {
+		pending, free, headroom float64
+		want                    int
+	}{
+		{3, 4, 0, 0},
+		{4, 4, 0, 0},
+		{5, 4, 0, 1},
+		{9, 0, 0, 3},
+		{2, -2, 0, 1},
+		{0.5, 0, 0, 1},
+		{0, 4, 2, 0},
+		{0, 1, 2, 1},
+		{3, 4, 2, 1},
+		{0, 0, 9, 3},
+	}
+	for _, test := range tests {
+		got, err := e.calcUpscaleCount(test.pending, test.free, test.headroom)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("Want upscale count %d for %+v, got %d", test.want, test, got)
+		}
+	}
+}
+
+func TestCapacity_FleetCapacity(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	asg := mocks.NewMockAutoScalingAPI(ctrl)
+	asg.
+		EXPECT().
+		DescribeAutoScalingGroupsWithContext(gomock.Any(), gomock.Any()).
+		Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+			AutoScalingGroups: []*autoscaling.Group{
+				{
+					Instances: []*autoscaling.Instance{
+						{
+							HealthStatus: aws.String("Healthy"),
+							InstanceId:   aws.String("i-001"),
+							InstanceType: aws.String("c5.xlarge"),
+						},
+						{
+							HealthStatus: aws.String("Healthy"),
+							InstanceId:   aws.String("i-002"),
+							InstanceType: aws.String("c5.4xlarge"),
+						},
+						{
+							HealthStatus: aws.String("Healthy"),
+							InstanceId:   aws.String("i-003"),
+							InstanceType: aws.String("m5.2xlarge"),
+						},
+					},
+				},
+			},
+		}, nil).
+		Times(2)
+
+	// derived capacity is cached, so instance types are described once
+	ec2Client := mocks.NewMockEC2API(ctrl)
+	ec2Client.
+		EXPECT().
+		DescribeInstanceTypesWithContext(gomock.Any(), gomock.Any()).
+		Return(&ec2.DescribeInstanceTypesOutput{
+			InstanceTypes: []*ec2.InstanceTypeInfo{
+				{
+					InstanceType: aws.String("m5.2xlarge"),
+					VCpuInfo:     &ec2.VCpuInfo{DefaultVCpus: aws.Int64(8)},
+					MemoryInfo:   &ec2.MemoryInfo{SizeInMiB: aws.Int64(32768)},
+				},
+			},
+		}, nil)
+
+	e := Engine{
+		drone: &droneConfig{
+			agent: &droneAgentConfig{
+				cluster:          cluster.New("test-asg", ec2Client, asg),
+				maxBuilds:        2,
+				instanceCapacity: map[string]int{"c5.xlarge": 2, "c5.4xlarge": 8},
+				vcpusPerBuild:    2,
+			},
+		},
+	}
+	agents := []cluster.NodeId{"i-001", "i-002", "i-003", "i-004"}
+	want := map[cluster.NodeId]int{"i-001": 2, "i-002": 8, "i-003": 4, "i-004": 2}
+
+	for i := 0; i < 2; i++ {
+		got, err := e.fleetCapacity(context.TODO(), agents)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for id, c := range want {
+			if got[id] != c {
+				t.Errorf("Want capacity %d for %s, got %d", c, id, got[id])
+			}
+		}
+		if total := totalCapacity(got); total != 16 {
+			t.Errorf("Want total capacity 16, got %d", total)
+		}
+	}
+}
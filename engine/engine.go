@@ -2,8 +2,12 @@ package engine
 
 import (
 	"context"
+	"errors"
 	"github.com/Shuttl-Tech/drone-autoscaler/cluster"
 	"github.com/Shuttl-Tech/drone-autoscaler/config"
+	"github.com/Shuttl-Tech/drone-autoscaler/metrics"
+	"github.com/Shuttl-Tech/drone-autoscaler/notify"
+	"github.com/Shuttl-Tech/drone-autoscaler/state"
 	"github.com/drone/drone-go/drone"
 	log "github.com/sirupsen/logrus"
 	"time"
@@ -12,13 +16,41 @@ import (
 type droneBuildConfig struct {
 	pendingMaxDuration time.Duration
 	runningMaxDuration time.Duration
+	cancelMaxDuration  time.Duration
+	rules              []*buildRule
 }
 
 type droneAgentConfig struct {
 	maxBuilds        int
 	minCount         int
 	minRetirementAge time.Duration
-	cluster          cluster.Cluster
+	minIdleDuration  time.Duration
+	maxAge           time.Duration
+	replacementRate  int
+	zombieCycles     int
+	instanceCapacity map[string]int
+	vcpusPerBuild    float64
+	memoryPerBuild   int64
+
+	retirementStrategy string
+	victimStrategy     victimStrategy
+	instancePrices     map[string]float64
+
+	scalingTimeout     time.Duration
+	resetStuckCapacity bool
+
+	headroomSlots   int
+	headroomPercent float64
+
+	// quarantine of agents whose recent stages keep erroring
+	quarantineErrorRate float64
+	quarantineWindow    int
+	quarantineRetention time.Duration
+
+	// tag agents as draining while they're being retired
+	tagDraining bool
+
+	cluster cluster.Cluster
 }
 
 type droneConfig struct {
@@ -30,60 +62,314 @@ type droneConfig struct {
 type Engine struct {
 	dry           bool
 	drone         *droneConfig
+	notify        *notifyConfig
 	probeInterval time.Duration
+	cycleTimeout  time.Duration
+	eventDebounce time.Duration
+	scaling       scalingActivity
+	policy        Policy
+
+	// bounds of the adaptive probe interval, and the interval until the
+	// next cycle as adapted to the latest plan
+	minInterval time.Duration
+	maxInterval time.Duration
+	interval    time.Duration
+
+	// IDs of stages discarded in the previous cycle for exceeding their
+	// max duration, used to report every discarded stage only once
+	discarded map[int64]struct{}
+
+	// build rule applicable to every incomplete build in the current
+	// cycle, keyed by build ID
+	matchedRules map[int64]*buildRule
+
+	// build slots of instance types derived from their resources
+	derivedCapacity map[string]int
+
+	// agents that couldn't be terminated, along with the number of failed
+	// attempts, to be retried on a later cycle
+	failedTerminations map[cluster.NodeId]int
+
+	// time every running agent was last seen running a build, persisted
+	// in the store, if any, and loaded from it once
+	lastBusy    map[cluster.NodeId]time.Time
+	store       state.Store
+	stateLoaded bool
+
+	// number of cycles with pending builds through which every running
+	// agent has stayed idle, used to detect zombie agents
+	idleStrikes map[cluster.NodeId]int
+
+	// stages running on agents, keyed by stage ID, and whether each of the
+	// recent stages of every running agent errored, oldest first
+	stagesInFlight map[int64]stageInFlight
+	stageOutcomes  map[cluster.NodeId][]bool
+
+	// configuration to apply before the next cycle
+	reload chan config.Config
+
+	// signals that builds changed, so a cycle must run soon
+	wake chan struct{}
 }
 
-func New(c config.Config, client drone.Client, fleet cluster.Cluster) *Engine {
-	return &Engine{
-		dry: c.Dry,
+func New(
+	c config.Config,
+	client drone.Client,
+	fleet cluster.Cluster,
+	notifier notify.Notifier,
+	store state.Store,
+) *Engine {
+	e := &Engine{
 		drone: &droneConfig{
 			client: client,
-			build: &droneBuildConfig{
-				pendingMaxDuration: c.Build.PendingMaxDuration,
-				runningMaxDuration: c.Build.RunningMaxDuration,
-			},
-			agent: &droneAgentConfig{
-				cluster:          fleet,
-				minCount:         c.Agent.MinCount,
-				maxBuilds:        c.Agent.MaxBuilds,
-				minRetirementAge: c.Agent.MinRetirementAge,
-			},
+			agent:  &droneAgentConfig{cluster: fleet},
 		},
-		probeInterval: c.ProbeInterval,
+		notify: &notifyConfig{notifier: notifier},
+		store:  store,
+		reload: make(chan config.Config, 1),
+		wake:   make(chan struct{}, 1),
+	}
+	e.applyConfig(c)
+	return e
+}
+
+// Reload schedules the given configuration to be applied before the next
+// cycle. Only the latest of multiple pending configurations is applied.
+func (e *Engine) Reload(c config.Config) {
+	for {
+		select {
+		case e.reload <- c:
+			return
+		default:
+			// discard the pending configuration in favour of this one
+			select {
+			case <-e.reload:
+			default:
+			}
+		}
+	}
+}
+
+// applyConfig swaps the engine's configuration with the given one. The
+// clients, cached derived capacity and state tracked across cycles are
+// retained.
+func (e *Engine) applyConfig(c config.Config) {
+	prev := e.drone.agent
+	e.drone.build = &droneBuildConfig{
+		pendingMaxDuration: c.Build.PendingMaxDuration,
+		runningMaxDuration: c.Build.RunningMaxDuration,
+		cancelMaxDuration:  c.Build.CancelMaxDuration,
+		rules:              newBuildRules(c.Build.Rules),
+	}
+	e.drone.agent = &droneAgentConfig{
+		cluster:          prev.cluster,
+		minCount:         c.Agent.MinCount,
+		maxBuilds:        c.Agent.MaxBuilds,
+		minRetirementAge: c.Agent.MinRetirementAge,
+		minIdleDuration:  c.Agent.MinIdleDuration,
+		maxAge:           c.Agent.MaxAge,
+		replacementRate:  c.Agent.ReplacementRate,
+		zombieCycles:     c.Agent.ZombieCycles,
+		instanceCapacity: c.Agent.InstanceCapacity,
+		vcpusPerBuild:    c.Agent.VCPUsPerBuild,
+		memoryPerBuild:   c.Agent.MemoryPerBuild,
+
+		retirementStrategy: c.Agent.RetirementStrategy,
+		victimStrategy:     newVictimStrategy(c.Agent.RetirementStrategy),
+		instancePrices:     c.Agent.InstancePrices,
+
+		scalingTimeout:     c.Agent.ScalingTimeout,
+		resetStuckCapacity: c.Agent.ResetStuckCapacity,
+
+		headroomSlots:   c.Agent.HeadroomSlots,
+		headroomPercent: c.Agent.HeadroomPercent,
+
+		quarantineErrorRate: c.Agent.QuarantineErrorRate,
+		quarantineWindow:    c.Agent.QuarantineWindow,
+		quarantineRetention: c.Agent.QuarantineRetention,
+
+		tagDraining: c.StateTags,
+	}
+	if prev.vcpusPerBuild != c.Agent.VCPUsPerBuild || prev.memoryPerBuild != c.Agent.MemoryPerBuild {
+		// capacity derived from the previous resources per build is stale
+		e.derivedCapacity = nil
+	}
+
+	e.notify = &notifyConfig{
+		notifier:              e.notify.notifier,
+		upscaleThreshold:      c.Notify.UpscaleThreshold,
+		queuePauseThreshold:   c.Notify.QueuePauseThreshold,
+		scalingStuckThreshold: c.Notify.ScalingStuckThreshold,
+	}
+	e.policy = newPolicy(c, e)
+	e.dry = c.Dry
+	e.probeInterval = c.ProbeInterval
+	e.minInterval = c.ProbeIntervalMin
+	e.maxInterval = c.ProbeIntervalMax
+	e.cycleTimeout = c.CycleTimeout
+	e.eventDebounce = c.EventDebounce
+}
+
+// Wake makes the engine run a cycle once the event debounce has passed,
+// rather than waiting for the probe interval. Wake-ups received in the
+// meantime are coalesced into the same cycle.
+func (e *Engine) Wake() {
+	select {
+	case e.wake <- struct{}{}:
+	default:
 	}
 }
 
 func (e *Engine) Start(ctx context.Context) {
+	interval := e.adaptInterval(nil)
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	next := time.Now().Add(interval)
+	schedule := func(d time.Duration) {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(d)
+		next = time.Now().Add(d)
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
 			log.Infoln("Shutting down gracefully")
 			return
 
-		case <-time.After(e.probeInterval):
-			plan, err := e.Plan(ctx)
-			if err != nil {
-				log.WithError(err).Errorln("Failed to create scaling plan")
-				continue
-			}
+		case c := <-e.reload:
+			e.applyConfig(c)
+			log.Infoln("Reloaded configuration")
+			schedule(e.adaptInterval(nil))
 
-			if e.dry {
-				log.
-					WithField("plan", plan).
-					Infoln("Final plan generated")
-				log.Infoln("Dry mode is enabled, no further action will be taken")
-				continue
+		case <-e.wake:
+			// a cycle that's already due sooner covers the change
+			if time.Until(next) > e.eventDebounce {
+				schedule(e.eventDebounce)
 			}
 
-			if plan.RequiresUpscaling() {
-				if err = e.Upscale(ctx, plan.UpscaleCount()); err != nil {
-					log.WithError(err).Errorln("Failed to upscale")
-				}
-			} else if plan.RequiresDownscaling() {
-				if err = e.Downscale(ctx, plan.NodesToDestroy()); err != nil {
-					log.WithError(err).Errorln("Failed to downscale")
-				}
+		case <-timer.C:
+			plan := e.runCycle(ctx)
+			schedule(e.adaptInterval(plan))
+		}
+	}
+}
+
+// adaptInterval returns the interval until the next cycle, as adapted to
+// the given plan of the latest one. The interval drops to the minimum unless
+// the plan is stable, and doubles up to the maximum otherwise. It's kept as
+// is when there's no plan, and fixed at the probe interval unless both
+// bounds are configured.
+func (e *Engine) adaptInterval(plan *Plan) time.Duration {
+	prev := e.interval
+	switch {
+	case e.minInterval <= 0 || e.maxInterval <= 0:
+		e.interval = e.probeInterval
+	case prev == 0:
+		e.interval = e.probeInterval
+	case plan == nil:
+	case plan.Stable():
+		e.interval = prev * 2
+	default:
+		e.interval = e.minInterval
+	}
+	if e.minInterval > 0 && e.maxInterval > 0 {
+		if e.interval < e.minInterval {
+			e.interval = e.minInterval
+		}
+		if e.interval > e.maxInterval {
+			e.interval = e.maxInterval
+		}
+	}
+
+	if e.interval != prev {
+		log.
+			WithField("interval", e.interval).
+			Infoln("Adjusted probe interval")
+	}
+	metrics.ProbeInterval.Set(int64(e.interval / time.Second))
+	return e.interval
+}
+
+// runCycle plans and acts upon the plan, which is returned unless planning
+// failed. The cycle is bound by the cycle timeout, and cut short when the
+// app is shutting down. The agent autoscaling group is described once per
+// cycle.
+func (e *Engine) runCycle(ctx context.Context) *Plan {
+	ctx = cluster.WithSnapshot(ctx)
+	if e.cycleTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.cycleTimeout)
+		defer cancel()
+	}
+
+	plan, err := e.Plan(ctx)
+	if err != nil {
+		log.WithError(err).Errorln("Failed to create scaling plan")
+		return nil
+	}
+	e.saveState(ctx)
+	e.notifyScalingStuck(ctx)
+
+	if e.dry {
+		log.
+			WithField("plan", plan).
+			Infoln("Final plan generated")
+		log.Infoln("Dry mode is enabled, no further action will be taken")
+		return plan
+	}
+
+	e.unprotectExpiredAgents(ctx, plan.ExpiredAgents())
+	e.replaceZombieAgents(ctx, plan.ZombieAgents())
+	e.quarantineAgents(ctx, plan.AgentsToQuarantine())
+	e.terminateQuarantinedAgents(ctx)
+	if builds := plan.BuildsToCancel(); len(builds) > 0 {
+		e.CancelBuilds(ctx, builds)
+	}
+
+	if plan.RequiresUpscaling() {
+		result, err := e.Upscale(ctx, plan.CurrentCapacity(), plan.TargetCapacity())
+		var conflict *cluster.ConcurrentModificationError
+		if errors.As(err, &conflict) {
+			log.
+				WithError(err).
+				Warnln("Agent autoscaling group was modified while planning, skipping upscale until next cycle")
+			return plan
+		}
+		if err != nil {
+			log.WithError(err).Errorln("Failed to upscale")
+			return plan
+		}
+		if result.Clamped() {
+			metrics.ClampedUpscales.Add(1)
+			log.
+				WithField("requested", result.Requested).
+				WithField("desired", result.Desired).
+				Warnln("Target capacity is outside the size limits of agent autoscaling group, clamped it")
+		}
+		if added := result.Desired - result.Previous; added > 0 {
+			e.notifyUpscale(ctx, added)
+		}
+	} else if plan.RequiresCapacityReset() {
+		if err = e.ResetCapacity(ctx, plan.CurrentCapacity(), plan.TargetCapacity()); err != nil {
+			log.WithError(err).Errorln("Failed to reset capacity of agent cluster")
+		}
+	} else if plan.RequiresDownscaling() {
+		results, err := e.Downscale(ctx, plan.NodesToDestroy())
+		if err != nil {
+			log.WithError(err).Errorln("Failed to downscale")
+			failed := cluster.FailedTerminations(results)
+			if len(failed) == 0 {
+				// no agent could be terminated at all
+				failed = plan.NodesToDestroy()
 			}
+			e.notifyDownscaleFailed(ctx, failed, err)
 		}
 	}
+	return plan
 }
@@ -1,8 +1,18 @@
 package engine
 
 import (
+	"context"
+	"errors"
 	"github.com/Shuttl-Tech/drone-autoscaler/cluster"
+	"github.com/Shuttl-Tech/drone-autoscaler/config"
+	"github.com/Shuttl-Tech/drone-autoscaler/mocks"
+	"github.com/Shuttl-Tech/drone-autoscaler/state"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/drone/drone-go/drone"
+	"github.com/golang/mock/gomock"
 	"testing"
 	"time"
 )
@@ -21,10 +31,10 @@ func TestEngine_CountBuilds(t *testing.T) {
 
 	pending, running := e.countBuilds(stages)
 	if pending != 3 {
-		t.Errorf("Want pending 3, got %d", pending)
+		t.Errorf("Want pending 3, got %v", pending)
 	}
 	if running != 2 {
-		t.Errorf("Want running 2, got %d", running)
+		t.Errorf("Want running 2, got %v", running)
 	}
 }
 
@@ -56,6 +66,50 @@ func TestEngine_CalcRequiredAgentCount(t *testing.T) {
 	}
 }
 
+func TestEngine_Reload(t *testing.T) {
+	fleet := cluster.New("test-asg", nil, nil)
+	c := config.Config{}
+	c.Agent.MaxBuilds = 2
+	c.Agent.VCPUsPerBuild = 2
+	e := New(c, nil, fleet, nil, nil)
+	e.derivedCapacity = map[string]int{"c5.xlarge": 2}
+	e.discarded = map[int64]struct{}{42: {}}
+
+	// only the latest pending configuration is applied
+	c.Agent.MaxBuilds = 4
+	e.Reload(c)
+	c.Agent.MaxBuilds = 8
+	c.Agent.MinCount = 3
+	c.Dry = true
+	e.Reload(c)
+	e.applyConfig(<-e.reload)
+
+	if got, want := e.drone.agent.maxBuilds, 8; got != want {
+		t.Errorf("Want max builds %d, got %d", want, got)
+	}
+	if got, want := e.drone.agent.minCount, 3; got != want {
+		t.Errorf("Want min count %d, got %d", want, got)
+	}
+	if !e.dry {
+		t.Error("Want dry mode to be reloaded")
+	}
+	if e.drone.agent.cluster != fleet {
+		t.Error("Want agent cluster to be retained")
+	}
+	if _, ok := e.discarded[42]; !ok {
+		t.Error("Want discarded stages to be retained")
+	}
+	if e.derivedCapacity == nil {
+		t.Error("Want derived capacity to be retained")
+	}
+
+	c.Agent.VCPUsPerBuild = 4
+	e.applyConfig(c)
+	if e.derivedCapacity != nil {
+		t.Error("Want derived capacity to be reset when vcpus per build change")
+	}
+}
+
 func TestEngine_ListBusyAgents(t *testing.T) {
 	e := Engine{}
 	stages := []*drone.Stage{
@@ -236,3 +290,180 @@ func TestPlan_AgedRunningBuildFilter(t *testing.T) {
 		t.Error("Expected false once running build max duration is exceeded")
 	}
 }
+
+// Verifies that a hung AWS call is cancelled once the cycle times out
+func TestEngine_CycleTimeout(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	asg := mocks.NewMockAutoScalingAPI(ctrl)
+	asg.
+		EXPECT().
+		DescribeAutoScalingGroupsWithContext(gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx aws.Context, _ *autoscaling.DescribeAutoScalingGroupsInput, _ ...request.Option) (
+			*autoscaling.DescribeAutoScalingGroupsOutput,
+			error,
+		) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})
+
+	e := &Engine{
+		drone: &droneConfig{
+			agent: &droneAgentConfig{cluster: cluster.New("test-asg", nil, asg)},
+		},
+		cycleTimeout: 10 * time.Millisecond,
+	}
+
+	done := make(chan struct{})
+	go func() {
+		e.runCycle(context.TODO())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Want cycle to end once it times out")
+	}
+}
+
+// Verifies that a burst of wake-ups runs a single cycle once the event
+// debounce has passed, without waiting for the probe interval
+func TestEngine_Wake(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	cycles := make(chan struct{}, 10)
+	asg := mocks.NewMockAutoScalingAPI(ctrl)
+	asg.
+		EXPECT().
+		DescribeAutoScalingGroupsWithContext(gomock.Any(), gomock.Any()).
+		DoAndReturn(func(aws.Context, *autoscaling.DescribeAutoScalingGroupsInput, ...request.Option) (
+			*autoscaling.DescribeAutoScalingGroupsOutput,
+			error,
+		) {
+			cycles <- struct{}{}
+			return nil, errors.New("stop cycle")
+		}).
+		Times(1)
+
+	e := &Engine{
+		drone: &droneConfig{
+			agent: &droneAgentConfig{cluster: cluster.New("test-asg", nil, asg)},
+		},
+		probeInterval: time.Hour,
+		eventDebounce: 20 * time.Millisecond,
+		wake:          make(chan struct{}, 1),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		e.Start(ctx)
+		close(done)
+	}()
+	for i := 0; i < 5; i++ {
+		e.Wake()
+		time.Sleep(time.Millisecond)
+	}
+
+	select {
+	case <-cycles:
+	case <-time.After(time.Second):
+		t.Fatal("Want a cycle to run after waking the engine")
+	}
+	// no further cycle runs for the coalesced wake-ups
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+}
+
+func TestEngine_AdaptInterval(t *testing.T) {
+	e := &Engine{
+		probeInterval: 30 * time.Second,
+		minInterval:   10 * time.Second,
+		maxInterval:   time.Minute,
+	}
+	busy := &Plan{action: actionUpscale}
+	stable := &Plan{action: actionNone, stable: true}
+
+	if got, want := e.adaptInterval(nil), 30*time.Second; got != want {
+		t.Errorf("Want initial interval %v, got %v", want, got)
+	}
+	if got, want := e.adaptInterval(stable), time.Minute; got != want {
+		t.Errorf("Want interval %v while stable, got %v", want, got)
+	}
+	if got, want := e.adaptInterval(stable), time.Minute; got != want {
+		t.Errorf("Want interval capped at %v, got %v", want, got)
+	}
+	if got, want := e.adaptInterval(nil), time.Minute; got != want {
+		t.Errorf("Want interval %v retained when planning fails, got %v", want, got)
+	}
+	if got, want := e.adaptInterval(busy), 10*time.Second; got != want {
+		t.Errorf("Want interval %v while busy, got %v", want, got)
+	}
+	if got, want := e.adaptInterval(&Plan{action: actionNone}), 10*time.Second; got != want {
+		t.Errorf("Want interval %v while builds are pending, got %v", want, got)
+	}
+	if got, want := e.adaptInterval(stable), 20*time.Second; got != want {
+		t.Errorf("Want interval %v once stable again, got %v", want, got)
+	}
+
+	e.minInterval, e.maxInterval = 0, 0
+	if got, want := e.adaptInterval(busy), 30*time.Second; got != want {
+		t.Errorf("Want fixed probe interval %v when not adaptive, got %v", want, got)
+	}
+}
+
+// Verifies that a dry run doesn't persist the state of agents, since the
+// tag store would tag them
+func TestEngine_DryRunSkipsState(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	asg := mocks.NewMockAutoScalingAPI(ctrl)
+	asg.
+		EXPECT().
+		DescribeAutoScalingGroupsWithContext(gomock.Any(), gomock.Any()).
+		Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+			AutoScalingGroups: []*autoscaling.Group{
+				{
+					Instances: []*autoscaling.Instance{
+						{HealthStatus: aws.String("Healthy"), InstanceId: aws.String("i-001")},
+					},
+					DesiredCapacity: aws.Int64(1),
+				},
+			},
+		}, nil).
+		AnyTimes()
+
+	// agents are only described while loading the state, never tagged
+	ec2Client := mocks.NewMockEC2API(ctrl)
+	ec2Client.
+		EXPECT().
+		DescribeTagsWithContext(gomock.Any(), gomock.Any()).
+		Return(&ec2.DescribeTagsOutput{}, nil)
+
+	droneClient := mocks.NewMockClient(ctrl)
+	droneClient.
+		EXPECT().
+		Queue().
+		Return([]*drone.Stage{{Status: drone.StatusRunning, Machine: "i-001"}}, nil)
+
+	fleet := cluster.New("test-asg", ec2Client, asg)
+	e := &Engine{
+		dry: true,
+		drone: &droneConfig{
+			client: droneClient,
+			build: &droneBuildConfig{
+				pendingMaxDuration: -1 * time.Second,
+				runningMaxDuration: -1 * time.Second,
+			},
+			agent: &droneAgentConfig{cluster: fleet, maxBuilds: 2},
+		},
+		store: state.NewTagStore(fleet),
+	}
+	if plan := e.runCycle(context.TODO()); plan == nil {
+		t.Fatal("Want a plan to be generated")
+	}
+}
@@ -0,0 +1,73 @@
+package engine
+
+import (
+	"context"
+	"github.com/Shuttl-Tech/drone-autoscaler/cluster"
+	"github.com/Shuttl-Tech/drone-autoscaler/state"
+	"github.com/drone/drone-go/drone"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// loads the state of agents from the store once, before the first cycle
+// that needs it. The app carries on with an empty state if it can't be
+// loaded.
+func (e *Engine) loadState(ctx context.Context) {
+	if e.stateLoaded {
+		return
+	}
+	e.stateLoaded = true
+	if e.store == nil {
+		return
+	}
+
+	agents, err := e.store.Load(ctx)
+	if err != nil {
+		log.WithError(err).Warnln("Failed to load state of agents, starting afresh")
+		return
+	}
+	e.lastBusy = agents.LastBusy
+}
+
+// persists the state of agents, if a store is configured. Nothing is
+// persisted in dry mode, since the store may tag the agents.
+func (e *Engine) saveState(ctx context.Context) {
+	if e.store == nil || e.dry {
+		return
+	}
+	if err := e.store.Save(ctx, state.Agents{LastBusy: e.lastBusy}); err != nil {
+		log.WithError(err).Errorln("Failed to save state of agents")
+	}
+}
+
+// records the agents running the given stages as busy at the given time.
+// Agents that are no longer running are forgotten.
+func (e *Engine) trackBusyAgents(stages []*drone.Stage, running []cluster.NodeId, now time.Time) {
+	if e.lastBusy == nil {
+		e.lastBusy = make(map[cluster.NodeId]time.Time)
+	}
+	for _, id := range e.listBusyAgents(stages) {
+		e.lastBusy[id] = now
+	}
+
+	alive := toSet(running)
+	for id := range e.lastBusy {
+		if _, ok := alive[id]; !ok {
+			delete(e.lastBusy, id)
+		}
+	}
+}
+
+// returns the given agents that have run no builds for at least the min
+// idle duration. Agents that were never seen busy are considered idle, and
+// are only protected by their min retirement age.
+func (e *Engine) listAgentsAboveMinIdleDuration(ids []cluster.NodeId, now time.Time) []cluster.NodeId {
+	res := make([]cluster.NodeId, 0, len(ids))
+	for _, id := range ids {
+		busy, ok := e.lastBusy[id]
+		if !ok || now.Sub(busy) >= e.drone.agent.minIdleDuration {
+			res = append(res, id)
+		}
+	}
+	return res
+}
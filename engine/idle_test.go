@@ -0,0 +1,63 @@
+package engine
+
+import (
+	"context"
+	"github.com/Shuttl-Tech/drone-autoscaler/cluster"
+	"github.com/Shuttl-Tech/drone-autoscaler/state"
+	"github.com/drone/drone-go/drone"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestIdle_MinIdleDuration(t *testing.T) {
+	now := time.Now().UTC()
+	e := &Engine{
+		drone: &droneConfig{
+			agent: &droneAgentConfig{minIdleDuration: 5 * time.Minute},
+		},
+	}
+	running := []cluster.NodeId{"i-100", "i-200", "i-300"}
+
+	// i-100 finished its build a couple of minutes ago
+	e.trackBusyAgents(
+		[]*drone.Stage{{Machine: "i-100", Status: drone.StatusRunning}},
+		running,
+		now.Add(-2*time.Minute),
+	)
+	// i-200 did so a while ago, and i-400 is gone
+	e.lastBusy["i-200"] = now.Add(-10 * time.Minute)
+	e.lastBusy["i-400"] = now.Add(-time.Minute)
+	e.trackBusyAgents(nil, running, now)
+
+	if _, ok := e.lastBusy["i-400"]; ok {
+		t.Error("Want agents that are no longer running to be forgotten")
+	}
+	got := e.listAgentsAboveMinIdleDuration(running, now)
+	if want := []cluster.NodeId{"i-200", "i-300"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Want agents past min idle duration %v, got %v", want, got)
+	}
+}
+
+// Verifies that the state of agents survives restarts
+func TestIdle_State(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scaler-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := state.NewFileStore(filepath.Join(dir, "state.json"))
+	busy := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	e := &Engine{store: store, lastBusy: map[cluster.NodeId]time.Time{"i-100": busy}}
+	e.saveState(context.TODO())
+
+	restarted := &Engine{store: store}
+	restarted.loadState(context.TODO())
+	if got := restarted.lastBusy["i-100"]; !got.Equal(busy) {
+		t.Errorf("Want agent last busy at %v, got %v", busy, got)
+	}
+}
@@ -0,0 +1,103 @@
+package engine
+
+import (
+	"context"
+	"github.com/Shuttl-Tech/drone-autoscaler/cluster"
+	"github.com/Shuttl-Tech/drone-autoscaler/notify"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+type notifyConfig struct {
+	notifier              notify.Notifier
+	upscaleThreshold      int
+	queuePauseThreshold   time.Duration
+	scalingStuckThreshold time.Duration
+}
+
+// tracks how long the agent autoscaling group has had a scaling activity
+// in progress, so that a stuck activity is notified only once
+type scalingActivity struct {
+	since    time.Time
+	notified bool
+	timedOut bool
+
+	// IDs of the failed activities of the autoscaling group that were
+	// already reported
+	reported map[string]struct{}
+}
+
+// emit sends an event of the given type to operators. Failure to deliver
+// a notification is logged but never interrupts the autoscaler.
+func (e *Engine) emit(ctx context.Context, t notify.EventType, fields map[string]interface{}) {
+	if e.notify == nil || e.notify.notifier == nil {
+		return
+	}
+	if err := e.notify.notifier.Notify(ctx, notify.NewEvent(t, fields)); err != nil {
+		log.
+			WithError(err).
+			WithField("event", t).
+			Errorln("Failed to send notification")
+	}
+}
+
+// notifyUpscale notifies operators if the number of agents added crosses
+// the upscale threshold
+func (e *Engine) notifyUpscale(ctx context.Context, count int) {
+	if e.notify == nil || count < e.notify.upscaleThreshold {
+		return
+	}
+	e.emit(ctx, notify.EventUpscale, map[string]interface{}{"count": count})
+}
+
+// notifyDownscaleFailed notifies operators that agents couldn't be destroyed
+func (e *Engine) notifyDownscaleFailed(ctx context.Context, agents []cluster.NodeId, err error) {
+	e.emit(ctx, notify.EventDownscaleFailed, map[string]interface{}{
+		"ids":   agents,
+		"error": err.Error(),
+	})
+}
+
+// notifyQueueResumeFailed notifies operators that the build queue couldn't
+// be resumed and must be resumed manually
+func (e *Engine) notifyQueueResumeFailed(ctx context.Context, err error) {
+	e.emit(ctx, notify.EventQueueResumeFailed, map[string]interface{}{"error": err.Error()})
+}
+
+// notifyQueuePaused notifies operators if the build queue remained paused
+// for longer than the queue pause threshold
+func (e *Engine) notifyQueuePaused(ctx context.Context, d time.Duration) {
+	if e.notify == nil || d < e.notify.queuePauseThreshold {
+		return
+	}
+	e.emit(ctx, notify.EventQueuePaused, map[string]interface{}{"duration": d.String()})
+}
+
+// trackScalingActivity records whether the agent autoscaling group has a
+// scaling activity in progress as of now
+func (e *Engine) trackScalingActivity(inProgress bool) {
+	if !inProgress {
+		e.scaling = scalingActivity{}
+		return
+	}
+	if e.scaling.since.IsZero() {
+		e.scaling.since = time.Now().UTC()
+	}
+}
+
+// notifyScalingStuck notifies operators once per scaling activity that has
+// been in progress for longer than the stuck scaling threshold
+func (e *Engine) notifyScalingStuck(ctx context.Context) {
+	if e.notify == nil || e.scaling.since.IsZero() || e.scaling.notified {
+		return
+	}
+	d := time.Since(e.scaling.since)
+	if d < e.notify.scalingStuckThreshold {
+		return
+	}
+	e.scaling.notified = true
+	e.emit(ctx, notify.EventScalingStuck, map[string]interface{}{
+		"duration": d.Round(time.Second).String(),
+		"since":    e.scaling.since,
+	})
+}
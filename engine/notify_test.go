@@ -0,0 +1,83 @@
+package engine
+
+import (
+	"context"
+	"github.com/Shuttl-Tech/drone-autoscaler/notify"
+	"testing"
+	"time"
+)
+
+type recordingNotifier struct {
+	events []notify.Event
+}
+
+func (r *recordingNotifier) Notify(ctx context.Context, e notify.Event) error {
+	r.events = append(r.events, e)
+	return nil
+}
+
+func TestNotify_Thresholds(t *testing.T) {
+	rec := &recordingNotifier{}
+	e := &Engine{
+		notify: &notifyConfig{
+			notifier:            rec,
+			upscaleThreshold:    5,
+			queuePauseThreshold: 30 * time.Second,
+		},
+	}
+
+	e.notifyUpscale(context.TODO(), 4)
+	e.notifyQueuePaused(context.TODO(), 10*time.Second)
+	if len(rec.events) != 0 {
+		t.Fatalf("Want no events below thresholds, got %v", rec.events)
+	}
+
+	e.notifyUpscale(context.TODO(), 5)
+	e.notifyQueuePaused(context.TODO(), time.Minute)
+	if len(rec.events) != 2 {
+		t.Fatalf("Want 2 events above thresholds, got %v", rec.events)
+	}
+	if rec.events[0].Type != notify.EventUpscale {
+		t.Errorf("Want upscale event, got %s", rec.events[0].Type)
+	}
+	if rec.events[1].Type != notify.EventQueuePaused {
+		t.Errorf("Want queue paused event, got %s", rec.events[1].Type)
+	}
+}
+
+func TestNotify_ScalingStuck(t *testing.T) {
+	rec := &recordingNotifier{}
+	e := &Engine{
+		notify: &notifyConfig{
+			notifier:              rec,
+			scalingStuckThreshold: time.Minute,
+		},
+	}
+
+	e.trackScalingActivity(true)
+	e.notifyScalingStuck(context.TODO())
+	if len(rec.events) != 0 {
+		t.Fatalf("Want no event for a fresh scaling activity, got %v", rec.events)
+	}
+
+	e.scaling.since = time.Now().Add(-2 * time.Minute)
+	e.trackScalingActivity(true)
+	e.notifyScalingStuck(context.TODO())
+	e.notifyScalingStuck(context.TODO())
+	if len(rec.events) != 1 || rec.events[0].Type != notify.EventScalingStuck {
+		t.Fatalf("Want a single scaling stuck event, got %v", rec.events)
+	}
+
+	e.trackScalingActivity(false)
+	if !e.scaling.since.IsZero() || e.scaling.notified {
+		t.Errorf("Want scaling activity tracking to be reset, got %+v", e.scaling)
+	}
+}
+
+// Verifies that engines without notifications configured don't fail
+func TestNotify_Disabled(t *testing.T) {
+	e := &Engine{}
+	e.notifyUpscale(context.TODO(), 100)
+	e.notifyQueuePaused(context.TODO(), time.Hour)
+	e.notifyScalingStuck(context.TODO())
+}
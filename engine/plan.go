@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/Shuttl-Tech/drone-autoscaler/cluster"
+	"github.com/Shuttl-Tech/drone-autoscaler/metrics"
+	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/drone/drone-go/drone"
 	log "github.com/sirupsen/logrus"
 	"math"
@@ -15,26 +17,47 @@ import (
 // by autoscaler's planner engine. It also supplies the data required to
 // carry out the action.
 type Plan struct {
-	action         string
-	upscaleCount   int
-	nodesToDestroy []cluster.NodeId
+	action          string
+	upscaleCount    int
+	currentCapacity int
+	targetCapacity  int
+	nodesToDestroy  []cluster.NodeId
+	buildsToCancel  []BuildRef
+	expiredAgents   []cluster.NodeId
+	zombieAgents    []cluster.NodeId
+	toQuarantine    []cluster.NodeId
+
+	// no builds are pending and the agent cluster isn't scaling
+	stable bool
 }
 
 // serialization methods for better representation of Plan in logs
 func (p *Plan) String() string {
 	return fmt.Sprintf(
-		"action=%v, upscaleCount=%v, nodesToDestroy=%v",
+		"action=%v, upscaleCount=%v, currentCapacity=%v, targetCapacity=%v, nodesToDestroy=%v, buildsToCancel=%v, expiredAgents=%v, zombieAgents=%v, toQuarantine=%v",
 		p.action,
 		p.upscaleCount,
+		p.currentCapacity,
+		p.targetCapacity,
 		p.nodesToDestroy,
+		p.buildsToCancel,
+		p.expiredAgents,
+		p.zombieAgents,
+		p.toQuarantine,
 	)
 }
 
 func (p *Plan) MarshalJSON() ([]byte, error) {
 	return json.Marshal(map[string]interface{}{
-		"action":         p.action,
-		"upscaleCount":   p.upscaleCount,
-		"nodesToDestroy": p.nodesToDestroy,
+		"action":          p.action,
+		"upscaleCount":    p.upscaleCount,
+		"currentCapacity": p.currentCapacity,
+		"targetCapacity":  p.targetCapacity,
+		"nodesToDestroy":  p.nodesToDestroy,
+		"buildsToCancel":  p.buildsToCancel,
+		"expiredAgents":   p.expiredAgents,
+		"zombieAgents":    p.zombieAgents,
+		"toQuarantine":    p.toQuarantine,
 	})
 }
 
@@ -55,14 +78,69 @@ func (p *Plan) UpscaleCount() int {
 	return p.upscaleCount
 }
 
+// CurrentCapacity returns the desired capacity of the agent autoscaling
+// group the plan is based on
+func (p *Plan) CurrentCapacity() int {
+	return p.currentCapacity
+}
+
+// TargetCapacity returns the desired capacity the agent autoscaling group
+// must be set to when upscaling
+func (p *Plan) TargetCapacity() int {
+	return p.targetCapacity
+}
+
+// ExpiredAgents returns IDs of agents that exceeded the max agent age, which
+// are retired as soon as they're idle
+func (p *Plan) ExpiredAgents() []cluster.NodeId {
+	return p.expiredAgents
+}
+
+// ZombieAgents returns IDs of agents that stayed idle through the zombie
+// cycles while builds were pending, which must be marked unhealthy so that
+// they're replaced
+func (p *Plan) ZombieAgents() []cluster.NodeId {
+	return p.zombieAgents
+}
+
+// AgentsToQuarantine returns IDs of idle agents whose recent stages errored
+// at or above the quarantine error rate, which must be quarantined
+func (p *Plan) AgentsToQuarantine() []cluster.NodeId {
+	return p.toQuarantine
+}
+
+// Stable returns true when no builds are pending, the agent cluster has no
+// scaling activity in progress and no action needs to be taken
+func (p *Plan) Stable() bool {
+	return p.stable && p.action == actionNone
+}
+
+// RequiresCapacityReset returns true when the desired capacity of the agent
+// cluster must be reset to the number of agents it actually has, since its
+// scaling activity timed out
+func (p *Plan) RequiresCapacityReset() bool {
+	return p.action == actionReset
+}
+
 // NodesToDestroy returns IDs of agent machines to destroy when downscaling
 func (p *Plan) NodesToDestroy() []cluster.NodeId {
 	return p.nodesToDestroy
 }
 
+// BuildsToCancel returns the builds that crossed the hard duration limit
+// and must be cancelled, regardless of the scaling action
+func (p *Plan) BuildsToCancel() []BuildRef {
+	return p.buildsToCancel
+}
+
 // Plan determines whether there is a need to upscale or downscale the agent
-// cluster based on current capacity and build traffic
+// cluster based on current capacity and build traffic. The decision is left
+// to the configured scaling policy, except for maintaining the min agent
+// count and resetting the capacity of a scaling activity that timed out.
 func (e *Engine) Plan(ctx context.Context) (*Plan, error) {
+	// the agent autoscaling group is described only once while planning
+	ctx = cluster.WithSnapshot(ctx)
+
 	// default response is no operation (or noop)
 	response := &Plan{
 		action:         actionNone,
@@ -70,31 +148,73 @@ func (e *Engine) Plan(ctx context.Context) (*Plan, error) {
 		nodesToDestroy: []cluster.NodeId{},
 	}
 
-	// let the cluster autoscale group reconcile before acting any further
-	ok, err := e.drone.agent.cluster.ScalingActivityInProgress(ctx)
+	e.loadState(ctx)
+
+	activity, err := e.drone.agent.cluster.ScalingActivityInProgress(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to check for any scaling activity in progress: %v", err)
 	}
-	if ok {
-		log.Debugln("Cluster has a scaling activity in progress, recommending noop")
-		return response, nil
+	e.trackScalingActivity(activity)
+
+	capacity, err := e.drone.agent.cluster.Capacity(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't fetch capacity of agent cluster: %v", err)
 	}
+	response.currentCapacity = capacity.Desired
+	response.targetCapacity = capacity.Desired
 
 	runningAgents, err := e.drone.agent.cluster.List(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't fetch list of running agent nodes: %v", err)
 	}
 
+	timedOut := false
+	if activity {
+		e.reportFailedScalingActivities(ctx)
+		if timedOut = e.scalingTimedOut(); timedOut {
+			e.notifyScalingTimedOut(ctx, capacity)
+			if e.drone.agent.resetStuckCapacity {
+				log.
+					WithField("desired", capacity.Desired).
+					WithField("actual", capacity.Actual).
+					Warnln("Scaling activity timed out, recommending reset of desired capacity")
+
+				response.action = actionReset
+				response.targetCapacity = capacity.Actual
+				return response, nil
+			}
+			log.Warnln("Scaling activity timed out, planning as if it finished")
+			activity = false
+		}
+	}
+
+	// agents requested from the autoscale group that are yet to be launched
+	// are capacity on its way, so only the shortfall beyond them is added.
+	// The ones of an activity that timed out are never expected to come up.
 	runningAgentCount := len(runningAgents)
-	if runningAgentCount < e.drone.agent.minCount {
+	incomingAgentCount := 0
+	if activity {
+		incomingAgentCount = capacity.Desired - runningAgentCount
+	}
+	if incomingAgentCount < 0 {
+		incomingAgentCount = 0
+	}
+	if incomingAgentCount > 0 {
+		log.
+			WithField("count", incomingAgentCount).
+			Debugln("Agents are being launched")
+	}
+
+	if runningAgentCount+incomingAgentCount < e.drone.agent.minCount {
 		// reconcile the agent count to the minimum number to maintain
-		c := e.drone.agent.minCount - runningAgentCount
+		c := e.drone.agent.minCount - runningAgentCount - incomingAgentCount
 		log.
 			WithField("count", c).
 			Info("Agent cluster size is below minimum required, recommending scale-up")
 
 		response.action = actionUpscale
 		response.upscaleCount = c
+		response.targetCapacity = upscaleTarget(capacity, timedOut, c)
 		return response, nil
 	}
 
@@ -102,124 +222,258 @@ func (e *Engine) Plan(ctx context.Context) (*Plan, error) {
 	if err != nil {
 		return nil, fmt.Errorf("couldn't fetch build queue from drone: %v", err)
 	}
+	e.trackBusyAgents(stages, runningAgents, time.Now().UTC())
+	// agents running stages past their max duration aren't idle, even
+	// though the stages are ignored while planning
+	occupiedAgents := e.listBusyAgents(stages)
+
+	// determine the rule applicable to every stage based on its repository,
+	// which is also needed to look up the outcome of finished stages
+	var repos map[int64]*drone.Repo
+	if len(e.drone.build.rules) > 0 || e.drone.agent.quarantineErrorRate > 0 {
+		if repos, err = e.lookupBuildRepos(); err != nil {
+			return nil, fmt.Errorf("couldn't look up repositories of builds: %v", err)
+		}
+	}
+	e.matchBuildRules(repos)
+	e.trackStageOutcomes(stages, repos, runningAgents)
+
+	// every running stage occupies slots on its agent, including the ones
+	// ignored while planning
+	_, occupiedSlots := e.countBuilds(stages)
+	capacities, err := e.fleetCapacity(ctx, runningAgents)
+	if err != nil {
+		return nil, err
+	}
+	// like the agents added when upscaling, the ones being launched are
+	// assumed to have max builds per agent slots
+	incomingSlots := incomingAgentCount * e.drone.agent.maxBuilds
+	totalSlots := totalCapacity(capacities) + incomingSlots
+	freeSlots := float64(totalSlots) - occupiedSlots
+	log.
+		WithField("total", totalSlots).
+		WithField("incoming", incomingSlots).
+		WithField("free", freeSlots).
+		Debugln("Determined build slots of agent cluster")
 
 	// remove all builds that are pending or running for longer than their
-	// maximum allowed duration
-	// TODO: log stages that were discarded because they exceeded max duration
-	stages = filterStages(stages, e.agedPendingBuildFilter)
-	stages = filterStages(stages, e.agedRunningBuildFilter)
+	// maximum allowed duration, followed by the ones excluded from scaling
+	stages, buildsToCancel := e.filterAgedStages(ctx, stages, repos)
+	stages = filterStages(stages, e.excludedBuildFilter)
+
+	snapshot := &Snapshot{
+		Capacity:   capacity,
+		Activity:   activity,
+		TimedOut:   timedOut,
+		Agents:     runningAgents,
+		Slots:      capacities,
+		TotalSlots: totalSlots,
+		FreeSlots:  freeSlots,
+		Headroom:   e.headroom(occupiedSlots),
+		Stages:     stages,
+	}
+	snapshot.Pending, snapshot.Running = e.countBuilds(stages)
+	snapshot.OldestPending = oldestPending(stages, time.Now().UTC())
 
-	pendingBuildCount, runningBuildCount := e.countBuilds(stages)
-	if pendingBuildCount > 0 {
+	// zombie agents are about to be replaced by the autoscaling group, so
+	// their build slots, which were never usable anyway, are swapped for
+	// those of their replacements
+	zombies, err := e.listZombieAgents(ctx, runningAgents, occupiedAgents, snapshot.Pending > 0)
+	if err != nil {
+		return nil, err
+	}
+	metrics.ZombieAgents.Set(int64(len(zombies)))
+	snapshot = snapshot.replaced(zombies, e.drone.agent.maxBuilds)
+	runningAgents = snapshot.Agents
+
+	// so are the agents about to be quarantined, since they're detached
+	// without decrementing the desired capacity
+	toQuarantine := e.listAgentsToQuarantine(runningAgents, occupiedAgents)
+	snapshot = snapshot.replaced(toQuarantine, e.drone.agent.maxBuilds)
+	runningAgents = snapshot.Agents
+
+	// idle agents past the max agent age are about to be recycled, so the
+	// policy plans without them
+	expired, err := e.listExpiredAgents(ctx, runningAgents)
+	if err != nil {
+		return nil, err
+	}
+	busyAgents := e.listBusyAgents(stages)
+	recyclable := e.listIdleAgents(expired, busyAgents)
+	metrics.ExpiredAgents.Set(int64(len(expired)))
+	if len(expired) > 0 {
 		log.
-			WithField("count", pendingBuildCount).
-			Debugln("Detected pending builds")
+			WithField("expired", expired).
+			WithField("idle", recyclable).
+			Debugln("Found agents past max agent age")
+	}
 
-		// we need to scale up since builds are queued but not yet running
-		c, err := e.calcUpscaleCount(pendingBuildCount)
-		if err != nil {
-			return nil, err
-		}
+	// so are some of the idle agents launched from an outdated launch
+	// template or configuration
+	outdated, err := e.listOutdatedAgents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	recyclable = append(recyclable, e.pickReplacements(outdated, busyAgents, recyclable)...)
 
-		log.
-			WithField("count", c).
-			Infoln("Recommending adding more agents")
+	policy := e.policy
+	if policy == nil {
+		policy = reactivePolicy{e}
+	}
+	plan, err := policy.Plan(ctx, snapshot.without(recyclable))
+	if err != nil {
+		return nil, err
+	}
+	plan = e.planRecycling(plan, snapshot, runningAgents, recyclable)
+	plan.expiredAgents = expired
+	plan.zombieAgents = zombies
+	plan.toQuarantine = toQuarantine
+	plan.buildsToCancel = buildsToCancel
+	plan.stable = snapshot.Pending == 0 && !activity
+	return plan, nil
+}
 
-		response.action = actionUpscale
-		response.upscaleCount = c
+// planDownscale plans the retirement of idle agents past their min
+// retirement age, as long as the build slots they provide add up to no
+// more than the given number. The min agent count is maintained.
+func (e *Engine) planDownscale(ctx context.Context, s *Snapshot, maxSlots float64) (*Plan, error) {
+	response := newPlan(s)
+
+	busyAgents := e.listBusyAgents(s.Stages)
+	idleAgents := e.listIdleAgents(s.Agents, busyAgents)
+	if len(idleAgents) < 1 {
+		log.Debugln("No idle agents found, recommending noop")
 		return response, nil
-	} else {
-		log.Debugln("Checking for any under-utilized capacity")
+	}
 
-		requiredAgentCount, err := e.calcRequiredAgentCount(runningBuildCount)
-		if err != nil {
-			return nil, err
-		}
-		if runningAgentCount == requiredAgentCount {
-			log.Debugln("No scaling action required, recommending noop")
-			return response, nil
-		}
+	log.
+		WithField("busy", busyAgents).
+		WithField("idle", idleAgents).
+		Debugln("Determined list of busy and idle agents")
 
-		log.
-			WithField("required", requiredAgentCount).
-			WithField("running", runningAgentCount).
-			Debugln("Running agent count is more than required")
-
-		busyAgents := e.listBusyAgents(stages)
-		idleAgents := e.listIdleAgents(runningAgents, busyAgents)
-		if len(idleAgents) < 1 {
-			log.Debugln("No idle agents found, recommending noop")
-			return response, nil
-		}
+	idleAgents = e.listAgentsAboveMinIdleDuration(idleAgents, time.Now().UTC())
+	if len(idleAgents) == 0 {
+		// the agents just finished their builds and are likely to be
+		// assigned new ones soon
+		log.Debugln("Idle agents are not past min idle duration, recommending noop")
+		return response, nil
+	}
 
-		log.
-			WithField("busy", busyAgents).
-			WithField("idle", idleAgents).
-			Debugln("Determined list of busy and idle agents")
+	expendable, err := e.listAgentsAboveMinRetirementAge(ctx, idleAgents)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't fetch agents above retirement age: %v", err)
+	}
+	if len(expendable) == 0 {
+		// we have newly created agents, so they're not busy yet because it
+		// might be a while before Drone starts assigning them jobs
+		log.Debugln("Idle agents are not past retirement age, recommending noop")
+		return response, nil
+	}
+	log.
+		WithField("agents", instanceIds(expendable)).
+		Debugln("Found idle agents above min retirement age")
 
-		expendable, err := e.listAgentsAboveMinRetirementAge(ctx, idleAgents)
-		if err != nil {
-			return nil, fmt.Errorf("couldn't fetch agents above retirement age: %v", err)
-		}
-		if len(expendable) == 0 {
-			// we have newly created agents, so they're not busy yet because it
-			// might be a while before Drone starts assigning them jobs
-			log.Debugln("Idle agents are not past retirement age, recommending noop")
-			return response, nil
-		}
+	victims, err := e.orderVictims(ctx, s.Agents, expendable)
+	if err != nil {
+		return nil, err
+	}
+	// agents that failed to terminate go first, so that they aren't left
+	// out by the limit on the slots retired
+	victims = e.retryFailedTerminations(s.Agents, victims)
+	victims = limitVictims(victims, s.Slots, maxSlots)
+
+	if e.drone.agent.minCount > 0 {
 		log.
-			WithField("agents", expendable).
-			Debugln("Found idle agents above min retirement age")
+			WithField("count", e.drone.agent.minCount).
+			Debugln("Need to maintain a minimum number of agents in the cluster")
+	}
 
-		if e.drone.agent.minCount > 0 {
-			log.
-				WithField("count", e.drone.agent.minCount).
-				Debugln("Need to maintain a minimum number of agents in the cluster")
-		}
+	victims = e.maintainMinAgentCount(s.Agents, victims)
+	if len(victims) == 0 {
+		log.Debugln("Cannot destroy agents to maintain min count, recommending noop")
+		return response, nil
+	}
+	log.
+		WithField("ids", victims).
+		Infoln("Recommending downscaling of agents")
+
+	response.action = actionDownscale
+	response.nodesToDestroy = victims
+	return response, nil
+}
 
-		expendable = e.maintainMinAgentCount(runningAgents, expendable)
-		if len(expendable) == 0 {
-			log.Debugln("Cannot destroy agents to maintain min count, recommending noop")
-			return response, nil
+// returns the longest prefix of the given victims whose build slots add up
+// to no more than the given number
+func limitVictims(victims []cluster.NodeId, slots map[cluster.NodeId]int, maxSlots float64) []cluster.NodeId {
+	total := 0.0
+	for i, v := range victims {
+		total += float64(slots[v])
+		if total > maxSlots {
+			return victims[:i]
 		}
-		log.
-			WithField("ids", expendable).
-			Infoln("Recommending downscaling of agents")
+	}
+	return victims
+}
 
-		response.action = actionDownscale
-		response.nodesToDestroy = expendable
-		return response, nil
+// returns how long the oldest of the given pending stages has waited
+func oldestPending(stages []*drone.Stage, now time.Time) time.Duration {
+	var res time.Duration
+	for _, stage := range stages {
+		if stage.Status != drone.StatusPending {
+			continue
+		}
+		if wait := now.Sub(time.Unix(stage.Created, 0)); wait > res {
+			res = wait
+		}
 	}
+	return res
 }
 
-// Returns the number of pending & running builds from given drone stages
-func (e *Engine) countBuilds(stages []*drone.Stage) (pending, running int) {
+// Returns the number of build slots needed by pending & running builds
+// from given drone stages, weighing every stage as per its build rule
+func (e *Engine) countBuilds(stages []*drone.Stage) (pending, running float64) {
 	for _, stage := range stages {
 		switch stage.Status {
 		case drone.StatusRunning:
-			running++
+			running += e.stageWeight(stage)
 		case drone.StatusPending:
-			pending++
+			pending += e.stageWeight(stage)
 		}
 	}
 	return
 }
 
 // Calculates number of agents required to run given number of builds.
-func (e *Engine) calcRequiredAgentCount(buildCount int) (int, error) {
+// Capacity of newly launched agents is assumed to be max builds per agent,
+// since their instance type isn't known in advance.
+func (e *Engine) calcRequiredAgentCount(buildCount float64) (int, error) {
 	maxCountPerAgent := e.drone.agent.maxBuilds
 	if maxCountPerAgent < 1 {
 		return 0, fmt.Errorf("max builds per agent cannot be %d", maxCountPerAgent)
 	}
-	res := math.Ceil(float64(buildCount) / float64(maxCountPerAgent))
+	res := math.Ceil(buildCount / float64(maxCountPerAgent))
 	return int(res), nil
 }
 
-// Calculates the number of agents to add to run pending builds.
-// This method simply wraps around calcRequiredAgentCount() to provide
-// a cleaner abstraction.
-func (e *Engine) calcUpscaleCount(pendingBuildCount int) (int, error) {
-	return e.calcRequiredAgentCount(pendingBuildCount)
+// Calculates the number of agents to add to run pending builds that
+// don't fit in the free build slots of the existing agents, while keeping
+// the given headroom of slots free.
+func (e *Engine) calcUpscaleCount(pendingBuildCount, freeSlots, headroom float64) (int, error) {
+	shortfall := pendingBuildCount + headroom - math.Max(freeSlots, 0)
+	if shortfall <= 0 {
+		return 0, nil
+	}
+	return e.calcRequiredAgentCount(shortfall)
+}
+
+// Returns the number of free build slots to keep available, given the
+// number of slots in use. It's the greater of the absolute headroom and the
+// percentage of in-use slots.
+func (e *Engine) headroom(inUse float64) float64 {
+	return math.Max(
+		float64(e.drone.agent.headroomSlots),
+		math.Ceil(inUse*e.drone.agent.headroomPercent/100),
+	)
 }
 
 // Returns a list of agents that are currently running 1 or more builds
@@ -237,13 +491,11 @@ func (e *Engine) listBusyAgents(stages []*drone.Stage) []cluster.NodeId {
 }
 
 // Returns list of agents that are currently running 0 builds
-// TODO: optimize
-//  This method has a complexity of O(N^2) where N = total no.
-//  of drone agents. We can take a map approach to make it O(N).
 func (e *Engine) listIdleAgents(all, busy []cluster.NodeId) []cluster.NodeId {
+	busySet := toSet(busy)
 	res := make([]cluster.NodeId, 0, len(all))
 	for _, subject := range all {
-		if !contains(busy, subject) {
+		if _, ok := busySet[subject]; !ok {
 			res = append(res, subject)
 		}
 	}
@@ -251,12 +503,12 @@ func (e *Engine) listIdleAgents(all, busy []cluster.NodeId) []cluster.NodeId {
 }
 
 func (e *Engine) listAgentsAboveMinRetirementAge(ctx context.Context, ids []cluster.NodeId) (
-	[]cluster.NodeId,
+	[]*ec2.Instance,
 	error,
 ) {
 	now := time.Now().UTC()
 	age := e.drone.agent.minRetirementAge
-	filtered := make([]cluster.NodeId, 0, len(ids))
+	filtered := make([]*ec2.Instance, 0, len(ids))
 
 	agents, err := e.drone.agent.cluster.Describe(ctx, ids)
 	if err != nil {
@@ -264,12 +516,15 @@ func (e *Engine) listAgentsAboveMinRetirementAge(ctx context.Context, ids []clus
 	}
 	for _, agent := range agents {
 		if now.After(agent.LaunchTime.Add(age)) {
-			filtered = append(filtered, cluster.NodeId(*agent.InstanceId))
+			filtered = append(filtered, agent)
 		}
 	}
 	return filtered, nil
 }
 
+// Trims the given list of expendable agents, ordered by retirement
+// preference, so that destroying them doesn't shrink the cluster below
+// the minimum agent count
 func (e *Engine) maintainMinAgentCount(all, expendable []cluster.NodeId) []cluster.NodeId {
 	var (
 		allCount     = len(all)
@@ -281,7 +536,7 @@ func (e *Engine) maintainMinAgentCount(all, expendable []cluster.NodeId) []clust
 	}
 	if (allCount - destroyCount) < minCount {
 		delta := minCount - (allCount - destroyCount)
-		return expendable[delta:]
+		return expendable[:destroyCount-delta]
 	}
 	return expendable
 }
@@ -289,16 +544,21 @@ func (e *Engine) maintainMinAgentCount(all, expendable []cluster.NodeId) []clust
 // filter func that returns false if a build has been in pending state
 // for longer than allowed duration
 func (e *Engine) agedPendingBuildFilter(stage *drone.Stage) bool {
+	maxDuration := e.drone.build.pendingMaxDuration
+	if r := e.ruleOf(stage); r != nil && r.pendingMaxDuration > 0 {
+		maxDuration = r.pendingMaxDuration
+	}
+
 	// a negative value means no upper bound is enforced on the pending
 	// build's duration of existence
-	if e.drone.build.pendingMaxDuration < time.Duration(0) {
+	if maxDuration < time.Duration(0) {
 		return true
 	}
 	if stage.Status == drone.StatusPending {
 		now := time.Now().UTC()
 		upper := time.
 			Unix(stage.Created, 0).
-			Add(e.drone.build.pendingMaxDuration).
+			Add(maxDuration).
 			UTC()
 		return now.Before(upper)
 	}
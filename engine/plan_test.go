@@ -2,18 +2,22 @@ package engine
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"github.com/Shuttl-Tech/drone-autoscaler/cluster"
 	"github.com/Shuttl-Tech/drone-autoscaler/mocks"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/drone/drone-go/drone"
 	"github.com/golang/mock/gomock"
+	log "github.com/sirupsen/logrus"
 	"testing"
 	"time"
 )
 
-// Verifies that planner recommends noop when a scaling activity
+// Verifies that planner doesn't shed idle agents while a scaling activity
 // is in progress in the agent pool.
 func TestPlan_ScalingInProgress(t *testing.T) {
 	ctrl := gomock.NewController(t)
@@ -22,22 +26,34 @@ func TestPlan_ScalingInProgress(t *testing.T) {
 	asg := mocks.NewMockAutoScalingAPI(ctrl)
 	asg.
 		EXPECT().
-		DescribeAutoScalingGroups(gomock.Any()).
+		DescribeAutoScalingGroupsWithContext(gomock.Any(), gomock.Any()).
 		Return(&autoscaling.DescribeAutoScalingGroupsOutput{
 			AutoScalingGroups: []*autoscaling.Group{
 				{
 					Instances: []*autoscaling.Instance{
-						{InstanceId: aws.String("i-009eed7816")},
+						{
+							HealthStatus: aws.String("Healthy"),
+							InstanceId:   aws.String("i-009eed7816"),
+						},
 					},
 					DesiredCapacity: aws.Int64(3),
 				},
 			},
 		}, nil)
+	asg.
+		EXPECT().
+		DescribeScalingActivitiesWithContext(gomock.Any(), gomock.Any()).
+		Return(&autoscaling.DescribeScalingActivitiesOutput{}, nil)
+
+	droneClient := mocks.NewMockClient(ctrl)
+	droneClient.EXPECT().Queue().Return([]*drone.Stage{}, nil)
 
 	c := cluster.New("test-asg", nil, asg)
 	e := &Engine{
 		drone: &droneConfig{
-			agent: &droneAgentConfig{cluster: c},
+			client: droneClient,
+			build:  &droneBuildConfig{},
+			agent:  &droneAgentConfig{cluster: c, maxBuilds: 2},
 		},
 	}
 
@@ -50,6 +66,76 @@ func TestPlan_ScalingInProgress(t *testing.T) {
 	}
 }
 
+// Verifies that agents being launched are counted as capacity on its way,
+// and only the shortfall beyond them is added during a scaling activity
+func TestPlan_IncomingAgents(t *testing.T) {
+	cases := []struct {
+		pending int
+		action  string
+		target  int
+	}{
+		// 1 running & 2 incoming agents have 6 build slots
+		{pending: 6, action: actionNone, target: 3},
+		{pending: 9, action: actionUpscale, target: 5},
+	}
+
+	for _, test := range cases {
+		ctrl := gomock.NewController(t)
+
+		asg := mocks.NewMockAutoScalingAPI(ctrl)
+		asg.
+			EXPECT().
+			DescribeAutoScalingGroupsWithContext(gomock.Any(), gomock.Any()).
+			Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+				AutoScalingGroups: []*autoscaling.Group{
+					{
+						Instances: []*autoscaling.Instance{
+							{
+								HealthStatus: aws.String("Healthy"),
+								InstanceId:   aws.String("i-009eed7816"),
+							},
+						},
+						DesiredCapacity: aws.Int64(3),
+					},
+				},
+			}, nil)
+		asg.
+			EXPECT().
+			DescribeScalingActivitiesWithContext(gomock.Any(), gomock.Any()).
+			Return(&autoscaling.DescribeScalingActivitiesOutput{}, nil)
+
+		stages := make([]*drone.Stage, test.pending)
+		for i := range stages {
+			stages[i] = &drone.Stage{Status: drone.StatusPending, Created: time.Now().Unix()}
+		}
+		droneClient := mocks.NewMockClient(ctrl)
+		droneClient.EXPECT().Queue().Return(stages, nil)
+
+		e := &Engine{
+			drone: &droneConfig{
+				client: droneClient,
+				build:  &droneBuildConfig{pendingMaxDuration: time.Hour},
+				agent:  &droneAgentConfig{cluster: cluster.New("test-asg", nil, asg), maxBuilds: 2},
+			},
+		}
+
+		p, err := e.Plan(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.action != test.action || p.targetCapacity != test.target {
+			t.Errorf(
+				"Want %s to capacity %d for %d pending builds, got %v",
+				test.action,
+				test.target,
+				test.pending,
+				p,
+			)
+		}
+		ctrl.Finish()
+	}
+}
+
 // Verifies that planner recommends noop when extra agents are
 // below minimum retirement age.
 func TestPlan_BelowMinRetirement(t *testing.T) {
@@ -59,7 +145,7 @@ func TestPlan_BelowMinRetirement(t *testing.T) {
 	asg := mocks.NewMockAutoScalingAPI(ctrl)
 	asg.
 		EXPECT().
-		DescribeAutoScalingGroups(gomock.Any()).
+		DescribeAutoScalingGroupsWithContext(gomock.Any(), gomock.Any()).
 		Return(&autoscaling.DescribeAutoScalingGroupsOutput{
 			AutoScalingGroups: []*autoscaling.Group{
 				{
@@ -76,13 +162,12 @@ func TestPlan_BelowMinRetirement(t *testing.T) {
 					DesiredCapacity: aws.Int64(2),
 				},
 			},
-		}, nil).
-		Times(2)
+		}, nil)
 
 	ec2Client := mocks.NewMockEC2API(ctrl)
 	ec2Client.
 		EXPECT().
-		DescribeInstances(gomock.Any()).
+		DescribeInstancesWithContext(gomock.Any(), gomock.Any()).
 		Return(&ec2.DescribeInstancesOutput{
 			Reservations: []*ec2.Reservation{
 				{
@@ -140,7 +225,7 @@ func TestPlan_MinAgentCount(t *testing.T) {
 	asg := mocks.NewMockAutoScalingAPI(ctrl)
 	asg.
 		EXPECT().
-		DescribeAutoScalingGroups(gomock.Any()).
+		DescribeAutoScalingGroupsWithContext(gomock.Any(), gomock.Any()).
 		Return(&autoscaling.DescribeAutoScalingGroupsOutput{
 			AutoScalingGroups: []*autoscaling.Group{
 				{
@@ -153,13 +238,12 @@ func TestPlan_MinAgentCount(t *testing.T) {
 					DesiredCapacity: aws.Int64(1),
 				},
 			},
-		}, nil).
-		Times(2)
+		}, nil)
 
 	ec2Client := mocks.NewMockEC2API(ctrl)
 	ec2Client.
 		EXPECT().
-		DescribeInstances(gomock.Any()).
+		DescribeInstancesWithContext(gomock.Any(), gomock.Any()).
 		Return(&ec2.DescribeInstancesOutput{
 			Reservations: []*ec2.Reservation{
 				{
@@ -215,7 +299,7 @@ func TestPlan_NoExtra(t *testing.T) {
 	asg := mocks.NewMockAutoScalingAPI(ctrl)
 	asg.
 		EXPECT().
-		DescribeAutoScalingGroups(gomock.Any()).
+		DescribeAutoScalingGroupsWithContext(gomock.Any(), gomock.Any()).
 		Return(&autoscaling.DescribeAutoScalingGroupsOutput{
 			AutoScalingGroups: []*autoscaling.Group{
 				{
@@ -228,8 +312,7 @@ func TestPlan_NoExtra(t *testing.T) {
 					DesiredCapacity: aws.Int64(1),
 				},
 			},
-		}, nil).
-		Times(2)
+		}, nil)
 
 	droneClient := mocks.NewMockClient(ctrl)
 	droneClient.
@@ -270,7 +353,7 @@ func TestPlan_NoneIdle(t *testing.T) {
 	asg := mocks.NewMockAutoScalingAPI(ctrl)
 	asg.
 		EXPECT().
-		DescribeAutoScalingGroups(gomock.Any()).
+		DescribeAutoScalingGroupsWithContext(gomock.Any(), gomock.Any()).
 		Return(&autoscaling.DescribeAutoScalingGroupsOutput{
 			AutoScalingGroups: []*autoscaling.Group{
 				{
@@ -287,8 +370,7 @@ func TestPlan_NoneIdle(t *testing.T) {
 					DesiredCapacity: aws.Int64(2),
 				},
 			},
-		}, nil).
-		Times(2)
+		}, nil)
 
 	droneClient := mocks.NewMockClient(ctrl)
 	droneClient.
@@ -329,7 +411,7 @@ func TestPlan_BelowMinCount(t *testing.T) {
 	asg := mocks.NewMockAutoScalingAPI(ctrl)
 	asg.
 		EXPECT().
-		DescribeAutoScalingGroups(gomock.Any()).
+		DescribeAutoScalingGroupsWithContext(gomock.Any(), gomock.Any()).
 		Return(&autoscaling.DescribeAutoScalingGroupsOutput{
 			AutoScalingGroups: []*autoscaling.Group{
 				{
@@ -342,8 +424,7 @@ func TestPlan_BelowMinCount(t *testing.T) {
 					DesiredCapacity: aws.Int64(1),
 				},
 			},
-		}, nil).
-		Times(2)
+		}, nil)
 
 	c := cluster.New("test-asg", nil, asg)
 	e := &Engine{
@@ -362,6 +443,9 @@ func TestPlan_BelowMinCount(t *testing.T) {
 	if p.upscaleCount != 2 {
 		t.Errorf("Want plan upscale count 2, got %d", p.upscaleCount)
 	}
+	if p.currentCapacity != 1 || p.targetCapacity != 3 {
+		t.Errorf("Want plan to scale capacity from 1 to 3, got %v", p)
+	}
 }
 
 // Verifies that planner recommends upscaling when there are
@@ -373,7 +457,7 @@ func TestPlan_PendingBuilds(t *testing.T) {
 	asg := mocks.NewMockAutoScalingAPI(ctrl)
 	asg.
 		EXPECT().
-		DescribeAutoScalingGroups(gomock.Any()).
+		DescribeAutoScalingGroupsWithContext(gomock.Any(), gomock.Any()).
 		Return(&autoscaling.DescribeAutoScalingGroupsOutput{
 			AutoScalingGroups: []*autoscaling.Group{
 				{
@@ -386,8 +470,7 @@ func TestPlan_PendingBuilds(t *testing.T) {
 					DesiredCapacity: aws.Int64(1),
 				},
 			},
-		}, nil).
-		Times(2)
+		}, nil)
 
 	droneClient := mocks.NewMockClient(ctrl)
 	droneClient.
@@ -417,6 +500,10 @@ func TestPlan_PendingBuilds(t *testing.T) {
 			},
 			nil,
 		)
+	droneClient.
+		EXPECT().
+		Incomplete().
+		Return([]*drone.Repo{}, nil)
 
 	c := cluster.New("test-asg", nil, asg)
 	e := &Engine{
@@ -440,6 +527,9 @@ func TestPlan_PendingBuilds(t *testing.T) {
 	if p.upscaleCount != 1 {
 		t.Errorf("Want plan upscale count 1, got %d", p.upscaleCount)
 	}
+	if p.currentCapacity != 1 || p.targetCapacity != 2 {
+		t.Errorf("Want plan to scale capacity from 1 to 2, got %v", p)
+	}
 }
 
 // Verifies that planner recommends downscaling when there are
@@ -451,7 +541,7 @@ func TestPlan_ExtraDestroyable(t *testing.T) {
 	asg := mocks.NewMockAutoScalingAPI(ctrl)
 	asg.
 		EXPECT().
-		DescribeAutoScalingGroups(gomock.Any()).
+		DescribeAutoScalingGroupsWithContext(gomock.Any(), gomock.Any()).
 		Return(&autoscaling.DescribeAutoScalingGroupsOutput{
 			AutoScalingGroups: []*autoscaling.Group{
 				{
@@ -464,13 +554,12 @@ func TestPlan_ExtraDestroyable(t *testing.T) {
 					DesiredCapacity: aws.Int64(1),
 				},
 			},
-		}, nil).
-		Times(2)
+		}, nil)
 
 	ec2Client := mocks.NewMockEC2API(ctrl)
 	ec2Client.
 		EXPECT().
-		DescribeInstances(gomock.Any()).
+		DescribeInstancesWithContext(gomock.Any(), gomock.Any()).
 		Return(&ec2.DescribeInstancesOutput{
 			Reservations: []*ec2.Reservation{
 				{
@@ -563,3 +652,290 @@ func TestPlan_NodesToDestroy(t *testing.T) {
 		}
 	}
 }
+
+var fleetSizes = []int{100, 1000, 5000}
+
+// Plan is expected to take time proportional to the fleet size, ie- the
+// time per agent stays flat as the fleet grows
+func BenchmarkPlan(b *testing.B) {
+	log.SetLevel(log.WarnLevel)
+	defer log.SetLevel(log.InfoLevel)
+
+	for _, size := range fleetSizes {
+		b.Run(fmt.Sprintf("agents=%d", size), func(b *testing.B) {
+			ctrl := gomock.NewController(b)
+			defer ctrl.Finish()
+
+			launched := time.Now().Add(-time.Hour)
+			group := &autoscaling.Group{DesiredCapacity: aws.Int64(int64(size))}
+			stages := make([]*drone.Stage, 0, size)
+			for i := 0; i < size; i++ {
+				id := fmt.Sprintf("i-%06d", i)
+				group.Instances = append(group.Instances, &autoscaling.Instance{
+					HealthStatus: aws.String("Healthy"),
+					InstanceId:   aws.String(id),
+				})
+				// every other agent is busy
+				if i%2 == 0 {
+					stages = append(stages, &drone.Stage{Status: drone.StatusRunning, Machine: id})
+				}
+			}
+
+			asg := mocks.NewMockAutoScalingAPI(ctrl)
+			asg.
+				EXPECT().
+				DescribeAutoScalingGroupsWithContext(gomock.Any(), gomock.Any()).
+				Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+					AutoScalingGroups: []*autoscaling.Group{group},
+				}, nil).
+				AnyTimes()
+
+			ec2Client := mocks.NewMockEC2API(ctrl)
+			ec2Client.
+				EXPECT().
+				DescribeInstancesWithContext(gomock.Any(), gomock.Any()).
+				DoAndReturn(func(_ aws.Context, in *ec2.DescribeInstancesInput, _ ...request.Option) (
+					*ec2.DescribeInstancesOutput,
+					error,
+				) {
+					reservation := &ec2.Reservation{}
+					for _, id := range in.InstanceIds {
+						reservation.Instances = append(reservation.Instances, &ec2.Instance{
+							InstanceId: id,
+							LaunchTime: aws.Time(launched),
+						})
+					}
+					return &ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{reservation}}, nil
+				}).
+				AnyTimes()
+
+			droneClient := mocks.NewMockClient(ctrl)
+			droneClient.EXPECT().Queue().Return(stages, nil).AnyTimes()
+
+			e := &Engine{
+				drone: &droneConfig{
+					client: droneClient,
+					build: &droneBuildConfig{
+						pendingMaxDuration: -1,
+						runningMaxDuration: -1,
+					},
+					agent: &droneAgentConfig{
+						cluster:          cluster.New("test-asg", ec2Client, asg),
+						maxBuilds:        1,
+						minCount:         1,
+						minRetirementAge: time.Minute,
+					},
+				},
+			}
+
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				plan, err := e.Plan(context.TODO())
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(plan.NodesToDestroy()) != size/2 {
+					b.Fatalf("Want %d agents to destroy, got %d", size/2, len(plan.NodesToDestroy()))
+				}
+			}
+			b.ReportMetric(float64(time.Since(start).Nanoseconds())/float64(b.N*size), "ns/agent")
+		})
+	}
+}
+
+func BenchmarkEngine_ListIdleAgents(b *testing.B) {
+	e := Engine{}
+	for _, size := range fleetSizes {
+		b.Run(fmt.Sprintf("agents=%d", size), func(b *testing.B) {
+			all := make([]cluster.NodeId, size)
+			busy := make([]cluster.NodeId, 0, size/2)
+			for i := range all {
+				all[i] = cluster.NodeId(fmt.Sprintf("i-%06d", i))
+				if i%2 == 0 {
+					busy = append(busy, all[i])
+				}
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				e.listIdleAgents(all, busy)
+			}
+		})
+	}
+}
+
+// Verifies that the agents a plan acts upon besides scaling are serialized,
+// so that they show up in one-shot & dry-run plans
+func TestPlan_MarshalJSON(t *testing.T) {
+	p := &Plan{
+		action:         actionNone,
+		nodesToDestroy: []cluster.NodeId{},
+		expiredAgents:  []cluster.NodeId{"i-100"},
+		zombieAgents:   []cluster.NodeId{"i-200"},
+		toQuarantine:   []cluster.NodeId{"i-300"},
+	}
+	raw, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(raw, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"expiredAgents": []interface{}{"i-100"},
+		"zombieAgents":  []interface{}{"i-200"},
+		"toQuarantine":  []interface{}{"i-300"},
+	}
+	for k, v := range want {
+		if fmt.Sprint(got[k]) != fmt.Sprint(v) {
+			t.Errorf("Want %s to be %v, got %v", k, v, got[k])
+		}
+	}
+}
+
+// Verifies that the replacements of zombie agents count as incoming build
+// slots, so that no agents are added for the slots of the zombies
+func TestPlan_ZombieAgents(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	asg := mocks.NewMockAutoScalingAPI(ctrl)
+	asg.
+		EXPECT().
+		DescribeAutoScalingGroupsWithContext(gomock.Any(), gomock.Any()).
+		Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+			AutoScalingGroups: []*autoscaling.Group{
+				{
+					Instances: []*autoscaling.Instance{
+						{HealthStatus: aws.String("Healthy"), InstanceId: aws.String("i-001")},
+						{HealthStatus: aws.String("Healthy"), InstanceId: aws.String("i-002")},
+					},
+					DesiredCapacity: aws.Int64(2),
+				},
+			},
+		}, nil)
+
+	ec2Client := mocks.NewMockEC2API(ctrl)
+	ec2Client.
+		EXPECT().
+		DescribeInstancesWithContext(gomock.Any(), gomock.Any()).
+		Return(&ec2.DescribeInstancesOutput{
+			Reservations: []*ec2.Reservation{
+				{
+					Instances: []*ec2.Instance{
+						{
+							InstanceId: aws.String("i-002"),
+							LaunchTime: aws.Time(time.Now().UTC().Add(-time.Hour)),
+						},
+					},
+				},
+			},
+		}, nil)
+
+	droneClient := mocks.NewMockClient(ctrl)
+	droneClient.
+		EXPECT().
+		Queue().
+		Return([]*drone.Stage{
+			{Status: drone.StatusRunning, Machine: "i-001"},
+			{Status: drone.StatusRunning, Machine: "i-001"},
+			{Status: drone.StatusPending},
+			{Status: drone.StatusPending},
+		}, nil)
+
+	e := &Engine{
+		drone: &droneConfig{
+			client: droneClient,
+			build: &droneBuildConfig{
+				pendingMaxDuration: -1 * time.Second,
+				runningMaxDuration: -1 * time.Second,
+			},
+			agent: &droneAgentConfig{
+				cluster:          cluster.New("test-asg", ec2Client, asg),
+				maxBuilds:        2,
+				minRetirementAge: 10 * time.Minute,
+				zombieCycles:     2,
+			},
+		},
+		idleStrikes: map[cluster.NodeId]int{"i-002": 1},
+	}
+
+	p, err := e.Plan(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.ZombieAgents(); len(got) != 1 || got[0] != "i-002" {
+		t.Errorf("Want i-002 to be a zombie agent, got %v", got)
+	}
+	if p.UpscaleCount() != 0 {
+		t.Errorf("Want no agents added for the zombie's replacement, got %v", p)
+	}
+}
+
+// Verifies that the replacements of agents about to be quarantined count as
+// incoming build slots, so that no agents are added for their slots
+func TestPlan_QuarantineAgents(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	asg := mocks.NewMockAutoScalingAPI(ctrl)
+	asg.
+		EXPECT().
+		DescribeAutoScalingGroupsWithContext(gomock.Any(), gomock.Any()).
+		Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+			AutoScalingGroups: []*autoscaling.Group{
+				{
+					Instances: []*autoscaling.Instance{
+						{HealthStatus: aws.String("Healthy"), InstanceId: aws.String("i-001")},
+						{HealthStatus: aws.String("Healthy"), InstanceId: aws.String("i-002")},
+					},
+					DesiredCapacity: aws.Int64(2),
+				},
+			},
+		}, nil)
+
+	droneClient := mocks.NewMockClient(ctrl)
+	droneClient.
+		EXPECT().
+		Queue().
+		Return([]*drone.Stage{
+			{Status: drone.StatusRunning, Machine: "i-001"},
+			{Status: drone.StatusRunning, Machine: "i-001"},
+			{Status: drone.StatusPending},
+			{Status: drone.StatusPending},
+		}, nil)
+	droneClient.
+		EXPECT().
+		Incomplete().
+		Return([]*drone.Repo{}, nil)
+
+	e := &Engine{
+		drone: &droneConfig{
+			client: droneClient,
+			build: &droneBuildConfig{
+				pendingMaxDuration: -1 * time.Second,
+				runningMaxDuration: -1 * time.Second,
+			},
+			agent: &droneAgentConfig{
+				cluster:             cluster.New("test-asg", nil, asg),
+				maxBuilds:           2,
+				quarantineErrorRate: 0.5,
+				quarantineWindow:    2,
+			},
+		},
+		stageOutcomes: map[cluster.NodeId][]bool{"i-002": {true, true}},
+	}
+
+	p, err := e.Plan(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.AgentsToQuarantine(); len(got) != 1 || got[0] != "i-002" {
+		t.Errorf("Want i-002 to be quarantined, got %v", got)
+	}
+	if p.UpscaleCount() != 0 {
+		t.Errorf("Want no agents added for the quarantined agent's replacement, got %v", p)
+	}
+}
@@ -0,0 +1,224 @@
+package engine
+
+import (
+	"context"
+	"github.com/Shuttl-Tech/drone-autoscaler/cluster"
+	"github.com/Shuttl-Tech/drone-autoscaler/config"
+	"github.com/drone/drone-go/drone"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"time"
+)
+
+// Snapshot is the state of the agent cluster & build queue that a scaling
+// policy plans upon
+type Snapshot struct {
+	Capacity cluster.Capacity
+
+	// true if the agent cluster has a scaling activity in progress that
+	// hasn't timed out
+	Activity bool
+
+	// true if a scaling activity timed out, in which case the agents it
+	// was launching aren't expected to come up
+	TimedOut bool
+
+	// IDs of the running agents, along with their build slots
+	Agents []cluster.NodeId
+	Slots  map[cluster.NodeId]int
+
+	// build slots of the running agents and the ones being launched, and
+	// the ones not occupied by running builds
+	TotalSlots int
+	FreeSlots  float64
+
+	// free build slots to keep available at all times
+	Headroom float64
+
+	// stages considered for scaling, the build slots needed by the pending
+	// & running ones, and how long the oldest pending one has waited
+	Stages        []*drone.Stage
+	Pending       float64
+	Running       float64
+	OldestPending time.Duration
+}
+
+// Policy decides the scaling action to take for a snapshot of the agent
+// cluster & build queue
+type Policy interface {
+	Plan(ctx context.Context, s *Snapshot) (*Plan, error)
+}
+
+// returns the scaling policy described by the given configuration, falling
+// back to the reactive policy for unknown names
+func newPolicy(c config.Config, e *Engine) Policy {
+	switch c.Policy.Name {
+	case config.PolicyTargetUtilization:
+		return targetUtilizationPolicy{e: e, target: c.Policy.TargetUtilization}
+	case config.PolicyQueueWait:
+		return queueWaitPolicy{e: e, slo: c.Policy.QueueWaitSLO}
+	default:
+		return reactivePolicy{e}
+	}
+}
+
+// returns a plan to take no action on the given snapshot
+func newPlan(s *Snapshot) *Plan {
+	return &Plan{
+		action:          actionNone,
+		nodesToDestroy:  []cluster.NodeId{},
+		currentCapacity: s.Capacity.Desired,
+		targetCapacity:  s.Capacity.Desired,
+	}
+}
+
+// returns a plan to add the given number of agents on the given snapshot
+func newUpscalePlan(s *Snapshot, count int) *Plan {
+	log.
+		WithField("count", count).
+		Infoln("Recommending adding more agents")
+
+	p := newPlan(s)
+	p.action = actionUpscale
+	p.upscaleCount = count
+	p.targetCapacity = upscaleTarget(s.Capacity, s.TimedOut, count)
+	return p
+}
+
+// returns the desired capacity that adds the given number of agents to
+// the given capacity. After a scaling activity timed out, agents are added
+// to the actual capacity instead, since adding to a desired capacity stuck
+// above it would grow it further on every cycle. The desired capacity
+// isn't lowered though, that's up to resetting stuck capacity.
+func upscaleTarget(c cluster.Capacity, timedOut bool, count int) int {
+	if !timedOut {
+		return c.Desired + count
+	}
+	if target := c.Actual + count; target > c.Desired {
+		return target
+	}
+	return c.Desired
+}
+
+// reactivePolicy adds agents for pending builds that don't fit in the free
+// build slots, and retires idle agents once no builds are pending. The
+// headroom of free slots is kept either way.
+type reactivePolicy struct {
+	e *Engine
+}
+
+func (p reactivePolicy) Plan(ctx context.Context, s *Snapshot) (*Plan, error) {
+	if s.Pending > 0 || s.FreeSlots < s.Headroom {
+		return p.e.planUpscale(s, s.Pending)
+	}
+	return p.e.planIdle(ctx, s)
+}
+
+// targetUtilizationPolicy keeps the share of build slots occupied by
+// pending & running builds at the target, on top of the headroom. Agents are
+// added as soon as it's exceeded, and idle agents are retired as long as it
+// isn't.
+type targetUtilizationPolicy struct {
+	e      *Engine
+	target float64
+}
+
+func (p targetUtilizationPolicy) Plan(ctx context.Context, s *Snapshot) (*Plan, error) {
+	needed := (s.Pending+s.Running)/p.target + s.Headroom
+	log.
+		WithField("needed", needed).
+		WithField("total", s.TotalSlots).
+		Debugln("Determined build slots needed for target utilization")
+
+	if shortfall := needed - float64(s.TotalSlots); shortfall > 0 {
+		c, err := p.e.calcRequiredAgentCount(shortfall)
+		if err != nil {
+			return nil, err
+		}
+		return newUpscalePlan(s, c), nil
+	}
+	if s.Activity {
+		log.Debugln("Cluster has a scaling activity in progress, recommending noop")
+		return newPlan(s), nil
+	}
+	surplus := float64(s.TotalSlots) - needed
+	if surplus < 1 {
+		log.Debugln("Agent cluster is at target utilization, recommending noop")
+		return newPlan(s), nil
+	}
+	return p.e.planDownscale(ctx, s, surplus)
+}
+
+// queueWaitPolicy lets pending builds wait for busy agents to free up, and
+// adds agents for the ones that don't fit in the free build slots only once
+// the oldest pending stage has waited for longer than the SLO. The headroom
+// of free slots is kept meanwhile. Idle agents are retired once no builds
+// are pending.
+type queueWaitPolicy struct {
+	e   *Engine
+	slo time.Duration
+}
+
+func (p queueWaitPolicy) Plan(ctx context.Context, s *Snapshot) (*Plan, error) {
+	if s.Pending > 0 && s.OldestPending < p.slo {
+		log.
+			WithField("wait", s.OldestPending).
+			WithField("slo", p.slo).
+			Debugln("Pending builds are within queue wait SLO, letting them wait")
+		return p.e.planUpscale(s, 0)
+	}
+	if s.Pending > 0 || s.FreeSlots < s.Headroom {
+		return p.e.planUpscale(s, s.Pending)
+	}
+	return p.e.planIdle(ctx, s)
+}
+
+// plans to add agents for the given pending builds that don't fit in the
+// free build slots, along with the ones needed to keep the headroom
+func (e *Engine) planUpscale(s *Snapshot, pending float64) (*Plan, error) {
+	if pending > 0 {
+		log.
+			WithField("count", pending).
+			Debugln("Detected pending builds")
+	}
+
+	c, err := e.calcUpscaleCount(pending, s.FreeSlots, s.Headroom)
+	if err != nil {
+		return nil, err
+	}
+	if c == 0 {
+		log.Debugln("Pending builds & headroom fit in free build slots, recommending noop")
+		return newPlan(s), nil
+	}
+	return newUpscalePlan(s, c), nil
+}
+
+// plans to retire idle agents while no builds are pending, once the agent
+// cluster has reconciled. Agents whose slots make up the headroom are kept.
+func (e *Engine) planIdle(ctx context.Context, s *Snapshot) (*Plan, error) {
+	// let the cluster autoscale group reconcile before shedding any
+	// capacity, since the agents being launched can't be retired yet
+	if s.Activity {
+		log.Debugln("Cluster has a scaling activity in progress, recommending noop")
+		return newPlan(s), nil
+	}
+
+	log.Debugln("Checking for any under-utilized capacity")
+
+	if s.FreeSlots <= s.Headroom {
+		log.Debugln("No scaling action required, recommending noop")
+		return newPlan(s), nil
+	}
+
+	log.
+		WithField("free", s.FreeSlots).
+		WithField("headroom", s.Headroom).
+		WithField("builds", s.Running).
+		Debugln("Agent cluster has free build slots")
+
+	surplus := math.Inf(1)
+	if s.Headroom > 0 {
+		surplus = s.FreeSlots - s.Headroom
+	}
+	return e.planDownscale(ctx, s, surplus)
+}
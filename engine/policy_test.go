@@ -0,0 +1,181 @@
+package engine
+
+import (
+	"context"
+	"github.com/Shuttl-Tech/drone-autoscaler/cluster"
+	"github.com/Shuttl-Tech/drone-autoscaler/config"
+	"github.com/drone/drone-go/drone"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPolicy_New(t *testing.T) {
+	e := &Engine{}
+	c := config.Config{}
+	if _, ok := newPolicy(c, e).(reactivePolicy); !ok {
+		t.Error("Want reactive policy by default")
+	}
+
+	c.Policy.Name = config.PolicyTargetUtilization
+	c.Policy.TargetUtilization = 0.5
+	if p, ok := newPolicy(c, e).(targetUtilizationPolicy); !ok || p.target != 0.5 {
+		t.Errorf("Want target utilization policy with target 0.5, got %#v", p)
+	}
+
+	c.Policy.Name = config.PolicyQueueWait
+	c.Policy.QueueWaitSLO = time.Minute
+	if p, ok := newPolicy(c, e).(queueWaitPolicy); !ok || p.slo != time.Minute {
+		t.Errorf("Want queue wait policy with SLO 1m, got %#v", p)
+	}
+}
+
+func TestPolicy_TargetUtilization(t *testing.T) {
+	e := &Engine{
+		drone: &droneConfig{
+			agent: &droneAgentConfig{maxBuilds: 4},
+		},
+	}
+	p := targetUtilizationPolicy{e: e, target: 0.5}
+	agents := []cluster.NodeId{"i-100", "i-200"}
+	stages := []*drone.Stage{
+		{Machine: "i-100", Status: drone.StatusRunning},
+		{Machine: "i-200", Status: drone.StatusRunning},
+	}
+	s := &Snapshot{
+		Capacity:   cluster.Capacity{Desired: 2},
+		Agents:     agents,
+		Slots:      map[cluster.NodeId]int{"i-100": 4, "i-200": 4},
+		TotalSlots: 8,
+		Stages:     stages,
+		Running:    2,
+		Pending:    3,
+	}
+
+	// 5 builds need 10 slots to be at 50% utilization
+	plan, err := p.Plan(context.TODO(), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !plan.RequiresUpscaling() || plan.TargetCapacity() != 3 {
+		t.Errorf("Want upscale to 3 agents, got %v", plan)
+	}
+
+	// 2 builds need 4 slots, but no agent is idle
+	s.Pending = 0
+	plan, err = p.Plan(context.TODO(), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.RequiresUpscaling() || plan.RequiresDownscaling() {
+		t.Errorf("Want noop without idle agents, got %v", plan)
+	}
+}
+
+func TestPolicy_QueueWait(t *testing.T) {
+	e := &Engine{
+		drone: &droneConfig{
+			agent: &droneAgentConfig{maxBuilds: 2},
+		},
+	}
+	p := queueWaitPolicy{e: e, slo: time.Minute}
+	s := &Snapshot{
+		Capacity:      cluster.Capacity{Desired: 1},
+		TotalSlots:    2,
+		Pending:       3,
+		Running:       2,
+		OldestPending: 30 * time.Second,
+	}
+
+	plan, err := p.Plan(context.TODO(), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.RequiresUpscaling() {
+		t.Errorf("Want noop while pending builds are within SLO, got %v", plan)
+	}
+
+	s.OldestPending = 2 * time.Minute
+	plan, err = p.Plan(context.TODO(), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !plan.RequiresUpscaling() || plan.UpscaleCount() != 2 {
+		t.Errorf("Want upscale by 2 agents once SLO is exceeded, got %v", plan)
+	}
+}
+
+func TestPolicy_LimitVictims(t *testing.T) {
+	victims := []cluster.NodeId{"i-100", "i-200", "i-300"}
+	slots := map[cluster.NodeId]int{"i-100": 2, "i-200": 4, "i-300": 2}
+
+	if got, want := limitVictims(victims, slots, 7), victims[:2]; !reflect.DeepEqual(got, want) {
+		t.Errorf("Want victims %v, got %v", want, got)
+	}
+	if got := limitVictims(victims, slots, 1); len(got) != 0 {
+		t.Errorf("Want no victims, got %v", got)
+	}
+	if got := limitVictims(victims, slots, 8); !reflect.DeepEqual(got, victims) {
+		t.Errorf("Want all victims, got %v", got)
+	}
+}
+
+func TestPolicy_OldestPending(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	stages := []*drone.Stage{
+		{Status: drone.StatusRunning, Created: now.Add(-time.Hour).Unix()},
+		{Status: drone.StatusPending, Created: now.Add(-time.Minute).Unix()},
+		{Status: drone.StatusPending, Created: now.Add(-3 * time.Minute).Unix()},
+	}
+	if got, want := oldestPending(stages, now), 3*time.Minute; got != want {
+		t.Errorf("Want oldest pending %v, got %v", want, got)
+	}
+	if got := oldestPending(nil, now); got != 0 {
+		t.Errorf("Want no wait without pending stages, got %v", got)
+	}
+}
+
+func TestPolicy_Headroom(t *testing.T) {
+	e := &Engine{
+		drone: &droneConfig{
+			agent: &droneAgentConfig{maxBuilds: 4, headroomSlots: 2, headroomPercent: 50},
+		},
+	}
+	if got, want := e.headroom(2), 2.0; got != want {
+		t.Errorf("Want absolute headroom %v, got %v", want, got)
+	}
+	if got, want := e.headroom(7), 4.0; got != want {
+		t.Errorf("Want percentage headroom %v, got %v", want, got)
+	}
+
+	p := reactivePolicy{e}
+	s := &Snapshot{
+		Capacity:   cluster.Capacity{Desired: 1},
+		Agents:     []cluster.NodeId{"i-100"},
+		Slots:      map[cluster.NodeId]int{"i-100": 4},
+		TotalSlots: 4,
+		FreeSlots:  1,
+		Running:    3,
+		Headroom:   2,
+	}
+
+	// the free slots fall short of the headroom without any pending build
+	plan, err := p.Plan(context.TODO(), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !plan.RequiresUpscaling() || plan.UpscaleCount() != 1 {
+		t.Errorf("Want upscale by 1 agent to restore headroom, got %v", plan)
+	}
+
+	// idle agents within the headroom aren't retired
+	s.Running, s.FreeSlots = 0, 4
+	s.Headroom = 4
+	plan, err = p.Plan(context.TODO(), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.RequiresDownscaling() {
+		t.Errorf("Want idle agents within headroom to be kept, got %v", plan)
+	}
+}
@@ -0,0 +1,242 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"github.com/Shuttl-Tech/drone-autoscaler/cluster"
+	"github.com/Shuttl-Tech/drone-autoscaler/metrics"
+	"github.com/Shuttl-Tech/drone-autoscaler/notify"
+	"github.com/drone/drone-go/drone"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"time"
+)
+
+// a stage seen running on an agent, whose outcome is looked up from its
+// build once it leaves the queue
+type stageInFlight struct {
+	id      int64
+	machine cluster.NodeId
+	build   BuildRef
+}
+
+// records the outcome of the stages that finished since the previous cycle
+// against the agents that ran them, and tracks the running ones. Stages
+// whose repository isn't known can't be looked up, so they're ignored.
+// Agents that are no longer running are forgotten.
+func (e *Engine) trackStageOutcomes(stages []*drone.Stage, repos map[int64]*drone.Repo, running []cluster.NodeId) {
+	if e.drone.agent.quarantineErrorRate <= 0 {
+		e.stagesInFlight, e.stageOutcomes = nil, nil
+		return
+	}
+	if e.stagesInFlight == nil {
+		e.stagesInFlight = make(map[int64]stageInFlight)
+	}
+	if e.stageOutcomes == nil {
+		e.stageOutcomes = make(map[cluster.NodeId][]bool)
+	}
+
+	queued := make(map[int64]struct{}, len(stages))
+	for _, stage := range stages {
+		queued[stage.ID] = struct{}{}
+	}
+	finished := make(map[BuildRef][]stageInFlight)
+	for id, s := range e.stagesInFlight {
+		if _, ok := queued[id]; !ok {
+			finished[s.build] = append(finished[s.build], s)
+			delete(e.stagesInFlight, id)
+		}
+	}
+	for ref, inFlight := range finished {
+		build, err := e.drone.client.Build(ref.Namespace, ref.Name, int(ref.Number))
+		if err != nil {
+			log.
+				WithError(err).
+				WithField("build", ref).
+				Warnln("Couldn't look up outcome of finished stages")
+			continue
+		}
+		for _, s := range inFlight {
+			for _, stage := range build.Stages {
+				if stage.ID == s.id {
+					e.recordStageOutcome(s.machine, stage.Error != "")
+				}
+			}
+		}
+	}
+
+	for _, stage := range stages {
+		if stage.Status != drone.StatusRunning || stage.Machine == "" {
+			continue
+		}
+		repo, ok := repos[stage.BuildID]
+		if !ok {
+			continue
+		}
+		e.stagesInFlight[stage.ID] = stageInFlight{
+			id:      stage.ID,
+			machine: cluster.NodeId(stage.Machine),
+			build:   BuildRef{Namespace: repo.Namespace, Name: repo.Name, Number: repo.Build.Number},
+		}
+	}
+
+	alive := toSet(running)
+	for id := range e.stageOutcomes {
+		if _, ok := alive[id]; !ok {
+			delete(e.stageOutcomes, id)
+		}
+	}
+}
+
+// records whether a stage run by the given agent errored, keeping only the
+// outcomes within the quarantine window
+func (e *Engine) recordStageOutcome(agent cluster.NodeId, errored bool) {
+	outcomes := append(e.stageOutcomes[agent], errored)
+	if n := len(outcomes) - e.drone.agent.quarantineWindow; n > 0 {
+		outcomes = outcomes[n:]
+	}
+	e.stageOutcomes[agent] = outcomes
+}
+
+// returns the number of stages that errored out of the recent stages run
+// by the given agent
+func (e *Engine) stageErrors(agent cluster.NodeId) (errored, total int) {
+	for _, failed := range e.stageOutcomes[agent] {
+		if failed {
+			errored++
+		}
+	}
+	return errored, len(e.stageOutcomes[agent])
+}
+
+// returns the idle agents whose recent stages errored at or above the
+// quarantine error rate, once they've run as many stages as the quarantine
+// window. Busy agents are quarantined once they're idle, so that their
+// builds aren't interrupted.
+func (e *Engine) listAgentsToQuarantine(running, busy []cluster.NodeId) []cluster.NodeId {
+	if e.drone.agent.quarantineErrorRate <= 0 {
+		return nil
+	}
+	busySet := toSet(busy)
+	var res []cluster.NodeId
+	for _, id := range running {
+		errored, total := e.stageErrors(id)
+		if total < e.drone.agent.quarantineWindow || float64(errored)/float64(total) < e.drone.agent.quarantineErrorRate {
+			continue
+		}
+		if _, ok := busySet[id]; ok {
+			log.
+				WithField("id", id).
+				Debugln("Waiting for agent to finish its builds before quarantining it")
+			continue
+		}
+		res = append(res, id)
+	}
+	if len(res) > 0 {
+		log.
+			WithField("ids", res).
+			WithField("rate", e.drone.agent.quarantineErrorRate).
+			Warnln("Found agents whose stages are erroring above the quarantine error rate")
+	}
+	return res
+}
+
+// quarantineAgents quarantines the given agents whose stages are erroring.
+// Failure to quarantine an agent is logged, and it's retried on a later
+// cycle.
+func (e *Engine) quarantineAgents(ctx context.Context, ids []cluster.NodeId) {
+	for _, id := range ids {
+		errored, total := e.stageErrors(id)
+		reason := fmt.Sprintf("%d of its last %d stages errored", errored, total)
+		if err := e.Quarantine(ctx, id, reason); err != nil {
+			log.
+				WithError(err).
+				WithField("id", id).
+				Errorln("Failed to quarantine agent")
+		}
+	}
+}
+
+// Quarantine takes the given agent out of service for inspection, for the
+// given reason. It's detached from the agent autoscaling group, which
+// replaces it, and stopped, so that its runner no longer accepts builds.
+// The agent is quarantined only if it isn't running any builds. The build
+// queue is paused meanwhile so that no builds get scheduled on the agent.
+func (e *Engine) Quarantine(ctx context.Context, agent cluster.NodeId, reason string) error {
+	all, err := e.drone.agent.cluster.List(ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't fetch list of agents: %v", err)
+	}
+	if !contains(all, agent) {
+		return fmt.Errorf("agent %s is not a running member of the agent cluster", agent)
+	}
+
+	log.Infoln("Pausing build queue to quarantine agent")
+	if err := e.drone.client.QueuePause(); err != nil {
+		return fmt.Errorf("couldn't pause drone queue while quarantining agent: %v", err)
+	}
+	defer e.resumeBuildQueue(ctx)
+
+	// the queue is checked only after pausing it, so that a build can't be
+	// scheduled on the agent right before it's stopped
+	stages, err := e.drone.client.Queue()
+	if err != nil {
+		return fmt.Errorf("couldn't fetch build queue: %v", err)
+	}
+	if n := runningBuildsByAgent(stages)[agent]; n > 0 {
+		return fmt.Errorf("agent %s is running %d builds", agent, n)
+	}
+	if err := e.drone.agent.cluster.Quarantine(ctx, []cluster.NodeId{agent}, time.Now().UTC()); err != nil {
+		return err
+	}
+
+	log.
+		WithField("id", agent).
+		WithField("reason", reason).
+		Warnln("Quarantined agent for inspection")
+	delete(e.stageOutcomes, agent)
+	e.emit(ctx, notify.EventAgentQuarantined, map[string]interface{}{
+		"id":     agent,
+		"reason": reason,
+	})
+	return nil
+}
+
+// terminateQuarantinedAgents terminates the quarantined agents that were
+// kept for longer than the quarantine retention. Agents whose quarantine
+// time is unknown are left for operators to terminate.
+func (e *Engine) terminateQuarantinedAgents(ctx context.Context) {
+	retention := e.drone.agent.quarantineRetention
+	if retention <= 0 {
+		return
+	}
+	agents, err := e.drone.agent.cluster.Quarantined(ctx)
+	if err != nil {
+		log.WithError(err).Warnln("Failed to list quarantined agents")
+		return
+	}
+	metrics.QuarantinedAgents.Set(int64(len(agents)))
+
+	now := time.Now().UTC()
+	var expired []cluster.NodeId
+	for id, at := range agents {
+		if !at.IsZero() && now.Sub(at) > retention {
+			expired = append(expired, id)
+		}
+	}
+	if len(expired) == 0 {
+		return
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i] < expired[j] })
+	if err := e.drone.agent.cluster.TerminateQuarantined(ctx, expired); err != nil {
+		log.
+			WithError(err).
+			WithField("ids", expired).
+			Errorln("Failed to terminate quarantined agents")
+		return
+	}
+	log.
+		WithField("ids", expired).
+		WithField("retention", retention).
+		Infoln("Terminated quarantined agents past their retention")
+}
@@ -0,0 +1,126 @@
+package engine
+
+import (
+	"context"
+	"github.com/Shuttl-Tech/drone-autoscaler/cluster"
+	"github.com/Shuttl-Tech/drone-autoscaler/mocks"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/drone/drone-go/drone"
+	"github.com/golang/mock/gomock"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Verifies that the outcome of stages is recorded against their agents once
+// they leave the queue, and that agents are quarantined once idle
+func TestQuarantine_TrackStageOutcomes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	droneClient := mocks.NewMockClient(ctrl)
+	droneClient.
+		EXPECT().
+		Build("octocat", "hello", 42).
+		Return(&drone.Build{
+			Stages: []*drone.Stage{
+				{ID: 1, Status: drone.StatusError, Error: "Cannot connect to the Docker daemon"},
+				{ID: 2, Status: drone.StatusPassing},
+			},
+		}, nil)
+
+	e := &Engine{
+		drone: &droneConfig{
+			client: droneClient,
+			agent: &droneAgentConfig{
+				quarantineErrorRate: 0.5,
+				quarantineWindow:    2,
+			},
+		},
+	}
+	repos := map[int64]*drone.Repo{
+		10: {Namespace: "octocat", Name: "hello", Build: drone.Build{ID: 10, Number: 42}},
+	}
+	running := []cluster.NodeId{"i-100", "i-200"}
+	stages := []*drone.Stage{
+		{ID: 1, BuildID: 10, Status: drone.StatusRunning, Machine: "i-100"},
+		{ID: 2, BuildID: 10, Status: drone.StatusRunning, Machine: "i-200"},
+	}
+	e.trackStageOutcomes(stages, repos, running)
+	e.trackStageOutcomes(nil, repos, running)
+
+	want := map[cluster.NodeId][]bool{"i-100": {true}, "i-200": {false}}
+	if !reflect.DeepEqual(e.stageOutcomes, want) {
+		t.Errorf("Want stage outcomes %v, got %v", want, e.stageOutcomes)
+	}
+	if got := e.listAgentsToQuarantine(running, nil); len(got) != 0 {
+		t.Errorf("Want no agents quarantined before the window is full, got %v", got)
+	}
+
+	e.recordStageOutcome("i-100", false)
+	e.recordStageOutcome("i-100", true)
+	e.recordStageOutcome("i-200", false)
+	if got := e.stageOutcomes["i-100"]; !reflect.DeepEqual(got, []bool{false, true}) {
+		t.Errorf("Want outcomes to be limited to the window, got %v", got)
+	}
+	if got := e.listAgentsToQuarantine(running, []cluster.NodeId{"i-100"}); len(got) != 0 {
+		t.Errorf("Want busy agent to not be quarantined yet, got %v", got)
+	}
+	if got := e.listAgentsToQuarantine(running, nil); !reflect.DeepEqual(got, []cluster.NodeId{"i-100"}) {
+		t.Errorf("Want i-100 to be quarantined, got %v", got)
+	}
+
+	// agents that are gone are forgotten
+	e.trackStageOutcomes(nil, repos, []cluster.NodeId{"i-200"})
+	if _, ok := e.stageOutcomes["i-100"]; ok {
+		t.Errorf("Want outcomes of i-100 to be forgotten, got %v", e.stageOutcomes)
+	}
+}
+
+// Verifies that only quarantined agents past their retention are terminated
+func TestQuarantine_TerminateQuarantinedAgents(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	now := time.Now().UTC()
+	tagged := func(id string, at time.Time) *ec2.Instance {
+		return &ec2.Instance{
+			InstanceId: aws.String(id),
+			Tags: []*ec2.Tag{
+				{Key: aws.String(cluster.TagQuarantinedAt), Value: aws.String(at.Format(time.RFC3339))},
+			},
+		}
+	}
+	ec2Client := mocks.NewMockEC2API(ctrl)
+	ec2Client.
+		EXPECT().
+		DescribeInstancesWithContext(gomock.Any(), gomock.Any()).
+		Return(&ec2.DescribeInstancesOutput{
+			Reservations: []*ec2.Reservation{
+				{
+					Instances: []*ec2.Instance{
+						tagged("i-100", now.Add(-48*time.Hour)),
+						tagged("i-200", now.Add(-time.Hour)),
+						{InstanceId: aws.String("i-300")},
+					},
+				},
+			},
+		}, nil)
+	ec2Client.
+		EXPECT().
+		TerminateInstancesWithContext(gomock.Any(), &ec2.TerminateInstancesInput{
+			InstanceIds: aws.StringSlice([]string{"i-100"}),
+		}).
+		Return(&ec2.TerminateInstancesOutput{}, nil)
+
+	e := &Engine{
+		drone: &droneConfig{
+			agent: &droneAgentConfig{
+				cluster:             cluster.New("test-asg", ec2Client, nil),
+				quarantineRetention: 24 * time.Hour,
+			},
+		},
+	}
+	e.terminateQuarantinedAgents(context.TODO())
+}
@@ -0,0 +1,150 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"github.com/Shuttl-Tech/drone-autoscaler/cluster"
+	"github.com/Shuttl-Tech/drone-autoscaler/metrics"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// returns the given agents that were launched longer than the max agent age
+// ago, or none if agents don't expire
+func (e *Engine) listExpiredAgents(ctx context.Context, ids []cluster.NodeId) ([]cluster.NodeId, error) {
+	maxAge := e.drone.agent.maxAge
+	if maxAge <= 0 || len(ids) == 0 {
+		return nil, nil
+	}
+
+	agents, err := e.drone.agent.cluster.Describe(ctx, ids)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't describe agents to check their age: %v", err)
+	}
+	now := time.Now().UTC()
+	var res []cluster.NodeId
+	for _, agent := range agents {
+		if agent.LaunchTime != nil && now.Sub(*agent.LaunchTime) > maxAge {
+			res = append(res, cluster.NodeId(*agent.InstanceId))
+		}
+	}
+	return res, nil
+}
+
+// returns the agents launched from an outdated launch template version or
+// launch configuration, or none if outdated agents aren't replaced
+func (e *Engine) listOutdatedAgents(ctx context.Context) ([]cluster.NodeId, error) {
+	if e.drone.agent.replacementRate <= 0 {
+		return nil, nil
+	}
+	outdated, err := e.drone.agent.cluster.OutdatedAgents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't check agents for launch template drift: %v", err)
+	}
+	metrics.OutdatedAgents.Set(int64(len(outdated)))
+	if len(outdated) > 0 {
+		log.
+			WithField("count", len(outdated)).
+			Infoln("Agent cluster has outdated agents to replace")
+	}
+	return outdated, nil
+}
+
+// returns up to the replacement rate of the given outdated agents that are
+// idle, excluding the ones that are already recycled
+func (e *Engine) pickReplacements(outdated, busy, recycled []cluster.NodeId) []cluster.NodeId {
+	excluded := toSet(append(append([]cluster.NodeId{}, busy...), recycled...))
+	var res []cluster.NodeId
+	for _, id := range outdated {
+		if len(res) == e.drone.agent.replacementRate {
+			break
+		}
+		if _, ok := excluded[id]; !ok {
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
+// returns a snapshot without the given agents, along with their build slots
+func (s *Snapshot) without(ids []cluster.NodeId) *Snapshot {
+	res := *s
+	excluded := toSet(ids)
+	res.Agents = make([]cluster.NodeId, 0, len(s.Agents))
+	for _, id := range s.Agents {
+		if _, ok := excluded[id]; !ok {
+			res.Agents = append(res.Agents, id)
+		}
+	}
+	res.Slots = make(map[cluster.NodeId]int, len(s.Slots))
+	for id, slots := range s.Slots {
+		if _, ok := excluded[id]; ok {
+			res.TotalSlots -= slots
+			res.FreeSlots -= float64(slots)
+			continue
+		}
+		res.Slots[id] = slots
+	}
+	return &res
+}
+
+// returns a snapshot without the given agents, which the autoscaling group
+// replaces with agents assumed to have the given build slots each. Like the
+// agents being launched, their replacements are capacity on its way.
+func (s *Snapshot) replaced(ids []cluster.NodeId, slots int) *Snapshot {
+	res := s.without(ids)
+	res.TotalSlots += len(ids) * slots
+	res.FreeSlots += float64(len(ids) * slots)
+	return res
+}
+
+// planRecycling amends the given plan to retire the given idle agents that
+// exceeded the max agent age or are outdated. The plan was made without
+// them, so it already adds whatever capacity pending builds and the
+// headroom need in their place. The agents are left alone while the plan
+// adds agents or a scaling activity is in progress, and retired once the
+// other agents cover the load. Agents are added instead if retiring them
+// brings the cluster below the min agent count.
+func (e *Engine) planRecycling(plan *Plan, s *Snapshot, all, recyclable []cluster.NodeId) *Plan {
+	if len(recyclable) == 0 || plan.RequiresUpscaling() || plan.RequiresCapacityReset() {
+		return plan
+	}
+	if s.Activity {
+		log.Debugln("Waiting for scaling activity to finish before recycling expired agents")
+		return plan
+	}
+
+	victims := append(append([]cluster.NodeId{}, recyclable...), plan.nodesToDestroy...)
+	if deficit := e.drone.agent.minCount - (len(all) - len(victims)); deficit > 0 && !plan.RequiresDownscaling() {
+		log.
+			WithField("count", deficit).
+			Infoln("Adding agents to replace the ones being recycled")
+		return newUpscalePlan(s, deficit)
+	}
+
+	victims = e.maintainMinAgentCount(all, victims)
+	if len(victims) == 0 {
+		return plan
+	}
+	log.
+		WithField("ids", recyclable).
+		Infoln("Recommending recycling of expired & outdated agents")
+
+	plan.action = actionDownscale
+	plan.nodesToDestroy = victims
+	return plan
+}
+
+// unprotectExpiredAgents removes the scale-in protection of agents that
+// exceeded the max agent age, so that they're never kept from retiring
+func (e *Engine) unprotectExpiredAgents(ctx context.Context, ids []cluster.NodeId) {
+	if len(ids) == 0 {
+		return
+	}
+	if err := e.drone.agent.cluster.Unprotect(ctx, ids); err != nil {
+		log.
+			WithError(err).
+			WithField("ids", ids).
+			Warnln("Failed to remove scale-in protection of expired agents")
+	}
+}
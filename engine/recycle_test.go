@@ -0,0 +1,140 @@
+package engine
+
+import (
+	"context"
+	"github.com/Shuttl-Tech/drone-autoscaler/cluster"
+	"reflect"
+	"testing"
+)
+
+func TestRecycle_SnapshotWithout(t *testing.T) {
+	s := &Snapshot{
+		Agents:     []cluster.NodeId{"i-100", "i-200"},
+		Slots:      map[cluster.NodeId]int{"i-100": 2, "i-200": 4},
+		TotalSlots: 6,
+		FreeSlots:  5,
+	}
+	got := s.without([]cluster.NodeId{"i-200"})
+	if !reflect.DeepEqual(got.Agents, []cluster.NodeId{"i-100"}) {
+		t.Errorf("Want agents without i-200, got %v", got.Agents)
+	}
+	if got.TotalSlots != 2 || got.FreeSlots != 1 {
+		t.Errorf("Want 2 total & 1 free slots, got %d & %v", got.TotalSlots, got.FreeSlots)
+	}
+	if len(s.Agents) != 2 || s.TotalSlots != 6 {
+		t.Error("Want original snapshot to be left untouched")
+	}
+}
+
+func TestRecycle_PlanRecycling(t *testing.T) {
+	e := &Engine{
+		drone: &droneConfig{
+			agent: &droneAgentConfig{maxBuilds: 2, minCount: 2},
+		},
+	}
+	all := []cluster.NodeId{"i-100", "i-200", "i-300"}
+	s := &Snapshot{Capacity: cluster.Capacity{Desired: 3}}
+
+	// replacements being added are waited for
+	upscale := newUpscalePlan(s, 1)
+	if got := e.planRecycling(upscale, s, all, []cluster.NodeId{"i-100"}); got != upscale {
+		t.Errorf("Want upscale plan to be kept, got %v", got)
+	}
+
+	// expired agents are retired first, as long as the min count is kept
+	downscale := newPlan(s)
+	downscale.action = actionDownscale
+	downscale.nodesToDestroy = []cluster.NodeId{"i-300"}
+	got := e.planRecycling(downscale, s, all, []cluster.NodeId{"i-100"})
+	if !reflect.DeepEqual(got.NodesToDestroy(), []cluster.NodeId{"i-100"}) {
+		t.Errorf("Want expired agent to be retired instead, got %v", got)
+	}
+
+	got = e.planRecycling(newPlan(s), s, all, []cluster.NodeId{"i-100"})
+	if !reflect.DeepEqual(got.NodesToDestroy(), []cluster.NodeId{"i-100"}) {
+		t.Errorf("Want expired agent to be recycled, got %v", got)
+	}
+
+	// a replacement is added before going below the min count
+	got = e.planRecycling(newPlan(s), s, all, []cluster.NodeId{"i-100", "i-200"})
+	if !got.RequiresUpscaling() || got.UpscaleCount() != 1 {
+		t.Errorf("Want a replacement agent to be added first, got %v", got)
+	}
+
+	// nothing is recycled while a scaling activity is in progress
+	s.Activity = true
+	if got := e.planRecycling(newPlan(s), s, all, []cluster.NodeId{"i-100"}); got.RequiresDownscaling() {
+		t.Errorf("Want no recycling during scaling activity, got %v", got)
+	}
+}
+
+// Verifies that the capacity recycled agents leave missing is added by the
+// policy planning without them, before they're retired
+func TestRecycle_ReplacementCapacity(t *testing.T) {
+	e := &Engine{
+		drone: &droneConfig{
+			agent: &droneAgentConfig{maxBuilds: 2, minCount: 1},
+		},
+	}
+	recyclable := []cluster.NodeId{"i-100"}
+	plan := func(s *Snapshot) *Plan {
+		p, err := reactivePolicy{e}.Plan(context.TODO(), s.without(recyclable))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e.planRecycling(p, s, s.Agents, recyclable)
+	}
+
+	// 3 pending builds don't fit in the slots of i-200 alone
+	s := &Snapshot{
+		Capacity:   cluster.Capacity{Desired: 2, Actual: 2},
+		Agents:     []cluster.NodeId{"i-100", "i-200"},
+		Slots:      map[cluster.NodeId]int{"i-100": 2, "i-200": 2},
+		TotalSlots: 4,
+		FreeSlots:  4,
+		Pending:    3,
+	}
+	if got := plan(s); !got.RequiresUpscaling() || got.UpscaleCount() != 1 {
+		t.Errorf("Want a replacement agent to be added first, got %v", got)
+	}
+
+	// nor does the headroom
+	s.Pending, s.Headroom = 0, 3
+	if got := plan(s); !got.RequiresUpscaling() || got.UpscaleCount() != 1 {
+		t.Errorf("Want a replacement agent to be added for the headroom, got %v", got)
+	}
+
+	// once the replacement runs, the expired agent is retired
+	s = &Snapshot{
+		Capacity:   cluster.Capacity{Desired: 3, Actual: 3},
+		Agents:     []cluster.NodeId{"i-100", "i-200", "i-300"},
+		Slots:      map[cluster.NodeId]int{"i-100": 2, "i-200": 2, "i-300": 2},
+		TotalSlots: 6,
+		FreeSlots:  6,
+		Pending:    3,
+	}
+	if got := plan(s); !reflect.DeepEqual(got.NodesToDestroy(), recyclable) {
+		t.Errorf("Want expired agent to be retired, got %v", got)
+	}
+}
+
+func TestRecycle_PickReplacements(t *testing.T) {
+	e := &Engine{
+		drone: &droneConfig{
+			agent: &droneAgentConfig{replacementRate: 2},
+		},
+	}
+	outdated := []cluster.NodeId{"i-100", "i-200", "i-300", "i-400"}
+	busy := []cluster.NodeId{"i-100"}
+	recycled := []cluster.NodeId{"i-200"}
+
+	got := e.pickReplacements(outdated, busy, recycled)
+	if want := []cluster.NodeId{"i-300", "i-400"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Want replacements %v, got %v", want, got)
+	}
+
+	e.drone.agent.replacementRate = 1
+	if got := e.pickReplacements(outdated, nil, nil); len(got) != 1 {
+		t.Errorf("Want a single replacement per cycle, got %v", got)
+	}
+}
@@ -0,0 +1,22 @@
+package engine
+
+import (
+	"fmt"
+	"github.com/drone/drone-go/drone"
+)
+
+// lookupBuildRepos returns the repository of every incomplete build, keyed
+// by build ID. Stages in drone's queue only reference their build by ID,
+// and the list of incomplete builds is the only API that maps those IDs
+// to repositories.
+func (e *Engine) lookupBuildRepos() (map[int64]*drone.Repo, error) {
+	repos, err := e.drone.client.Incomplete()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't fetch incomplete builds from drone: %v", err)
+	}
+	res := make(map[int64]*drone.Repo, len(repos))
+	for _, repo := range repos {
+		res[repo.Build.ID] = repo
+	}
+	return res, nil
+}
@@ -0,0 +1,85 @@
+package engine
+
+import (
+	"github.com/Shuttl-Tech/drone-autoscaler/config"
+	"github.com/drone/drone-go/drone"
+	log "github.com/sirupsen/logrus"
+	"path"
+	"time"
+)
+
+// weight of a stage that isn't matched by any rule
+const defaultStageWeight = 1.0
+
+type buildRule struct {
+	repo               string
+	namespace          string
+	weight             float64
+	pendingMaxDuration time.Duration
+	exclude            bool
+}
+
+func newBuildRules(rules config.BuildRules) []*buildRule {
+	res := make([]*buildRule, len(rules))
+	for i, r := range rules {
+		res[i] = &buildRule{
+			repo:               r.Repo,
+			namespace:          r.Namespace,
+			weight:             r.Weight,
+			pendingMaxDuration: r.PendingMaxDuration,
+			exclude:            r.Exclude,
+		}
+	}
+	return res
+}
+
+// returns true if the rule applies to the given repository
+func (r *buildRule) matches(repo *drone.Repo) bool {
+	if r.namespace != "" && r.namespace != repo.Namespace {
+		return false
+	}
+	if r.repo != "" {
+		ok, err := path.Match(r.repo, repo.Slug)
+		if err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// matchBuildRules determines the rule applicable to every build in the
+// given set of repositories and remembers it for the rest of the cycle
+func (e *Engine) matchBuildRules(repos map[int64]*drone.Repo) {
+	e.matchedRules = make(map[int64]*buildRule, len(repos))
+	for buildID, repo := range repos {
+		for _, rule := range e.drone.build.rules {
+			if rule.matches(repo) {
+				e.matchedRules[buildID] = rule
+				break
+			}
+		}
+	}
+	log.
+		WithField("count", len(e.matchedRules)).
+		Debugln("Matched build rules to incomplete builds")
+}
+
+// returns the rule that applies to the given stage, nil if there's none
+func (e *Engine) ruleOf(stage *drone.Stage) *buildRule {
+	return e.matchedRules[stage.BuildID]
+}
+
+// returns the number of build slots occupied by the given stage
+func (e *Engine) stageWeight(stage *drone.Stage) float64 {
+	if r := e.ruleOf(stage); r != nil && r.weight > 0 {
+		return r.weight
+	}
+	return defaultStageWeight
+}
+
+// filter func that returns false if a stage belongs to a repository that
+// is excluded from scaling
+func (e *Engine) excludedBuildFilter(stage *drone.Stage) bool {
+	r := e.ruleOf(stage)
+	return r == nil || !r.exclude
+}
@@ -0,0 +1,83 @@
+package engine
+
+import (
+	"github.com/Shuttl-Tech/drone-autoscaler/config"
+	"github.com/drone/drone-go/drone"
+	"testing"
+	"time"
+)
+
+func TestRules_Matches(t *testing.T) {
+	repo := &drone.Repo{Namespace: "octocat", Slug: "octocat/heavy-app"}
+	tests := []struct {
+		rule buildRule
+		want bool
+	}{
+		{buildRule{repo: "octocat/heavy-app"}, true},
+		{buildRule{repo: "octocat/heavy-*"}, true},
+		{buildRule{repo: "octocat/lint-*"}, false},
+		{buildRule{namespace: "octocat"}, true},
+		{buildRule{namespace: "github"}, false},
+		{buildRule{namespace: "octocat", repo: "*/heavy-*"}, true},
+		{buildRule{namespace: "github", repo: "*/heavy-*"}, false},
+		{buildRule{repo: "["}, false},
+	}
+	for _, test := range tests {
+		if got := test.rule.matches(repo); got != test.want {
+			t.Errorf("Want %v for rule %+v, got %v", test.want, test.rule, got)
+		}
+	}
+}
+
+func TestRules_Apply(t *testing.T) {
+	e := Engine{
+		drone: &droneConfig{
+			build: &droneBuildConfig{
+				pendingMaxDuration: -1,
+				rules: newBuildRules(config.BuildRules{
+					{Repo: "octocat/heavy", Weight: 4, PendingMaxDuration: time.Minute},
+					{Namespace: "octocat", Weight: 0.5},
+					{Namespace: "lint", Exclude: true},
+				}),
+			},
+		},
+	}
+	e.matchBuildRules(map[int64]*drone.Repo{
+		1: {Namespace: "octocat", Slug: "octocat/heavy"},
+		2: {Namespace: "octocat", Slug: "octocat/tiny"},
+		3: {Namespace: "lint", Slug: "lint/golang"},
+	})
+
+	stages := []*drone.Stage{
+		{BuildID: 1, Status: drone.StatusRunning},
+		{BuildID: 2, Status: drone.StatusRunning},
+		{BuildID: 2, Status: drone.StatusPending},
+		{BuildID: 3, Status: drone.StatusPending},
+		{BuildID: 4, Status: drone.StatusPending},
+	}
+	stages = filterStages(stages, e.excludedBuildFilter)
+	if len(stages) != 4 {
+		t.Fatalf("Want excluded stage to be removed, got %d stages", len(stages))
+	}
+
+	pending, running := e.countBuilds(stages)
+	if pending != 1.5 {
+		t.Errorf("Want pending 1.5, got %v", pending)
+	}
+	if running != 4.5 {
+		t.Errorf("Want running 4.5, got %v", running)
+	}
+
+	heavy := &drone.Stage{
+		BuildID: 1,
+		Status:  drone.StatusPending,
+		Created: time.Now().Add(-2 * time.Minute).Unix(),
+	}
+	if e.agedPendingBuildFilter(heavy) {
+		t.Error("Expected false once rule's pending max duration is exceeded")
+	}
+	heavy.BuildID = 2
+	if !e.agedPendingBuildFilter(heavy) {
+		t.Error("Expected true when global pending max duration is unbounded")
+	}
+}
@@ -5,38 +5,122 @@ import (
 	"fmt"
 	"github.com/Shuttl-Tech/drone-autoscaler/cluster"
 	log "github.com/sirupsen/logrus"
+	"time"
 )
 
 const (
 	actionNone      = "noop"
 	actionUpscale   = "upscale"
 	actionDownscale = "downscale"
+	actionReset     = "reset"
 )
 
-func (e *Engine) Upscale(ctx context.Context, count int) error {
-	return e.drone.agent.cluster.Add(ctx, count)
+// Upscale sets the desired capacity of the agent cluster from the current
+// capacity to the target one. The cluster may clamp the target to its size
+// limits, and refuses to scale if its capacity was changed concurrently.
+func (e *Engine) Upscale(ctx context.Context, current, target int) (cluster.ScaleResult, error) {
+	return e.drone.agent.cluster.ScaleTo(ctx, current, target)
 }
 
-func (e *Engine) Downscale(ctx context.Context, agents []cluster.NodeId) error {
+// ResetCapacity sets the desired capacity of the agent cluster from the
+// current capacity back to the number of agents it actually has, so that
+// it stops attempting to launch agents that never come up
+func (e *Engine) ResetCapacity(ctx context.Context, current, actual int) error {
+	log.
+		WithField("old", current).
+		WithField("new", actual).
+		Warnln("Resetting desired capacity of agent cluster")
+	_, err := e.drone.agent.cluster.ScaleTo(ctx, current, actual)
+	return err
+}
+
+// Downscale destroys the given agents while the build queue is paused,
+// returning the outcome of every termination. Agents that couldn't be
+// terminated are retried on a later cycle.
+func (e *Engine) Downscale(ctx context.Context, agents []cluster.NodeId) ([]cluster.TerminationResult, error) {
 	log.Infoln("Pausing build queue to destroy agents")
 	if err := e.drone.client.QueuePause(); err != nil {
-		return fmt.Errorf("couldn't pause drone queue while downscaling: %v", err)
+		return nil, fmt.Errorf("couldn't pause drone queue while downscaling: %v", err)
 	}
-	defer e.resumeBuildQueue()
+	pausedAt := time.Now()
+	defer func() {
+		e.resumeBuildQueue(ctx)
+		e.notifyQueuePaused(ctx, time.Since(pausedAt))
+	}()
+	e.markDraining(ctx, agents)
 	log.
 		WithField("ids", agents).
 		Debugln("Destroying agent nodes")
-	return e.drone.agent.cluster.Destroy(ctx, agents)
+	results, err := e.drone.agent.cluster.Destroy(ctx, agents)
+	e.recordTerminations(results)
+	return results, err
+}
+
+// markDraining tags the given agents as draining, if enabled, so that
+// operators can tell them apart while they're being retired. Agents are
+// retired even if they couldn't be tagged.
+func (e *Engine) markDraining(ctx context.Context, agents []cluster.NodeId) {
+	if !e.drone.agent.tagDraining {
+		return
+	}
+	err := e.drone.agent.cluster.Tag(ctx, agents, map[string]string{cluster.TagState: cluster.AgentStateDraining})
+	if err != nil {
+		log.
+			WithError(err).
+			WithField("ids", agents).
+			Warnln("Failed to tag agents as draining")
+	}
 }
 
 // resumeBuildQueue attempts to resume Drone's build queue
-func (e *Engine) resumeBuildQueue() {
+func (e *Engine) resumeBuildQueue(ctx context.Context) {
 	log.Infoln("Resuming build queue")
 
 	// failing to resume is catastrophic because all builds will remain
-	// stuck if the queue was previously paused, so the app must fail
-	// immediately and queue must be resumed manually before re-starting it.
+	// stuck if the queue was previously paused. Once the client has run out
+	// of retries, operators are notified and the app must fail immediately.
+	// The queue must be resumed manually before re-starting it.
 	if err := e.drone.client.QueueResume(); err != nil {
+		e.notifyQueueResumeFailed(ctx, err)
 		panic(fmt.Errorf("failed to resume build queue: %v", err))
 	}
 }
+
+// Drain safely retires the given agent. The agent is destroyed only if it
+// isn't running any builds and retiring it doesn't bring the cluster below
+// the minimum agent count. The build queue is paused meanwhile so that no
+// builds get scheduled on the agent.
+func (e *Engine) Drain(ctx context.Context, agent cluster.NodeId) error {
+	all, err := e.drone.agent.cluster.List(ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't fetch list of agents: %v", err)
+	}
+	if !contains(all, agent) {
+		return fmt.Errorf("agent %s is not a running member of the agent cluster", agent)
+	}
+	if len(all)-1 < e.drone.agent.minCount {
+		return fmt.Errorf("retiring agent %s would bring the cluster below %d agents", agent, e.drone.agent.minCount)
+	}
+
+	log.Infoln("Pausing build queue to drain agent")
+	if err := e.drone.client.QueuePause(); err != nil {
+		return fmt.Errorf("couldn't pause drone queue while draining agent: %v", err)
+	}
+	defer e.resumeBuildQueue(ctx)
+
+	// the queue is checked only after pausing it, so that a build can't be
+	// scheduled on the agent right before it's destroyed
+	stages, err := e.drone.client.Queue()
+	if err != nil {
+		return fmt.Errorf("couldn't fetch build queue: %v", err)
+	}
+	if n := runningBuildsByAgent(stages)[agent]; n > 0 {
+		return fmt.Errorf("agent %s is running %d builds", agent, n)
+	}
+	log.
+		WithField("id", agent).
+		Infoln("Destroying drained agent")
+	e.markDraining(ctx, []cluster.NodeId{agent})
+	_, err = e.drone.agent.cluster.Destroy(ctx, []cluster.NodeId{agent})
+	return err
+}
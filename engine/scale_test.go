@@ -5,8 +5,11 @@ import (
 	"github.com/Shuttl-Tech/drone-autoscaler/cluster"
 	"github.com/Shuttl-Tech/drone-autoscaler/mocks"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/drone/drone-go/drone"
 	"github.com/golang/mock/gomock"
+	"reflect"
 	"testing"
 )
 
@@ -17,15 +20,15 @@ func TestScale_Upscale(t *testing.T) {
 	asg := mocks.NewMockAutoScalingAPI(ctrl)
 	describe := asg.
 		EXPECT().
-		DescribeAutoScalingGroups(gomock.Any()).
+		DescribeAutoScalingGroupsWithContext(gomock.Any(), gomock.Any()).
 		Return(&autoscaling.DescribeAutoScalingGroupsOutput{
 			AutoScalingGroups: []*autoscaling.Group{
-				{DesiredCapacity: aws.Int64(2)},
+				{DesiredCapacity: aws.Int64(2), MaxSize: aws.Int64(10)},
 			},
 		}, nil)
 	asg.
 		EXPECT().
-		SetDesiredCapacity(&autoscaling.SetDesiredCapacityInput{
+		SetDesiredCapacityWithContext(gomock.Any(), &autoscaling.SetDesiredCapacityInput{
 			DesiredCapacity:      aws.Int64(5),
 			AutoScalingGroupName: aws.String("test-asg"),
 		}).
@@ -39,10 +42,13 @@ func TestScale_Upscale(t *testing.T) {
 		},
 	}
 
-	err := e.Upscale(context.TODO(), 3)
+	result, err := e.Upscale(context.TODO(), 2, 5)
 	if err != nil {
 		t.Error(err)
 	}
+	if result.Clamped() || result.Desired != 5 {
+		t.Errorf("Want desired capacity 5, got %+v", result)
+	}
 }
 
 func TestScale_Downscale(t *testing.T) {
@@ -59,7 +65,7 @@ func TestScale_Downscale(t *testing.T) {
 	for _, t := range cluster.NodeIdsToAwsStrings(targets) {
 		downscale = asg.
 			EXPECT().
-			TerminateInstanceInAutoScalingGroup(&autoscaling.TerminateInstanceInAutoScalingGroupInput{
+			TerminateInstanceInAutoScalingGroupWithContext(gomock.Any(), &autoscaling.TerminateInstanceInAutoScalingGroupInput{
 				InstanceId:                     t,
 				ShouldDecrementDesiredCapacity: aws.Bool(true),
 			}).
@@ -77,8 +83,167 @@ func TestScale_Downscale(t *testing.T) {
 		},
 	}
 
-	err := e.Downscale(context.TODO(), targets)
+	results, err := e.Downscale(context.TODO(), targets)
 	if err != nil {
 		t.Error(err)
 	}
+	for i, r := range results {
+		if r.Id != targets[i] || r.Status != cluster.Terminated {
+			t.Errorf("Want %s to be terminated, got %+v", targets[i], r)
+		}
+	}
+}
+
+// Verifies that every agent is attempted even if some fail, and that the
+// failed ones are tracked for retrying
+func TestScale_DownscalePartialFailure(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	terminate := func(id string) *autoscaling.TerminateInstanceInAutoScalingGroupInput {
+		return &autoscaling.TerminateInstanceInAutoScalingGroupInput{
+			InstanceId:                     aws.String(id),
+			ShouldDecrementDesiredCapacity: aws.Bool(true),
+		}
+	}
+	asg := mocks.NewMockAutoScalingAPI(ctrl)
+	asg.
+		EXPECT().
+		TerminateInstanceInAutoScalingGroupWithContext(gomock.Any(), terminate("i-001")).
+		Return(nil, nil)
+	asg.
+		EXPECT().
+		TerminateInstanceInAutoScalingGroupWithContext(gomock.Any(), terminate("i-002")).
+		Return(nil, awserr.New("ValidationError", "Instance Id not found - No managed instance found for instance ID: i-002", nil))
+	asg.
+		EXPECT().
+		TerminateInstanceInAutoScalingGroupWithContext(gomock.Any(), terminate("i-003")).
+		Return(nil, awserr.New("ScalingActivityInProgress", "Scaling activity is in progress", nil))
+
+	droneClient := mocks.NewMockClient(ctrl)
+	droneClient.EXPECT().QueuePause().Return(nil)
+	droneClient.EXPECT().QueueResume().Return(nil)
+
+	e := &Engine{
+		drone: &droneConfig{
+			client: droneClient,
+			agent:  &droneAgentConfig{cluster: cluster.New("test-asg", nil, asg)},
+		},
+	}
+
+	results, err := e.Downscale(context.TODO(), []cluster.NodeId{"i-001", "i-002", "i-003"})
+	if err == nil {
+		t.Error("Want error for failed termination")
+	}
+	want := []cluster.TerminationStatus{cluster.Terminated, cluster.AlreadyGone, cluster.TerminationFailed}
+	for i, r := range results {
+		if r.Status != want[i] {
+			t.Errorf("Want status %s for %s, got %s", want[i], r.Id, r.Status)
+		}
+	}
+	if failed := cluster.FailedTerminations(results); !reflect.DeepEqual(failed, []cluster.NodeId{"i-003"}) {
+		t.Errorf("Want i-003 to have failed, got %v", failed)
+	}
+	if !reflect.DeepEqual(e.failedTerminations, map[cluster.NodeId]int{"i-003": 1}) {
+		t.Errorf("Want i-003 to be retried later, got %v", e.failedTerminations)
+	}
+}
+
+func TestScale_RetryFailedTerminations(t *testing.T) {
+	e := &Engine{
+		failedTerminations: map[cluster.NodeId]int{
+			"i-003": 1,
+			"i-004": maxTerminationAttempts,
+			"i-009": 1,
+		},
+	}
+	all := []cluster.NodeId{"i-001", "i-002", "i-003", "i-004"}
+	victims := []cluster.NodeId{"i-001", "i-004", "i-003"}
+
+	got := e.retryFailedTerminations(all, victims)
+	if want := []cluster.NodeId{"i-003", "i-001", "i-004"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Want victims %v, got %v", want, got)
+	}
+	// agents that are gone or failed too many times are forgotten
+	if want := map[cluster.NodeId]int{"i-003": 1}; !reflect.DeepEqual(e.failedTerminations, want) {
+		t.Errorf("Want failed terminations %v, got %v", want, e.failedTerminations)
+	}
+
+	// a failed agent beyond the limit on the slots retired is still
+	// retried, ahead of the others
+	slots := map[cluster.NodeId]int{"i-001": 2, "i-003": 2, "i-004": 2}
+	got = limitVictims(e.retryFailedTerminations(all, victims), slots, 2)
+	if want := []cluster.NodeId{"i-003"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Want victims %v within the slot limit, got %v", want, got)
+	}
+}
+
+func TestScale_Drain(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	asg := mocks.NewMockAutoScalingAPI(ctrl)
+	asg.
+		EXPECT().
+		DescribeAutoScalingGroupsWithContext(gomock.Any(), gomock.Any()).
+		Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+			AutoScalingGroups: []*autoscaling.Group{
+				{
+					Instances: []*autoscaling.Instance{
+						{
+							HealthStatus: aws.String("Healthy"),
+							InstanceId:   aws.String("i-001"),
+						},
+						{
+							HealthStatus: aws.String("Healthy"),
+							InstanceId:   aws.String("i-002"),
+						},
+					},
+				},
+			},
+		}, nil).
+		AnyTimes()
+
+	droneClient := mocks.NewMockClient(ctrl)
+	// the queue is paused once for each agent that's checked for builds
+	droneClient.EXPECT().QueuePause().Return(nil).Times(2)
+	droneClient.
+		EXPECT().
+		Queue().
+		Return([]*drone.Stage{{Status: drone.StatusRunning, Machine: "i-002"}}, nil).
+		Times(2)
+	terminate := asg.
+		EXPECT().
+		TerminateInstanceInAutoScalingGroupWithContext(gomock.Any(), &autoscaling.TerminateInstanceInAutoScalingGroupInput{
+			InstanceId:                     aws.String("i-001"),
+			ShouldDecrementDesiredCapacity: aws.Bool(true),
+		}).
+		Return(nil, nil)
+	droneClient.EXPECT().QueueResume().Return(nil).After(terminate)
+	droneClient.EXPECT().QueueResume().Return(nil)
+
+	e := &Engine{
+		drone: &droneConfig{
+			client: droneClient,
+			agent: &droneAgentConfig{
+				cluster:  cluster.New("test-asg", nil, asg),
+				minCount: 1,
+			},
+		},
+	}
+
+	if err := e.Drain(context.TODO(), "i-001"); err != nil {
+		t.Errorf("Want idle agent to be drained, got %v", err)
+	}
+	if err := e.Drain(context.TODO(), "i-002"); err == nil {
+		t.Error("Want error draining busy agent")
+	}
+	if err := e.Drain(context.TODO(), "i-003"); err == nil {
+		t.Error("Want error draining unknown agent")
+	}
+
+	e.drone.agent.minCount = 2
+	if err := e.Drain(context.TODO(), "i-001"); err == nil {
+		t.Error("Want error draining agent below min count")
+	}
 }
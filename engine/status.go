@@ -0,0 +1,97 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"github.com/Shuttl-Tech/drone-autoscaler/cluster"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/drone/drone-go/drone"
+	"time"
+)
+
+// AgentStatus describes a running agent and the builds it's running
+type AgentStatus struct {
+	Id            cluster.NodeId `json:"id"`
+	InstanceType  string         `json:"instance_type"`
+	Zone          string         `json:"zone"`
+	LaunchTime    time.Time      `json:"launch_time"`
+	RunningBuilds int            `json:"running_builds"`
+	Outdated      bool           `json:"outdated"`
+}
+
+// Busy returns true if the agent is running 1 or more builds
+func (a AgentStatus) Busy() bool {
+	return a.RunningBuilds > 0
+}
+
+// Status describes the agent cluster at a point in time
+type Status struct {
+	Capacity cluster.Capacity `json:"capacity"`
+	Agents   []AgentStatus    `json:"agents"`
+
+	// number of agents launched from an outdated launch template version
+	// or launch configuration, only checked while they're being replaced
+	Outdated int `json:"outdated"`
+}
+
+// Status returns the capacity of the agent autoscaling group along with
+// every running agent, the number of builds running on it and whether it's
+// outdated
+func (e *Engine) Status(ctx context.Context) (*Status, error) {
+	capacity, err := e.drone.agent.cluster.Capacity(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't fetch capacity of agent cluster: %v", err)
+	}
+	ids, err := e.drone.agent.cluster.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't fetch list of agents: %v", err)
+	}
+	stages, err := e.drone.client.Queue()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't fetch build queue: %v", err)
+	}
+
+	status := &Status{Capacity: capacity, Agents: make([]AgentStatus, 0, len(ids))}
+	if len(ids) == 0 {
+		return status, nil
+	}
+	instances, err := e.drone.agent.cluster.Describe(ctx, ids)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't describe agents: %v", err)
+	}
+
+	outdated, err := e.listOutdatedAgents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	outdatedSet := toSet(outdated)
+
+	running := runningBuildsByAgent(stages)
+	for _, i := range instances {
+		id := cluster.NodeId(aws.StringValue(i.InstanceId))
+		_, isOutdated := outdatedSet[id]
+		status.Agents = append(status.Agents, AgentStatus{
+			Id:            id,
+			InstanceType:  aws.StringValue(i.InstanceType),
+			Zone:          availabilityZone(i),
+			LaunchTime:    aws.TimeValue(i.LaunchTime),
+			RunningBuilds: running[id],
+			Outdated:      isOutdated,
+		})
+		if isOutdated {
+			status.Outdated++
+		}
+	}
+	return status, nil
+}
+
+// returns the number of builds running on every busy agent
+func runningBuildsByAgent(stages []*drone.Stage) map[cluster.NodeId]int {
+	res := make(map[cluster.NodeId]int)
+	for _, stage := range stages {
+		if stage.Status == drone.StatusRunning {
+			res[cluster.NodeId(stage.Machine)]++
+		}
+	}
+	return res
+}
@@ -0,0 +1,108 @@
+package engine
+
+import (
+	"context"
+	"github.com/Shuttl-Tech/drone-autoscaler/cluster"
+	"github.com/Shuttl-Tech/drone-autoscaler/mocks"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/drone/drone-go/drone"
+	"github.com/golang/mock/gomock"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStatus(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	asg := mocks.NewMockAutoScalingAPI(ctrl)
+	asg.
+		EXPECT().
+		DescribeAutoScalingGroupsWithContext(gomock.Any(), gomock.Any()).
+		Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+			AutoScalingGroups: []*autoscaling.Group{
+				{
+					Instances: []*autoscaling.Instance{
+						{
+							HealthStatus: aws.String("Healthy"),
+							InstanceId:   aws.String("i-001"),
+						},
+						{
+							HealthStatus: aws.String("Healthy"),
+							InstanceId:   aws.String("i-002"),
+						},
+					},
+					DesiredCapacity: aws.Int64(2),
+					MinSize:         aws.Int64(1),
+					MaxSize:         aws.Int64(10),
+				},
+			},
+		}, nil).
+		Times(2)
+
+	launched := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	ec2Client := mocks.NewMockEC2API(ctrl)
+	ec2Client.
+		EXPECT().
+		DescribeInstancesWithContext(gomock.Any(), gomock.Any()).
+		Return(&ec2.DescribeInstancesOutput{
+			Reservations: []*ec2.Reservation{
+				{
+					Instances: []*ec2.Instance{
+						{
+							InstanceId:   aws.String("i-001"),
+							InstanceType: aws.String("c5.xlarge"),
+							LaunchTime:   aws.Time(launched),
+							Placement:    &ec2.Placement{AvailabilityZone: aws.String("ap-south-1a")},
+						},
+						{
+							InstanceId:   aws.String("i-002"),
+							InstanceType: aws.String("c5.xlarge"),
+							LaunchTime:   aws.Time(launched),
+							Placement:    &ec2.Placement{AvailabilityZone: aws.String("ap-south-1b")},
+						},
+					},
+				},
+			},
+		}, nil)
+
+	droneClient := mocks.NewMockClient(ctrl)
+	droneClient.
+		EXPECT().
+		Queue().
+		Return([]*drone.Stage{
+			{Status: drone.StatusRunning, Machine: "i-001"},
+			{Status: drone.StatusRunning, Machine: "i-001"},
+			{Status: drone.StatusPending},
+		}, nil)
+
+	e := &Engine{
+		drone: &droneConfig{
+			client: droneClient,
+			agent: &droneAgentConfig{
+				cluster: cluster.New("test-asg", ec2Client, asg),
+			},
+		},
+	}
+	status, err := e.Status(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &Status{
+		Capacity: cluster.Capacity{Desired: 2, Min: 1, Max: 10, Actual: 2},
+		Agents: []AgentStatus{
+			{Id: "i-001", InstanceType: "c5.xlarge", Zone: "ap-south-1a", LaunchTime: launched, RunningBuilds: 2},
+			{Id: "i-002", InstanceType: "c5.xlarge", Zone: "ap-south-1b", LaunchTime: launched},
+		},
+	}
+	if !reflect.DeepEqual(status, want) {
+		t.Errorf("Want status %+v, got %+v", want, status)
+	}
+	if !status.Agents[0].Busy() || status.Agents[1].Busy() {
+		t.Errorf("Want only i-001 to be busy, got %+v", status.Agents)
+	}
+}
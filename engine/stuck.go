@@ -0,0 +1,166 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"github.com/Shuttl-Tech/drone-autoscaler/metrics"
+	"github.com/Shuttl-Tech/drone-autoscaler/notify"
+	"github.com/drone/drone-go/drone"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// BuildRef identifies a drone build by its repository & build number
+type BuildRef struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Number    int64  `json:"number"`
+}
+
+func (b BuildRef) String() string {
+	return fmt.Sprintf("%s/%s#%d", b.Namespace, b.Name, b.Number)
+}
+
+// returns a human-readable identifier of the given stage, including its
+// repository & build number when known
+func describeStage(stage *drone.Stage, repos map[int64]*drone.Repo) string {
+	if repo, ok := repos[stage.BuildID]; ok {
+		return fmt.Sprintf("%s#%d.%d", repo.Slug, repo.Build.Number, stage.Number)
+	}
+	return fmt.Sprintf("build:%d#%d", stage.BuildID, stage.Number)
+}
+
+// filterAgedStages removes all stages that are pending or running for
+// longer than their maximum allowed duration and reports the discarded
+// ones. It also returns the builds that have crossed the hard duration
+// limit and must be cancelled.
+// Repositories are looked up if they weren't supplied and are needed.
+func (e *Engine) filterAgedStages(
+	ctx context.Context,
+	stages []*drone.Stage,
+	repos map[int64]*drone.Repo,
+) ([]*drone.Stage, []BuildRef) {
+	kept, pending := partitionStages(stages, e.agedPendingBuildFilter)
+	kept, running := partitionStages(kept, e.agedRunningBuildFilter)
+	discarded := append(pending, running...)
+	overdue := filterStages(stages, e.overdueBuildFilter)
+
+	if repos == nil && (len(discarded) > 0 || len(overdue) > 0) {
+		var err error
+		if repos, err = e.lookupBuildRepos(); err != nil {
+			// reporting is best-effort, stages are still identified
+			// by their build ID
+			log.WithError(err).Warnln("Couldn't look up repositories of discarded stages")
+		}
+	}
+
+	e.reportDiscardedStages(ctx, discarded, repos)
+	return kept, e.listBuildsToCancel(overdue, repos)
+}
+
+// reportDiscardedStages logs every discarded stage and notifies operators
+// about the ones that weren't discarded in the previous cycle
+func (e *Engine) reportDiscardedStages(ctx context.Context, stages []*drone.Stage, repos map[int64]*drone.Repo) {
+	metrics.StuckStages.Set(int64(len(stages)))
+
+	seen := make(map[int64]struct{}, len(stages))
+	fresh := make([]string, 0, len(stages))
+	for _, stage := range stages {
+		id := describeStage(stage, repos)
+		seen[stage.ID] = struct{}{}
+		log.
+			WithField("stage", id).
+			WithField("status", stage.Status).
+			WithField("machine", stage.Machine).
+			Debugln("Discarded stage that exceeded its max duration")
+
+		if _, ok := e.discarded[stage.ID]; !ok {
+			metrics.DiscardedStages.Add(stage.Status, 1)
+			fresh = append(fresh, id)
+		}
+	}
+	// forget stages that are no longer discarded, so the set doesn't
+	// grow forever
+	e.discarded = seen
+
+	if len(fresh) == 0 {
+		return
+	}
+	log.
+		WithField("stages", fresh).
+		Warnln("Discarding stages that exceeded their max duration")
+	e.emit(ctx, notify.EventStagesDiscarded, map[string]interface{}{
+		"stages": fresh,
+		"count":  len(fresh),
+	})
+}
+
+// returns the unique builds of the given stages. Stages whose repository
+// couldn't be determined are skipped since their build can't be addressed.
+func (e *Engine) listBuildsToCancel(stages []*drone.Stage, repos map[int64]*drone.Repo) []BuildRef {
+	set := make(map[int64]struct{}, len(stages))
+	res := make([]BuildRef, 0, len(stages))
+	for _, stage := range stages {
+		if _, ok := set[stage.BuildID]; ok {
+			continue
+		}
+		repo, ok := repos[stage.BuildID]
+		if !ok {
+			log.
+				WithField("stage", describeStage(stage, repos)).
+				Warnln("Cannot cancel build of unknown repository")
+			continue
+		}
+		set[stage.BuildID] = struct{}{}
+		res = append(res, BuildRef{
+			Namespace: repo.Namespace,
+			Name:      repo.Name,
+			Number:    repo.Build.Number,
+		})
+	}
+	return res
+}
+
+// CancelBuilds cancels the given drone builds. Failure to cancel a build
+// is logged and doesn't prevent the remaining builds from being cancelled.
+func (e *Engine) CancelBuilds(ctx context.Context, builds []BuildRef) {
+	for _, b := range builds {
+		log.
+			WithField("build", b).
+			Warnln("Cancelling build that exceeded the hard duration limit")
+
+		if err := e.drone.client.BuildCancel(b.Namespace, b.Name, int(b.Number)); err != nil {
+			log.
+				WithError(err).
+				WithField("build", b).
+				Errorln("Failed to cancel build")
+			continue
+		}
+		metrics.CancelledBuilds.Add(1)
+		e.emit(ctx, notify.EventBuildCancelled, map[string]interface{}{
+			"build": b.String(),
+			"limit": e.drone.build.cancelMaxDuration.String(),
+		})
+	}
+}
+
+// filter func that returns true if a build has been pending or running
+// for longer than the hard duration limit
+func (e *Engine) overdueBuildFilter(stage *drone.Stage) bool {
+	// cancellation is opt-in, a non-positive value disables it
+	limit := e.drone.build.cancelMaxDuration
+	if limit <= time.Duration(0) {
+		return false
+	}
+
+	var since int64
+	switch stage.Status {
+	case drone.StatusPending:
+		since = stage.Created
+	case drone.StatusRunning:
+		since = stage.Started
+	default:
+		return false
+	}
+	return time.Now().UTC().After(time.Unix(since, 0).Add(limit).UTC())
+}
@@ -0,0 +1,114 @@
+package engine
+
+import (
+	"context"
+	"github.com/Shuttl-Tech/drone-autoscaler/mocks"
+	"github.com/drone/drone-go/drone"
+	"github.com/golang/mock/gomock"
+	"testing"
+	"time"
+)
+
+func TestStuck_OverdueBuildFilter(t *testing.T) {
+	now := time.Now().UTC()
+	e := Engine{
+		drone: &droneConfig{
+			build: &droneBuildConfig{cancelMaxDuration: -1},
+		},
+	}
+	s := &drone.Stage{
+		Status:  drone.StatusPending,
+		Created: now.Add(-2 * time.Hour).Unix(),
+	}
+	if e.overdueBuildFilter(s) {
+		t.Error("Expected false when cancellation is disabled")
+	}
+
+	e.drone.build.cancelMaxDuration = 0
+	if e.overdueBuildFilter(s) {
+		t.Error("Expected false when cancel max duration is 0")
+	}
+
+	e.drone.build.cancelMaxDuration = time.Hour
+	if !e.overdueBuildFilter(s) {
+		t.Error("Expected true once pending build crossed the hard limit")
+	}
+
+	s.Status = drone.StatusRunning
+	s.Started = now.Add(-10 * time.Minute).Unix()
+	if e.overdueBuildFilter(s) {
+		t.Error("Expected false when running build is below the hard limit")
+	}
+
+	s.Status = drone.StatusBlocked
+	if e.overdueBuildFilter(s) {
+		t.Error("Expected false when build is neither pending nor running")
+	}
+}
+
+func TestStuck_ListBuildsToCancel(t *testing.T) {
+	e := Engine{}
+	repos := map[int64]*drone.Repo{
+		10: {Namespace: "octocat", Name: "hello", Build: drone.Build{ID: 10, Number: 42}},
+	}
+	stages := []*drone.Stage{
+		{ID: 1, BuildID: 10, Number: 1},
+		{ID: 2, BuildID: 10, Number: 2},
+		{ID: 3, BuildID: 99, Number: 1},
+	}
+
+	got := e.listBuildsToCancel(stages, repos)
+	if len(got) != 1 {
+		t.Fatalf("Want a single build, got %v", got)
+	}
+	if want := (BuildRef{"octocat", "hello", 42}); got[0] != want {
+		t.Errorf("Want build %v, got %v", want, got[0])
+	}
+}
+
+func TestStuck_ReportDiscardedStages(t *testing.T) {
+	rec := &recordingNotifier{}
+	e := Engine{notify: &notifyConfig{notifier: rec}}
+	stages := []*drone.Stage{
+		{ID: 1, BuildID: 10, Number: 1},
+		{ID: 2, BuildID: 10, Number: 2},
+	}
+
+	e.reportDiscardedStages(context.TODO(), stages, nil)
+	e.reportDiscardedStages(context.TODO(), stages, nil)
+	if len(rec.events) != 1 {
+		t.Fatalf("Want stages to be reported once, got %v", rec.events)
+	}
+	if got := rec.events[0].Fields["count"]; got != 2 {
+		t.Errorf("Want 2 discarded stages in event, got %v", got)
+	}
+
+	e.reportDiscardedStages(context.TODO(), stages[1:], nil)
+	e.reportDiscardedStages(context.TODO(), stages, nil)
+	if len(rec.events) != 2 {
+		t.Fatalf("Want re-discarded stage to be reported again, got %v", rec.events)
+	}
+	if got := rec.events[1].Fields["count"]; got != 1 {
+		t.Errorf("Want 1 discarded stage in event, got %v", got)
+	}
+}
+
+func TestStuck_CancelBuilds(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	droneClient := mocks.NewMockClient(ctrl)
+	droneClient.EXPECT().BuildCancel("octocat", "hello", 42).Return(nil)
+	droneClient.EXPECT().BuildCancel("octocat", "world", 7).Return(nil)
+
+	e := Engine{
+		drone: &droneConfig{
+			client: droneClient,
+			build:  &droneBuildConfig{cancelMaxDuration: time.Hour},
+		},
+	}
+	e.CancelBuilds(context.TODO(), []BuildRef{
+		{"octocat", "hello", 42},
+		{"octocat", "world", 7},
+	})
+}
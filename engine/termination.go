@@ -0,0 +1,77 @@
+package engine
+
+import (
+	"github.com/Shuttl-Tech/drone-autoscaler/cluster"
+	log "github.com/sirupsen/logrus"
+)
+
+// number of failed attempts after which an agent is no longer preferred
+// for retirement
+const maxTerminationAttempts = 3
+
+// recordTerminations tracks the agents that couldn't be terminated, so that
+// they're retried on a later cycle
+func (e *Engine) recordTerminations(results []cluster.TerminationResult) {
+	for _, r := range results {
+		switch r.Status {
+		case cluster.Terminated:
+			delete(e.failedTerminations, r.Id)
+			log.
+				WithField("id", r.Id).
+				Infoln("Terminated agent")
+
+		case cluster.AlreadyGone:
+			delete(e.failedTerminations, r.Id)
+
+		case cluster.TerminationFailed:
+			if e.failedTerminations == nil {
+				e.failedTerminations = make(map[cluster.NodeId]int)
+			}
+			e.failedTerminations[r.Id]++
+			log.
+				WithError(r.Err).
+				WithField("id", r.Id).
+				WithField("attempts", e.failedTerminations[r.Id]).
+				Warnln("Agent will be retried for retirement on a later cycle")
+		}
+	}
+}
+
+// retryFailedTerminations moves the given victims that previously failed to
+// terminate to the front, so that they're retired before any other agent.
+// Agents that are no longer running are forgotten, and so are the ones
+// that failed too many times, which are then treated as any other agent.
+func (e *Engine) retryFailedTerminations(all, victims []cluster.NodeId) []cluster.NodeId {
+	if len(e.failedTerminations) == 0 {
+		return victims
+	}
+
+	running := toSet(all)
+	for id, attempts := range e.failedTerminations {
+		if _, ok := running[id]; !ok {
+			delete(e.failedTerminations, id)
+		} else if attempts >= maxTerminationAttempts {
+			log.
+				WithField("id", id).
+				WithField("attempts", attempts).
+				Errorln("Giving up on retrying retirement of agent")
+			delete(e.failedTerminations, id)
+		}
+	}
+
+	retried := make([]cluster.NodeId, 0, len(victims))
+	rest := make([]cluster.NodeId, 0, len(victims))
+	for _, v := range victims {
+		if _, ok := e.failedTerminations[v]; ok {
+			retried = append(retried, v)
+		} else {
+			rest = append(rest, v)
+		}
+	}
+	if len(retried) > 0 {
+		log.
+			WithField("ids", retried).
+			Infoln("Retrying retirement of agents that failed to terminate")
+	}
+	return append(retried, rest...)
+}
@@ -20,6 +20,20 @@ func filterStages(stages []*drone.Stage, f StageFilter) []*drone.Stage {
 	return res
 }
 
+// splits the given list of stages into the ones for which the StageFilter
+// func returns true and the ones for which it returns false
+func partitionStages(stages []*drone.Stage, f StageFilter) (kept, dropped []*drone.Stage) {
+	kept = make([]*drone.Stage, 0, len(stages))
+	for _, s := range stages {
+		if f(s) {
+			kept = append(kept, s)
+		} else {
+			dropped = append(dropped, s)
+		}
+	}
+	return
+}
+
 // returns true if the given list of Node IDs contains the target Id
 func contains(arr []cluster.NodeId, subject cluster.NodeId) bool {
 	for _, s := range arr {
@@ -30,6 +44,15 @@ func contains(arr []cluster.NodeId, subject cluster.NodeId) bool {
 	return false
 }
 
+// returns a Set of the given node IDs
+func toSet(ids []cluster.NodeId) map[cluster.NodeId]struct{} {
+	set := make(map[cluster.NodeId]struct{}, len(ids))
+	for _, id := range ids {
+		set[id] = struct{}{}
+	}
+	return set
+}
+
 // returns list of node IDs from the given Set of nodes
 func keys(set map[cluster.NodeId]struct{}) []cluster.NodeId {
 	res := make([]cluster.NodeId, 0, len(set))
@@ -0,0 +1,220 @@
+package engine
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"github.com/Shuttl-Tech/drone-autoscaler/cluster"
+	"github.com/Shuttl-Tech/drone-autoscaler/config"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"sort"
+	"time"
+)
+
+// information about the agent fleet available to victim strategies
+type victimContext struct {
+	now time.Time
+
+	// hourly price of instance types
+	prices map[string]float64
+
+	// number of running agents in every availability zone
+	zones map[string]int
+}
+
+// victimStrategy orders agents eligible for retirement by preference. The
+// agents to retire first are at the front of the returned list.
+type victimStrategy func(candidates []*ec2.Instance, vc victimContext) []*ec2.Instance
+
+var victimStrategies = map[string]victimStrategy{
+	config.RetirementDefault:       defaultVictims,
+	config.RetirementOldestFirst:   oldestVictims,
+	config.RetirementNewestFirst:   newestVictims,
+	config.RetirementBillingHour:   billingHourVictims,
+	config.RetirementMostExpensive: mostExpensiveVictims,
+	config.RetirementSpotFirst:     spotVictims,
+	config.RetirementBalanceZones:  balancedZoneVictims,
+}
+
+// returns the victim strategy with the given name, falling back to the
+// default strategy for unknown names
+func newVictimStrategy(name string) victimStrategy {
+	if s, ok := victimStrategies[name]; ok {
+		return s
+	}
+	return defaultVictims
+}
+
+// orderVictims orders the given agents eligible for retirement as per the
+// configured victim strategy
+func (e *Engine) orderVictims(ctx context.Context, all []cluster.NodeId, candidates []*ec2.Instance) (
+	[]cluster.NodeId,
+	error,
+) {
+	vc := victimContext{
+		now:    time.Now().UTC(),
+		prices: e.drone.agent.instancePrices,
+	}
+
+	strategy := e.drone.agent.victimStrategy
+	if strategy == nil {
+		strategy = defaultVictims
+	}
+	if e.drone.agent.retirementStrategy == config.RetirementBalanceZones {
+		// balancing zones needs to know about all agents, not just the
+		// ones eligible for retirement
+		agents, err := e.drone.agent.cluster.Describe(ctx, all)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't describe agents to balance availability zones: %v", err)
+		}
+		vc.zones = make(map[string]int)
+		for _, agent := range agents {
+			vc.zones[availabilityZone(agent)]++
+		}
+	}
+
+	return instanceIds(strategy(candidates, vc)), nil
+}
+
+// retains the order in which AWS returned agents
+func defaultVictims(candidates []*ec2.Instance, _ victimContext) []*ec2.Instance {
+	return candidates
+}
+
+func oldestVictims(candidates []*ec2.Instance, _ victimContext) []*ec2.Instance {
+	res := copyInstances(candidates)
+	sort.SliceStable(res, func(i, j int) bool {
+		return aws.TimeValue(res[i].LaunchTime).Before(aws.TimeValue(res[j].LaunchTime))
+	})
+	return res
+}
+
+func newestVictims(candidates []*ec2.Instance, _ victimContext) []*ec2.Instance {
+	res := copyInstances(candidates)
+	sort.SliceStable(res, func(i, j int) bool {
+		return aws.TimeValue(res[i].LaunchTime).After(aws.TimeValue(res[j].LaunchTime))
+	})
+	return res
+}
+
+// prefers agents closest to the end of their current billing hour, since
+// the rest of that hour has already been paid for
+func billingHourVictims(candidates []*ec2.Instance, vc victimContext) []*ec2.Instance {
+	remaining := func(i *ec2.Instance) time.Duration {
+		return time.Hour - vc.now.Sub(aws.TimeValue(i.LaunchTime))%time.Hour
+	}
+	res := copyInstances(candidates)
+	sort.SliceStable(res, func(i, j int) bool {
+		return remaining(res[i]) < remaining(res[j])
+	})
+	return res
+}
+
+// prefers agents of instance types with the highest hourly price. Types
+// without a configured price are retired last.
+func mostExpensiveVictims(candidates []*ec2.Instance, vc victimContext) []*ec2.Instance {
+	res := copyInstances(candidates)
+	sort.SliceStable(res, func(i, j int) bool {
+		return vc.prices[aws.StringValue(res[i].InstanceType)] > vc.prices[aws.StringValue(res[j].InstanceType)]
+	})
+	return res
+}
+
+// prefers spot agents over on-demand ones
+func spotVictims(candidates []*ec2.Instance, _ victimContext) []*ec2.Instance {
+	res := copyInstances(candidates)
+	sort.SliceStable(res, func(i, j int) bool {
+		return isSpot(res[i]) && !isSpot(res[j])
+	})
+	return res
+}
+
+// picks every next victim from the availability zone that has the most
+// agents left, so that retiring agents keeps the fleet balanced across
+// zones. Zones are kept in a heap, so that large fleets are ordered in
+// O(n log z) for n candidates across z zones.
+func balancedZoneVictims(candidates []*ec2.Instance, vc victimContext) []*ec2.Instance {
+	byZone := make(map[string]*zoneVictims)
+	h := make(zoneHeap, 0, len(vc.zones))
+	for _, c := range candidates {
+		name := availabilityZone(c)
+		z, ok := byZone[name]
+		if !ok {
+			z = &zoneVictims{name: name, agents: vc.zones[name]}
+			byZone[name] = z
+			h = append(h, z)
+		}
+		z.candidates = append(z.candidates, c)
+	}
+	heap.Init(&h)
+
+	res := make([]*ec2.Instance, 0, len(candidates))
+	for h.Len() > 0 {
+		z := h[0]
+		res = append(res, z.candidates[0])
+		z.candidates = z.candidates[1:]
+		z.agents--
+		if len(z.candidates) == 0 {
+			heap.Pop(&h)
+		} else {
+			heap.Fix(&h, 0)
+		}
+	}
+	return res
+}
+
+// the candidates of an availability zone yet to be ordered, along with the
+// number of agents left in the zone
+type zoneVictims struct {
+	name       string
+	agents     int
+	candidates []*ec2.Instance
+}
+
+// max-heap of zones by the number of agents left, ties broken by name
+type zoneHeap []*zoneVictims
+
+func (h zoneHeap) Len() int      { return len(h) }
+func (h zoneHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h zoneHeap) Less(i, j int) bool {
+	if h[i].agents != h[j].agents {
+		return h[i].agents > h[j].agents
+	}
+	return h[i].name < h[j].name
+}
+
+func (h *zoneHeap) Push(x interface{}) { *h = append(*h, x.(*zoneVictims)) }
+
+func (h *zoneHeap) Pop() interface{} {
+	old := *h
+	z := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return z
+}
+
+func isSpot(i *ec2.Instance) bool {
+	return aws.StringValue(i.InstanceLifecycle) == ec2.InstanceLifecycleTypeSpot
+}
+
+func availabilityZone(i *ec2.Instance) string {
+	if i.Placement == nil {
+		return ""
+	}
+	return aws.StringValue(i.Placement.AvailabilityZone)
+}
+
+func copyInstances(instances []*ec2.Instance) []*ec2.Instance {
+	res := make([]*ec2.Instance, len(instances))
+	copy(res, instances)
+	return res
+}
+
+// returns the node IDs of the given instances
+func instanceIds(instances []*ec2.Instance) []cluster.NodeId {
+	res := make([]cluster.NodeId, len(instances))
+	for i, instance := range instances {
+		res[i] = cluster.NodeId(aws.StringValue(instance.InstanceId))
+	}
+	return res
+}
@@ -0,0 +1,130 @@
+package engine
+
+import (
+	"github.com/Shuttl-Tech/drone-autoscaler/cluster"
+	"github.com/Shuttl-Tech/drone-autoscaler/config"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestVictim_Strategies(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	instance := func(id, itype, lifecycle, zone string, age time.Duration) *ec2.Instance {
+		i := &ec2.Instance{
+			InstanceId:   aws.String(id),
+			InstanceType: aws.String(itype),
+			LaunchTime:   aws.Time(now.Add(-age)),
+			Placement:    &ec2.Placement{AvailabilityZone: aws.String(zone)},
+		}
+		if lifecycle != "" {
+			i.InstanceLifecycle = aws.String(lifecycle)
+		}
+		return i
+	}
+	candidates := []*ec2.Instance{
+		instance("i-1", "c5.xlarge", "", "ap-south-1a", 90*time.Minute),
+		instance("i-2", "c5.4xlarge", "spot", "ap-south-1b", 20*time.Minute),
+		instance("i-3", "c5.2xlarge", "", "ap-south-1a", 175*time.Minute),
+		instance("i-4", "m5.xlarge", "spot", "ap-south-1a", 50*time.Minute),
+	}
+	vc := victimContext{
+		now: now,
+		prices: map[string]float64{
+			"c5.xlarge":  0.17,
+			"c5.2xlarge": 0.34,
+			"c5.4xlarge": 0.68,
+		},
+		zones: map[string]int{
+			"ap-south-1a": 4,
+			"ap-south-1b": 3,
+		},
+	}
+
+	tests := []struct {
+		strategy string
+		want     []cluster.NodeId
+	}{
+		{config.RetirementDefault, []cluster.NodeId{"i-1", "i-2", "i-3", "i-4"}},
+		{config.RetirementOldestFirst, []cluster.NodeId{"i-3", "i-1", "i-4", "i-2"}},
+		{config.RetirementNewestFirst, []cluster.NodeId{"i-2", "i-4", "i-1", "i-3"}},
+		// minutes left in billing hour: i-1 30, i-2 40, i-3 5, i-4 10
+		{config.RetirementBillingHour, []cluster.NodeId{"i-3", "i-4", "i-1", "i-2"}},
+		{config.RetirementMostExpensive, []cluster.NodeId{"i-2", "i-3", "i-1", "i-4"}},
+		{config.RetirementSpotFirst, []cluster.NodeId{"i-2", "i-4", "i-1", "i-3"}},
+		// zone a: 4 agents, zone b: 3 agents, ties go to the first zone
+		{config.RetirementBalanceZones, []cluster.NodeId{"i-1", "i-3", "i-2", "i-4"}},
+		{"unknown", []cluster.NodeId{"i-1", "i-2", "i-3", "i-4"}},
+	}
+	for _, test := range tests {
+		got := instanceIds(newVictimStrategy(test.strategy)(candidates, vc))
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Want victims %v for %s strategy, got %v", test.want, test.strategy, got)
+		}
+	}
+
+	// strategies must not reorder the list they're given
+	if got := instanceIds(candidates); !reflect.DeepEqual(got, tests[0].want) {
+		t.Errorf("Want candidates to be left untouched, got %v", got)
+	}
+}
+
+func TestVictim_BalanceZones(t *testing.T) {
+	zone := func(id, z string) *ec2.Instance {
+		return &ec2.Instance{
+			InstanceId: aws.String(id),
+			Placement:  &ec2.Placement{AvailabilityZone: aws.String(z)},
+		}
+	}
+	tests := []struct {
+		zones      map[string]int
+		candidates []*ec2.Instance
+		want       []cluster.NodeId
+	}{
+		{
+			map[string]int{"a": 5, "b": 2},
+			[]*ec2.Instance{zone("i-b", "b"), zone("i-a1", "a"), zone("i-a2", "a")},
+			[]cluster.NodeId{"i-a1", "i-a2", "i-b"},
+		},
+		{
+			map[string]int{"a": 3, "b": 3, "c": 1},
+			[]*ec2.Instance{zone("i-c", "c"), zone("i-b", "b"), zone("i-a", "a")},
+			[]cluster.NodeId{"i-a", "i-b", "i-c"},
+		},
+		{
+			map[string]int{"a": 3, "b": 3},
+			[]*ec2.Instance{zone("i-b1", "b"), zone("i-b2", "b"), zone("i-a1", "a"), zone("i-a2", "a")},
+			[]cluster.NodeId{"i-a1", "i-b1", "i-a2", "i-b2"},
+		},
+		{
+			map[string]int{},
+			[]*ec2.Instance{},
+			[]cluster.NodeId{},
+		},
+	}
+	for _, test := range tests {
+		got := instanceIds(balancedZoneVictims(test.candidates, victimContext{zones: test.zones}))
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Want victims %v for zones %v, got %v", test.want, test.zones, got)
+		}
+	}
+}
+
+// Verifies that agents preferred by the victim strategy are retained
+// when trimming victims to maintain the min agent count
+func TestVictim_MaintainMinAgentCount(t *testing.T) {
+	e := Engine{
+		drone: &droneConfig{
+			agent: &droneAgentConfig{minCount: 2},
+		},
+	}
+	all := []cluster.NodeId{"i-1", "i-2", "i-3", "i-4"}
+	victims := []cluster.NodeId{"i-3", "i-1", "i-4"}
+
+	got := e.maintainMinAgentCount(all, victims)
+	if want := []cluster.NodeId{"i-3", "i-1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Want victims %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,97 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"github.com/Shuttl-Tech/drone-autoscaler/cluster"
+	"github.com/Shuttl-Tech/drone-autoscaler/notify"
+	log "github.com/sirupsen/logrus"
+)
+
+// records a strike against every idle running agent in a cycle that has
+// pending builds, and clears the strikes of busy agents. Cycles without
+// pending builds leave the strikes as they are. Agents that are no longer
+// running are forgotten.
+func (e *Engine) trackIdleAgents(running, busy []cluster.NodeId, pending bool) {
+	if e.idleStrikes == nil {
+		e.idleStrikes = make(map[cluster.NodeId]int)
+	}
+	busySet := toSet(busy)
+	alive := toSet(running)
+	for id := range e.idleStrikes {
+		if _, ok := alive[id]; !ok {
+			delete(e.idleStrikes, id)
+		}
+	}
+	for _, id := range running {
+		if _, ok := busySet[id]; ok {
+			delete(e.idleStrikes, id)
+		} else if pending {
+			e.idleStrikes[id]++
+		}
+	}
+}
+
+// returns the running agents that stayed idle through the zombie cycles
+// while builds were pending, since their runner is likely broken. Agents
+// below the min retirement age are left alone, as Drone might not have
+// started assigning them builds yet. None are returned when zombie agents
+// aren't detected.
+func (e *Engine) listZombieAgents(ctx context.Context, running, busy []cluster.NodeId, pending bool) (
+	[]cluster.NodeId,
+	error,
+) {
+	if e.drone.agent.zombieCycles <= 0 {
+		e.idleStrikes = nil
+		return nil, nil
+	}
+	e.trackIdleAgents(running, busy, pending)
+
+	var suspects []cluster.NodeId
+	for _, id := range running {
+		if e.idleStrikes[id] >= e.drone.agent.zombieCycles {
+			suspects = append(suspects, id)
+		}
+	}
+	if len(suspects) == 0 {
+		return nil, nil
+	}
+	agents, err := e.listAgentsAboveMinRetirementAge(ctx, suspects)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't describe agents suspected to be zombies: %v", err)
+	}
+	res := instanceIds(agents)
+	if len(res) > 0 {
+		log.
+			WithField("ids", res).
+			WithField("cycles", e.drone.agent.zombieCycles).
+			Warnln("Found agents that stayed idle while builds were pending")
+	}
+	return res, nil
+}
+
+// replaceZombieAgents marks the given zombie agents unhealthy, so that the
+// agent autoscaling group replaces them, and reports them
+func (e *Engine) replaceZombieAgents(ctx context.Context, ids []cluster.NodeId) {
+	if len(ids) == 0 {
+		return
+	}
+	if err := e.drone.agent.cluster.MarkUnhealthy(ctx, ids); err != nil {
+		log.
+			WithError(err).
+			WithField("ids", ids).
+			Errorln("Failed to mark zombie agents unhealthy")
+		return
+	}
+	log.
+		WithField("ids", ids).
+		Warnln("Marked zombie agents unhealthy to be replaced")
+	e.emit(ctx, notify.EventZombieAgents, map[string]interface{}{
+		"ids":    ids,
+		"count":  len(ids),
+		"cycles": e.drone.agent.zombieCycles,
+	})
+	for _, id := range ids {
+		delete(e.idleStrikes, id)
+	}
+}
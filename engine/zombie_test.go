@@ -0,0 +1,127 @@
+package engine
+
+import (
+	"context"
+	"github.com/Shuttl-Tech/drone-autoscaler/cluster"
+	"github.com/Shuttl-Tech/drone-autoscaler/mocks"
+	"github.com/Shuttl-Tech/drone-autoscaler/notify"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/golang/mock/gomock"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestZombie_TrackIdleAgents(t *testing.T) {
+	e := &Engine{}
+	running := []cluster.NodeId{"i-100", "i-200", "i-300"}
+
+	e.trackIdleAgents(running, []cluster.NodeId{"i-100"}, true)
+	e.trackIdleAgents(running, []cluster.NodeId{"i-100"}, false)
+	e.trackIdleAgents(running, []cluster.NodeId{"i-200"}, true)
+	e.trackIdleAgents([]cluster.NodeId{"i-100", "i-300"}, nil, true)
+
+	// cycles without pending builds leave strikes untouched, busy agents
+	// are cleared and agents that are gone are forgotten
+	want := map[cluster.NodeId]int{"i-100": 2, "i-300": 3}
+	if !reflect.DeepEqual(e.idleStrikes, want) {
+		t.Errorf("Want idle strikes %v, got %v", want, e.idleStrikes)
+	}
+}
+
+// Verifies that agents idle through the zombie cycles while builds are
+// pending are reported, unless they're below the min retirement age
+func TestZombie_ListZombieAgents(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	now := time.Now().UTC()
+	ec2Client := mocks.NewMockEC2API(ctrl)
+	ec2Client.
+		EXPECT().
+		DescribeInstancesWithContext(gomock.Any(), gomock.Any()).
+		Return(&ec2.DescribeInstancesOutput{
+			Reservations: []*ec2.Reservation{
+				{
+					Instances: []*ec2.Instance{
+						{InstanceId: aws.String("i-200"), LaunchTime: aws.Time(now.Add(-time.Hour))},
+						{InstanceId: aws.String("i-300"), LaunchTime: aws.Time(now.Add(-time.Minute))},
+					},
+				},
+			},
+		}, nil)
+
+	e := &Engine{
+		drone: &droneConfig{
+			agent: &droneAgentConfig{
+				cluster:          cluster.New("test-asg", ec2Client, nil),
+				zombieCycles:     2,
+				minRetirementAge: 10 * time.Minute,
+			},
+		},
+	}
+	running := []cluster.NodeId{"i-100", "i-200", "i-300"}
+	busy := []cluster.NodeId{"i-100"}
+
+	got, err := e.listZombieAgents(context.TODO(), running, busy, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("Want no zombie agents after a single cycle, got %v", got)
+	}
+	got, err = e.listZombieAgents(context.TODO(), running, busy, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, []cluster.NodeId{"i-200"}) {
+		t.Errorf("Want i-200 to be a zombie agent, got %v", got)
+	}
+
+	// detection is disabled when zombie cycles is 0
+	e.drone.agent.zombieCycles = 0
+	got, err = e.listZombieAgents(context.TODO(), running, busy, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 || e.idleStrikes != nil {
+		t.Errorf("Want no zombie agents when disabled, got %v", got)
+	}
+}
+
+func TestZombie_ReplaceZombieAgents(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	asg := mocks.NewMockAutoScalingAPI(ctrl)
+	asg.
+		EXPECT().
+		SetInstanceHealthWithContext(gomock.Any(), &autoscaling.SetInstanceHealthInput{
+			InstanceId:               aws.String("i-200"),
+			HealthStatus:             aws.String("Unhealthy"),
+			ShouldRespectGracePeriod: aws.Bool(false),
+		}).
+		Return(&autoscaling.SetInstanceHealthOutput{}, nil)
+
+	rec := &recordingNotifier{}
+	e := &Engine{
+		drone: &droneConfig{
+			agent: &droneAgentConfig{
+				cluster:      cluster.New("test-asg", nil, asg),
+				zombieCycles: 2,
+			},
+		},
+		notify:      &notifyConfig{notifier: rec},
+		idleStrikes: map[cluster.NodeId]int{"i-100": 1, "i-200": 2},
+	}
+
+	e.replaceZombieAgents(context.TODO(), []cluster.NodeId{"i-200"})
+	if _, ok := e.idleStrikes["i-200"]; ok || e.idleStrikes["i-100"] != 1 {
+		t.Errorf("Want strikes of replaced agent to be cleared, got %v", e.idleStrikes)
+	}
+	if len(rec.events) != 1 || rec.events[0].Type != notify.EventZombieAgents {
+		t.Errorf("Want zombie agents event, got %v", rec.events)
+	}
+}
@@ -0,0 +1,139 @@
+// Package events subscribes to the event stream of the Drone server, which
+// publishes a server-sent event for every change to a build and its stages.
+package events
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Shuttl-Tech/drone-autoscaler/metrics"
+	"github.com/Shuttl-Tech/drone-autoscaler/resilience"
+	"github.com/drone/drone-go/drone"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const pathStream = "%s/api/stream"
+
+// maximum size of a single event received from the stream
+const maxEventSize = 1 << 20
+
+// Event describes a change to a build received from the stream
+type Event struct {
+	Repo   string
+	Build  int64
+	Status string
+}
+
+// Stream is a subscription to Drone's event stream
+type Stream struct {
+	url    string
+	client *http.Client
+
+	// delay before reconnecting to the stream after it fails
+	backoff resilience.Policy
+}
+
+// NewStream returns a Stream of the given Drone server. The http client
+// must not have a timeout, since the stream is a long-lived connection.
+func NewStream(server string, client *http.Client) *Stream {
+	return &Stream{
+		url:     fmt.Sprintf(pathStream, server),
+		client:  client,
+		backoff: resilience.Policy{BaseDelay: time.Second, MaxDelay: time.Minute},
+	}
+}
+
+// Subscribe delivers every build event of the stream to fn until the
+// context is done. The stream is reconnected whenever it fails or ends,
+// after a jittered delay that grows exponentially with every consecutive
+// failure to connect.
+func (s *Stream) Subscribe(ctx context.Context, fn func(Event)) {
+	retry := 0
+	for {
+		connected, err := s.consume(ctx, fn)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			retry = 0
+		}
+		retry++
+		delay := s.backoff.Backoff(retry)
+		metrics.StreamReconnects.Add(1)
+		log.
+			WithError(err).
+			WithField("delay", delay).
+			Warnln("Drone event stream disconnected, reconnecting")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// consume reads events from the stream until it ends, returning whether it
+// could connect to the stream at all
+func (s *Stream) consume(ctx context.Context, fn func(Event)) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("%s responded with status %d", s.url, resp.StatusCode)
+	}
+	log.Infoln("Subscribed to Drone event stream")
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxEventSize)
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			// a blank line ends the event
+			if len(data) > 0 {
+				if e, ok := parse(strings.Join(data, "\n")); ok {
+					fn(e)
+				}
+				data = nil
+			}
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+		// comments, used by Drone as heartbeats, and other fields are ignored
+	}
+	if err := scanner.Err(); err != nil {
+		return true, err
+	}
+	return true, errors.New("stream closed by server")
+}
+
+// parses the data of an event, which Drone sends as the repository of the
+// changed build. Events about anything but builds are ignored.
+func parse(data string) (Event, bool) {
+	var repo drone.Repo
+	if err := json.Unmarshal([]byte(data), &repo); err != nil {
+		log.
+			WithError(err).
+			Debugln("Ignoring malformed event from Drone event stream")
+		return Event{}, false
+	}
+	if repo.Build.Number == 0 {
+		return Event{}, false
+	}
+	return Event{Repo: repo.Slug, Build: repo.Build.Number, Status: repo.Build.Status}, true
+}
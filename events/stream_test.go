@@ -0,0 +1,66 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"github.com/Shuttl-Tech/drone-autoscaler/resilience"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Verifies that build events are delivered, heartbeats & events about
+// anything but builds are ignored, and the stream is reconnected after a
+// failure
+func TestStream_Subscribe(t *testing.T) {
+	var connections int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/stream" {
+			t.Errorf("Want stream path /api/stream, got %s", r.URL.Path)
+		}
+		if atomic.AddInt32(&connections, 1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, ": ping\n\n")
+		fmt.Fprint(w, "data: {\"slug\": \"octocat/hello-world\"}\n\n")
+		fmt.Fprint(w, "data: {\"slug\": \"octocat/hello-world\",\n")
+		fmt.Fprint(w, "data: \"build\": {\"number\": 42, \"status\": \"pending\"}}\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	s := NewStream(srv.URL, srv.Client())
+	s.backoff = resilience.Policy{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan Event, 10)
+	done := make(chan struct{})
+	go func() {
+		s.Subscribe(ctx, func(e Event) { received <- e })
+		close(done)
+	}()
+
+	select {
+	case e := <-received:
+		want := Event{Repo: "octocat/hello-world", Build: 42, Status: "pending"}
+		if e != want {
+			t.Errorf("Want event %+v, got %+v", want, e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Want build event after reconnecting")
+	}
+	cancel()
+	<-done
+
+	if len(received) != 0 {
+		t.Errorf("Want a single event, got %d more", len(received))
+	}
+	if n := atomic.LoadInt32(&connections); n != 2 {
+		t.Errorf("Want 2 connections, got %d", n)
+	}
+}
@@ -10,4 +10,5 @@ require (
 	github.com/kr/pretty v0.2.0
 	github.com/sirupsen/logrus v1.4.2
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
+	gopkg.in/yaml.v2 v2.4.0
 )
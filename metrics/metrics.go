@@ -0,0 +1,60 @@
+// Package metrics exposes the autoscaler's internal counters & gauges via
+// expvar. They're served over HTTP at /debug/vars when a metrics address
+// is configured.
+package metrics
+
+import "expvar"
+
+var (
+	// DiscardedStages counts the stages ignored by the planner because they
+	// exceeded their maximum allowed duration, keyed by stage status.
+	// Every stage is counted only once, no matter how many cycles it
+	// stays discarded.
+	DiscardedStages = expvar.NewMap("discarded_stages")
+
+	// StuckStages is the number of stages discarded in the latest cycle
+	StuckStages = expvar.NewInt("stuck_stages")
+
+	// CancelledBuilds counts the builds cancelled by the autoscaler
+	// because they exceeded the hard duration limit
+	CancelledBuilds = expvar.NewInt("cancelled_builds")
+
+	// Retries counts the retried calls to external services, keyed by
+	// service name
+	Retries = expvar.NewMap("retries")
+
+	// BreakerOpenings counts how many times the circuit breaker of an
+	// external service opened, keyed by service name
+	BreakerOpenings = expvar.NewMap("breaker_openings")
+
+	// ClampedUpscales counts the upscales whose target capacity was limited
+	// by the size limits of the agent autoscaling group
+	ClampedUpscales = expvar.NewInt("clamped_upscales")
+
+	// FailedScalingActivities counts the scaling activities of the agent
+	// autoscaling group that failed or were cancelled
+	FailedScalingActivities = expvar.NewInt("failed_scaling_activities")
+
+	// StreamReconnects counts the reconnections to Drone's event stream
+	StreamReconnects = expvar.NewInt("event_stream_reconnects")
+
+	// ExpiredAgents is the number of agents past the max agent age in the
+	// latest cycle
+	ExpiredAgents = expvar.NewInt("expired_agents")
+
+	// OutdatedAgents is the number of agents launched from an outdated
+	// launch template version or launch configuration in the latest cycle
+	OutdatedAgents = expvar.NewInt("outdated_agents")
+
+	// ZombieAgents is the number of agents found idle through the zombie
+	// cycles while builds were pending in the latest cycle
+	ZombieAgents = expvar.NewInt("zombie_agents")
+
+	// QuarantinedAgents is the number of agents quarantined for inspection
+	// that are yet to be terminated
+	QuarantinedAgents = expvar.NewInt("quarantined_agents")
+
+	// ProbeInterval is the interval until the next cycle in seconds, as
+	// adapted to the load
+	ProbeInterval = expvar.NewInt("probe_interval_seconds")
+)
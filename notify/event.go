@@ -0,0 +1,80 @@
+package notify
+
+import "time"
+
+// EventType identifies the kind of scaling event an operator is being
+// notified about
+type EventType string
+
+const (
+	// EventUpscale is emitted when the agent cluster is scaled up by at
+	// least the configured number of agents in a single cycle
+	EventUpscale EventType = "upscale"
+
+	// EventDownscaleFailed is emitted when agents could not be destroyed
+	// during downscaling
+	EventDownscaleFailed EventType = "downscale_failed"
+
+	// EventQueuePaused is emitted when Drone's build queue remained paused
+	// for longer than the configured threshold
+	EventQueuePaused EventType = "queue_paused"
+
+	// EventScalingStuck is emitted when the agent autoscaling group has had
+	// a scaling activity in progress for longer than the configured threshold
+	EventScalingStuck EventType = "scaling_stuck"
+
+	// EventStagesDiscarded is emitted when stages start being ignored by
+	// the planner because they exceeded their maximum allowed duration
+	EventStagesDiscarded EventType = "stages_discarded"
+
+	// EventBuildCancelled is emitted when a build is cancelled because it
+	// exceeded the hard duration limit
+	EventBuildCancelled EventType = "build_cancelled"
+
+	// EventQueueResumeFailed is emitted when Drone's build queue couldn't
+	// be resumed after downscaling, right before the autoscaler exits
+	EventQueueResumeFailed EventType = "queue_resume_failed"
+
+	// EventScalingFailed is emitted once for every scaling activity of the
+	// agent autoscaling group that failed or was cancelled
+	EventScalingFailed EventType = "scaling_failed"
+
+	// EventScalingTimedOut is emitted when the planner stops waiting on a
+	// scaling activity that didn't finish within the scaling timeout
+	EventScalingTimedOut EventType = "scaling_timed_out"
+
+	// EventZombieAgents is emitted when agents that stayed idle while
+	// builds were pending are marked unhealthy to be replaced
+	EventZombieAgents EventType = "zombie_agents"
+
+	// EventAgentQuarantined is emitted when an agent is taken out of
+	// service for inspection
+	EventAgentQuarantined EventType = "agent_quarantined"
+)
+
+// Event describes something noteworthy that happened while the autoscaler
+// was planning or acting upon a plan
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	// Human-readable description of the event. It is rendered from the
+	// template configured for the event type when left empty.
+	Message string
+
+	// Arbitrary data about the event, made available to templates and
+	// included as-is in webhook payloads
+	Fields map[string]interface{}
+}
+
+// NewEvent returns an Event of the given type with the current time
+func NewEvent(t EventType, fields map[string]interface{}) Event {
+	if fields == nil {
+		fields = map[string]interface{}{}
+	}
+	return Event{
+		Type:   t,
+		Time:   time.Now().UTC(),
+		Fields: fields,
+	}
+}
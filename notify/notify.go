@@ -0,0 +1,76 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Notifier delivers scaling events to operators
+type Notifier interface {
+	// Notify sends the given event to its destination
+	Notify(context.Context, Event) error
+}
+
+type dispatcher struct {
+	templates Templates
+	sinks     []Notifier
+}
+
+// New returns a Notifier that renders the message of every event using
+// the given templates and fans it out to all sinks
+func New(templates Templates, sinks ...Notifier) Notifier {
+	return &dispatcher{
+		templates: templates,
+		sinks:     sinks,
+	}
+}
+
+// Notify renders the event's message and delivers it to every sink.
+// Delivery is attempted on all sinks even if some of them fail.
+func (d *dispatcher) Notify(ctx context.Context, e Event) error {
+	if e.Message == "" {
+		msg, err := d.templates.Render(e)
+		if err != nil {
+			return err
+		}
+		e.Message = msg
+	}
+
+	var failed []string
+	for _, s := range d.sinks {
+		if err := s.Notify(ctx, e); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to deliver %s event: %s", e.Type, strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// posts the given payload as JSON to url
+func postJSON(ctx context.Context, client *http.Client, url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s responded with status %d", url, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTemplates(t *testing.T) {
+	templates, err := ParseTemplates(map[EventType]string{
+		EventUpscale: "+{{.Fields.count}}",
+	})
+	if err != nil {
+		t.Fatalf("Did not expect parse error: %v", err)
+	}
+
+	e := NewEvent(EventUpscale, map[string]interface{}{"count": 4})
+	if got, _ := templates.Render(e); got != "+4" {
+		t.Errorf("Want overridden message +4, got %s", got)
+	}
+
+	e = NewEvent(EventDownscaleFailed, map[string]interface{}{
+		"ids":   []string{"i-100"},
+		"error": "boom",
+	})
+	if got, _ := templates.Render(e); got != "Failed to destroy agents [i-100]: boom" {
+		t.Errorf("Want default message, got %s", got)
+	}
+
+	if _, err := ParseTemplates(map[EventType]string{EventUpscale: "{{"}); err == nil {
+		t.Error("Want error for invalid template")
+	}
+}
+
+func TestNotify(t *testing.T) {
+	var hook webhookPayload
+	hookSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&hook); err != nil {
+			t.Errorf("Failed to decode webhook payload: %v", err)
+		}
+	}))
+	defer hookSrv.Close()
+
+	var msg slackPayload
+	slackSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			t.Errorf("Failed to decode slack payload: %v", err)
+		}
+	}))
+	defer slackSrv.Close()
+
+	templates, _ := ParseTemplates(nil)
+	n := New(
+		templates,
+		NewWebhook(hookSrv.URL, hookSrv.Client()),
+		NewSlack(slackSrv.URL, slackSrv.Client()),
+	)
+
+	e := NewEvent(EventUpscale, map[string]interface{}{"count": 7})
+	if err := n.Notify(context.TODO(), e); err != nil {
+		t.Fatalf("Did not expect notify error: %v", err)
+	}
+
+	want := "Adding 7 agent(s) to the Drone agent cluster"
+	if hook.Event != EventUpscale {
+		t.Errorf("Want webhook event %s, got %s", EventUpscale, hook.Event)
+	}
+	if hook.Message != want {
+		t.Errorf("Want webhook message %q, got %q", want, hook.Message)
+	}
+	if hook.Fields["count"] != float64(7) {
+		t.Errorf("Want webhook field count 7, got %v", hook.Fields["count"])
+	}
+	if msg.Text != want {
+		t.Errorf("Want slack text %q, got %q", want, msg.Text)
+	}
+}
+
+func TestNotify_Failure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	templates, _ := ParseTemplates(nil)
+	n := New(templates, NewWebhook(srv.URL, srv.Client()))
+	if err := n.Notify(context.TODO(), NewEvent(EventScalingStuck, nil)); err == nil {
+		t.Error("Want error when webhook responds with non-2xx status")
+	}
+}
@@ -0,0 +1,25 @@
+package notify
+
+import (
+	"context"
+	"net/http"
+)
+
+type slack struct {
+	url    string
+	client *http.Client
+}
+
+type slackPayload struct {
+	Text string `json:"text"`
+}
+
+// NewSlack returns a Notifier that posts the message of every event to
+// a Slack-compatible incoming webhook
+func NewSlack(url string, client *http.Client) Notifier {
+	return &slack{url: url, client: client}
+}
+
+func (s *slack) Notify(ctx context.Context, e Event) error {
+	return postJSON(ctx, s.client, s.url, slackPayload{Text: e.Message})
+}
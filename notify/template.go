@@ -0,0 +1,57 @@
+package notify
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+)
+
+// default message templates for every event type. Templates are executed
+// against the Event object, so event data is accessible via .Fields
+var defaultTemplates = map[EventType]string{
+	EventUpscale:           `Adding {{.Fields.count}} agent(s) to the Drone agent cluster`,
+	EventDownscaleFailed:   `Failed to destroy agents {{.Fields.ids}}: {{.Fields.error}}`,
+	EventQueuePaused:       `Drone build queue was paused for {{.Fields.duration}} while destroying agents`,
+	EventScalingStuck:      `Agent autoscaling group has had a scaling activity in progress for {{.Fields.duration}}`,
+	EventStagesDiscarded:   `Ignoring {{.Fields.count}} stage(s) that exceeded their max duration: {{.Fields.stages}}`,
+	EventBuildCancelled:    `Cancelled build {{.Fields.build}} after it exceeded the hard limit of {{.Fields.limit}}`,
+	EventQueueResumeFailed: `Failed to resume Drone build queue, it must be resumed manually: {{.Fields.error}}`,
+	EventScalingFailed:     `Scaling activity of agent autoscaling group {{.Fields.status}}: {{.Fields.description}}: {{.Fields.message}}`,
+	EventScalingTimedOut:   `Agent autoscaling group has {{.Fields.actual}} of {{.Fields.desired}} agents after {{.Fields.duration}}{{if .Fields.reset}}, resetting its desired capacity{{end}}`,
+	EventZombieAgents:      `Replacing agents {{.Fields.ids}} that stayed idle for {{.Fields.cycles}} cycles while builds were pending`,
+	EventAgentQuarantined:  `Quarantined agent {{.Fields.id}} for inspection: {{.Fields.reason}}`,
+}
+
+// Templates holds the parsed message template of every event type
+type Templates map[EventType]*template.Template
+
+// ParseTemplates parses message templates for all event types. A template
+// supplied in overrides takes precedence over the default one for its
+// event type, empty overrides are ignored.
+func ParseTemplates(overrides map[EventType]string) (Templates, error) {
+	res := make(Templates, len(defaultTemplates))
+	for t, text := range defaultTemplates {
+		if o, ok := overrides[t]; ok && o != "" {
+			text = o
+		}
+		tmpl, err := template.New(string(t)).Option("missingkey=zero").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template for %s event: %v", t, err)
+		}
+		res[t] = tmpl
+	}
+	return res, nil
+}
+
+// Render returns the message for the given event
+func (t Templates) Render(e Event) (string, error) {
+	tmpl, ok := t[e.Type]
+	if !ok {
+		return string(e.Type), nil
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, e); err != nil {
+		return "", fmt.Errorf("failed to render %s event: %v", e.Type, err)
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,34 @@
+package notify
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+type webhook struct {
+	url    string
+	client *http.Client
+}
+
+type webhookPayload struct {
+	Event   EventType              `json:"event"`
+	Time    time.Time              `json:"time"`
+	Message string                 `json:"message"`
+	Fields  map[string]interface{} `json:"fields"`
+}
+
+// NewWebhook returns a Notifier that posts every event as a generic
+// JSON document to the given URL
+func NewWebhook(url string, client *http.Client) Notifier {
+	return &webhook{url: url, client: client}
+}
+
+func (w *webhook) Notify(ctx context.Context, e Event) error {
+	return postJSON(ctx, w.client, w.url, webhookPayload{
+		Event:   e.Type,
+		Time:    e.Time,
+		Message: e.Message,
+		Fields:  e.Fields,
+	})
+}
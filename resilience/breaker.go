@@ -0,0 +1,83 @@
+package resilience
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Breaker is a circuit breaker for a single dependency. It opens after a
+// number of consecutive transient failures, failing calls immediately
+// until the cooldown has passed. The first call after the cooldown is let
+// through, closing the breaker if it succeeds and re-opening it otherwise.
+type Breaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	now      func() time.Time
+}
+
+// ErrOpen is returned for calls rejected by an open breaker
+type ErrOpen struct {
+	Name  string
+	Until time.Time
+}
+
+func (e *ErrOpen) Error() string {
+	return fmt.Sprintf("circuit breaker of %s is open until %s", e.Name, e.Until.Format(time.RFC3339))
+}
+
+// NewBreaker returns a breaker for the given dependency
+func NewBreaker(name string, threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{
+		name:      name,
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// Allow returns an error if calls to the dependency must be rejected
+func (b *Breaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return nil
+	}
+	if until := b.openedAt.Add(b.cooldown); b.now().Before(until) {
+		return &ErrOpen{Name: b.name, Until: until}
+	}
+	// half-open: let this call through, and give the next ones a chance
+	// only once it has succeeded
+	b.openedAt = b.now()
+	return nil
+}
+
+// Record updates the breaker with the outcome of a call and returns true
+// if it opened the breaker. Only transient failures count towards opening
+// the breaker, since any other outcome means the dependency responded.
+func (b *Breaker) Record(err error) (opened bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !Retryable(err) {
+		b.failures = 0
+		return false
+	}
+	b.failures++
+	if b.failures < b.threshold {
+		return false
+	}
+	b.openedAt = b.now()
+	return true
+}
+
+// Open returns true if the breaker is currently rejecting calls
+func (b *Breaker) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures >= b.threshold && b.now().Before(b.openedAt.Add(b.cooldown))
+}
@@ -0,0 +1,86 @@
+package resilience
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	b := NewBreaker("aws", 2, time.Minute)
+	b.now = func() time.Time { return now }
+
+	if b.Record(errTransient) {
+		t.Error("Want breaker to stay closed after 1 failure")
+	}
+	if b.Record(errors.New("client error 404: Not Found")) {
+		t.Error("Want permanent failures to not open breaker")
+	}
+	// the permanent failure reset the consecutive failures
+	b.Record(errTransient)
+	if b.Open() {
+		t.Fatal("Want breaker to be closed")
+	}
+	if !b.Record(errTransient) {
+		t.Fatal("Want breaker to open after 2 consecutive failures")
+	}
+
+	var open *ErrOpen
+	if err := b.Allow(); !errors.As(err, &open) {
+		t.Fatalf("Want open breaker to reject calls, got %v", err)
+	}
+
+	// a single trial call is let through after the cooldown
+	now = now.Add(time.Minute)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Want trial call after cooldown, got %v", err)
+	}
+	if err := b.Allow(); err == nil {
+		t.Fatal("Want calls to be rejected until the trial call completes")
+	}
+	if !b.Record(errTransient) {
+		t.Error("Want failed trial call to re-open breaker")
+	}
+
+	now = now.Add(time.Minute)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Want trial call after cooldown, got %v", err)
+	}
+	b.Record(nil)
+	if b.Open() || b.Allow() != nil {
+		t.Error("Want successful trial call to close breaker")
+	}
+}
+
+func TestDependency_Call(t *testing.T) {
+	d := NewDependency(
+		"drone",
+		Policy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+		NewBreaker("drone", 2, time.Minute),
+	)
+
+	calls := 0
+	failing := func(context.Context) error {
+		calls++
+		return errTransient
+	}
+
+	// non-idempotent calls aren't retried
+	if err := d.Call(context.TODO(), "Add", false, failing); err != errTransient || calls != 1 {
+		t.Errorf("Want 1 call of non-idempotent op, got %v after %d calls", err, calls)
+	}
+
+	calls = 0
+	if err := d.Call(context.TODO(), "List", true, failing); err != errTransient || calls != 3 {
+		t.Errorf("Want 3 calls of idempotent op, got %v after %d calls", err, calls)
+	}
+
+	// breaker opened after 2 failed calls
+	calls = 0
+	var open *ErrOpen
+	if err := d.Call(context.TODO(), "List", true, failing); !errors.As(err, &open) || calls != 0 {
+		t.Errorf("Want call to be rejected by open breaker, got %v after %d calls", err, calls)
+	}
+}
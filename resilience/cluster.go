@@ -0,0 +1,167 @@
+package resilience
+
+import (
+	"context"
+	"github.com/Shuttl-Tech/drone-autoscaler/cluster"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"time"
+)
+
+// resilientCluster guards the calls of a cluster to AWS. Destroying agents
+// isn't retried, since a call that failed after taking effect would then
+// be applied twice. Scaling to a target capacity is idempotent, so it's
+// retried like the remaining operations.
+type resilientCluster struct {
+	cluster cluster.Cluster
+	aws     *Dependency
+}
+
+// NewCluster returns a cluster that retries transient AWS failures and
+// stops calling AWS while its breaker is open
+func NewCluster(c cluster.Cluster, aws *Dependency) cluster.Cluster {
+	return &resilientCluster{cluster: c, aws: aws}
+}
+
+func (r *resilientCluster) ScaleTo(ctx context.Context, expected, target int) (res cluster.ScaleResult, err error) {
+	err = r.aws.Call(ctx, "ScaleTo", true, func(ctx context.Context) (err error) {
+		res, err = r.cluster.ScaleTo(ctx, expected, target)
+		return err
+	})
+	return res, err
+}
+
+func (r *resilientCluster) SetCapacity(ctx context.Context, count int) error {
+	return r.aws.Call(ctx, "SetCapacity", true, func(ctx context.Context) error {
+		return r.cluster.SetCapacity(ctx, count)
+	})
+}
+
+func (r *resilientCluster) Capacity(ctx context.Context) (res cluster.Capacity, err error) {
+	err = r.aws.Call(ctx, "Capacity", true, func(ctx context.Context) (err error) {
+		res, err = r.cluster.Capacity(ctx)
+		return err
+	})
+	return res, err
+}
+
+func (r *resilientCluster) Destroy(ctx context.Context, agents []cluster.NodeId) (
+	res []cluster.TerminationResult,
+	err error,
+) {
+	err = r.aws.Call(ctx, "Destroy", false, func(ctx context.Context) (err error) {
+		res, err = r.cluster.Destroy(ctx, agents)
+		return err
+	})
+	return res, err
+}
+
+func (r *resilientCluster) List(ctx context.Context) (res []cluster.NodeId, err error) {
+	err = r.aws.Call(ctx, "List", true, func(ctx context.Context) (err error) {
+		res, err = r.cluster.List(ctx)
+		return err
+	})
+	return res, err
+}
+
+func (r *resilientCluster) Describe(ctx context.Context, ids []cluster.NodeId) (res []*ec2.Instance, err error) {
+	err = r.aws.Call(ctx, "Describe", true, func(ctx context.Context) (err error) {
+		res, err = r.cluster.Describe(ctx, ids)
+		return err
+	})
+	return res, err
+}
+
+func (r *resilientCluster) InstanceTypes(ctx context.Context) (res map[cluster.NodeId]string, err error) {
+	err = r.aws.Call(ctx, "InstanceTypes", true, func(ctx context.Context) (err error) {
+		res, err = r.cluster.InstanceTypes(ctx)
+		return err
+	})
+	return res, err
+}
+
+func (r *resilientCluster) DescribeInstanceTypes(ctx context.Context, types []string) (
+	res map[string]cluster.InstanceType,
+	err error,
+) {
+	err = r.aws.Call(ctx, "DescribeInstanceTypes", true, func(ctx context.Context) (err error) {
+		res, err = r.cluster.DescribeInstanceTypes(ctx, types)
+		return err
+	})
+	return res, err
+}
+
+func (r *resilientCluster) ScalingActivityInProgress(ctx context.Context) (res bool, err error) {
+	err = r.aws.Call(ctx, "ScalingActivityInProgress", true, func(ctx context.Context) (err error) {
+		res, err = r.cluster.ScalingActivityInProgress(ctx)
+		return err
+	})
+	return res, err
+}
+
+func (r *resilientCluster) FailedScalingActivities(ctx context.Context, since time.Time) (
+	res []cluster.ScalingActivity,
+	err error,
+) {
+	err = r.aws.Call(ctx, "FailedScalingActivities", true, func(ctx context.Context) (err error) {
+		res, err = r.cluster.FailedScalingActivities(ctx, since)
+		return err
+	})
+	return res, err
+}
+
+func (r *resilientCluster) MarkUnhealthy(ctx context.Context, ids []cluster.NodeId) error {
+	return r.aws.Call(ctx, "MarkUnhealthy", true, func(ctx context.Context) error {
+		return r.cluster.MarkUnhealthy(ctx, ids)
+	})
+}
+
+func (r *resilientCluster) Quarantine(ctx context.Context, ids []cluster.NodeId, at time.Time) error {
+	return r.aws.Call(ctx, "Quarantine", false, func(ctx context.Context) error {
+		return r.cluster.Quarantine(ctx, ids, at)
+	})
+}
+
+func (r *resilientCluster) Quarantined(ctx context.Context) (res map[cluster.NodeId]time.Time, err error) {
+	err = r.aws.Call(ctx, "Quarantined", true, func(ctx context.Context) (err error) {
+		res, err = r.cluster.Quarantined(ctx)
+		return err
+	})
+	return res, err
+}
+
+func (r *resilientCluster) TerminateQuarantined(ctx context.Context, ids []cluster.NodeId) error {
+	return r.aws.Call(ctx, "TerminateQuarantined", true, func(ctx context.Context) error {
+		return r.cluster.TerminateQuarantined(ctx, ids)
+	})
+}
+
+func (r *resilientCluster) Tag(ctx context.Context, ids []cluster.NodeId, tags map[string]string) error {
+	return r.aws.Call(ctx, "Tag", true, func(ctx context.Context) error {
+		return r.cluster.Tag(ctx, ids, tags)
+	})
+}
+
+func (r *resilientCluster) TagsOf(ctx context.Context, ids []cluster.NodeId, keys []string) (
+	res map[cluster.NodeId]map[string]string,
+	err error,
+) {
+	err = r.aws.Call(ctx, "TagsOf", true, func(ctx context.Context) (err error) {
+		res, err = r.cluster.TagsOf(ctx, ids, keys)
+		return err
+	})
+	return res, err
+}
+
+func (r *resilientCluster) OutdatedAgents(ctx context.Context) (res []cluster.NodeId, err error) {
+	err = r.aws.Call(ctx, "OutdatedAgents", true, func(ctx context.Context) (err error) {
+		res, err = r.cluster.OutdatedAgents(ctx)
+		return err
+	})
+	return res, err
+}
+
+func (r *resilientCluster) Unprotect(ctx context.Context, ids []cluster.NodeId) error {
+	return r.aws.Call(ctx, "Unprotect", true, func(ctx context.Context) error {
+		return r.cluster.Unprotect(ctx, ids)
+	})
+}
@@ -0,0 +1,57 @@
+package resilience
+
+import (
+	"context"
+	"github.com/Shuttl-Tech/drone-autoscaler/cluster"
+	"github.com/Shuttl-Tech/drone-autoscaler/mocks"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/golang/mock/gomock"
+	"testing"
+	"time"
+)
+
+// Verifies that a throttled AWS call made by the cluster is retried
+func TestCluster_RetriesThrottling(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	asg := mocks.NewMockAutoScalingAPI(ctrl)
+	throttled := asg.
+		EXPECT().
+		DescribeAutoScalingGroupsWithContext(gomock.Any(), gomock.Any()).
+		Return(nil, awserr.New("Throttling", "Rate exceeded", nil))
+	asg.
+		EXPECT().
+		DescribeAutoScalingGroupsWithContext(gomock.Any(), gomock.Any()).
+		Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+			AutoScalingGroups: []*autoscaling.Group{
+				{
+					Instances: []*autoscaling.Instance{
+						{
+							HealthStatus: aws.String("Healthy"),
+							InstanceId:   aws.String("i-001"),
+						},
+					},
+				},
+			},
+		}, nil).
+		After(throttled)
+
+	c := NewCluster(
+		cluster.New("test-asg", nil, asg),
+		NewDependency(
+			"aws",
+			Policy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+			NewBreaker("aws", 5, time.Minute),
+		),
+	)
+	agents, err := c.List(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(agents) != 1 || agents[0] != "i-001" {
+		t.Errorf("Want agent i-001, got %v", agents)
+	}
+}
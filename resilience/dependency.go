@@ -0,0 +1,52 @@
+package resilience
+
+import (
+	"context"
+	"github.com/Shuttl-Tech/drone-autoscaler/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// Dependency guards the calls to an external service with retries and
+// a circuit breaker
+type Dependency struct {
+	name    string
+	policy  Policy
+	breaker *Breaker
+}
+
+// NewDependency returns a guard for calls to the named service
+func NewDependency(name string, policy Policy, breaker *Breaker) *Dependency {
+	return &Dependency{name: name, policy: policy, breaker: breaker}
+}
+
+// Call invokes the given operation of the dependency unless its breaker
+// is open. Idempotent operations are retried on transient failures. fn
+// receives a context bound by the policy's timeout.
+func (d *Dependency) Call(ctx context.Context, op string, idempotent bool, fn func(context.Context) error) error {
+	if err := d.breaker.Allow(); err != nil {
+		return err
+	}
+
+	policy := d.policy
+	if !idempotent {
+		policy.MaxAttempts = 1
+	}
+	err := Retry(ctx, policy, fn, func(retry int, err error) {
+		metrics.Retries.Add(d.name, 1)
+		log.
+			WithError(err).
+			WithField("dependency", d.name).
+			WithField("op", op).
+			WithField("retry", retry).
+			Warnln("Retrying failed call")
+	})
+
+	if d.breaker.Record(err) {
+		metrics.BreakerOpenings.Add(d.name, 1)
+		log.
+			WithError(err).
+			WithField("dependency", d.name).
+			Errorln("Opened circuit breaker after consecutive failures")
+	}
+	return err
+}
@@ -0,0 +1,78 @@
+package resilience
+
+import (
+	"context"
+	"github.com/drone/drone-go/drone"
+	log "github.com/sirupsen/logrus"
+)
+
+// resilientDrone guards the calls the autoscaler makes to the Drone
+// server. Calls it doesn't make are passed through as they are. The Drone
+// client doesn't accept a context, so the deadline of its calls is set by
+// its HTTP client instead, and retries are bound by the context the client
+// is created with.
+type resilientDrone struct {
+	drone.Client
+	ctx    context.Context
+	server *Dependency
+	resume Policy
+}
+
+// NewDroneClient returns a Drone client that retries transient failures
+// and stops calling the server while its breaker is open. Resuming the
+// build queue has a retry budget of its own and bypasses the breaker.
+// Failed calls are no longer retried once the given context is done, so
+// that they don't hold up shutdown.
+func NewDroneClient(ctx context.Context, c drone.Client, server *Dependency, resume Policy) drone.Client {
+	return &resilientDrone{Client: c, ctx: ctx, server: server, resume: resume}
+}
+
+func (r *resilientDrone) Queue() (res []*drone.Stage, err error) {
+	err = r.server.Call(r.ctx, "Queue", true, func(context.Context) (err error) {
+		res, err = r.Client.Queue()
+		return err
+	})
+	return res, err
+}
+
+func (r *resilientDrone) Incomplete() (res []*drone.Repo, err error) {
+	err = r.server.Call(r.ctx, "Incomplete", true, func(context.Context) (err error) {
+		res, err = r.Client.Incomplete()
+		return err
+	})
+	return res, err
+}
+
+func (r *resilientDrone) Build(namespace, name string, build int) (res *drone.Build, err error) {
+	err = r.server.Call(r.ctx, "Build", true, func(context.Context) (err error) {
+		res, err = r.Client.Build(namespace, name, build)
+		return err
+	})
+	return res, err
+}
+
+func (r *resilientDrone) QueuePause() error {
+	return r.server.Call(r.ctx, "QueuePause", true, func(context.Context) error {
+		return r.Client.QueuePause()
+	})
+}
+
+// QueueResume retries resuming the build queue regardless of the state of
+// the breaker, since a paused queue stalls every build
+func (r *resilientDrone) QueueResume() error {
+	resume := func(context.Context) error {
+		return r.Client.QueueResume()
+	}
+	return Retry(r.ctx, r.resume, resume, func(retry int, err error) {
+		log.
+			WithError(err).
+			WithField("retry", retry).
+			Warnln("Retrying to resume build queue")
+	})
+}
+
+func (r *resilientDrone) BuildCancel(namespace, name string, build int) error {
+	return r.server.Call(r.ctx, "BuildCancel", true, func(context.Context) error {
+		return r.Client.BuildCancel(namespace, name, build)
+	})
+}
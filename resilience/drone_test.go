@@ -0,0 +1,98 @@
+package resilience
+
+import (
+	"context"
+	"errors"
+	"github.com/Shuttl-Tech/drone-autoscaler/mocks"
+	"github.com/drone/drone-go/drone"
+	"github.com/golang/mock/gomock"
+	"testing"
+	"time"
+)
+
+// Verifies that resuming the build queue is retried with its own budget,
+// even while the breaker of the drone server is open
+func TestDrone_QueueResume(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	droneClient := mocks.NewMockClient(ctrl)
+	droneClient.EXPECT().Queue().Return(nil, errTransient)
+	resume := droneClient.EXPECT().QueueResume().Return(errTransient).Times(4)
+	droneClient.EXPECT().QueueResume().Return(nil).After(resume)
+
+	policy := Policy{MaxAttempts: 1, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	c := NewDroneClient(
+		context.TODO(),
+		droneClient,
+		NewDependency("drone", policy, NewBreaker("drone", 1, time.Minute)),
+		Policy{MaxAttempts: 5, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+	)
+
+	if _, err := c.Queue(); err != errTransient {
+		t.Fatalf("Want queue to fail, got %v", err)
+	}
+	var open *ErrOpen
+	if err := c.QueuePause(); !errors.As(err, &open) {
+		t.Errorf("Want pausing queue to be rejected by open breaker, got %v", err)
+	}
+	if err := c.QueueResume(); err != nil {
+		t.Errorf("Want queue to be resumed within retry budget, got %v", err)
+	}
+}
+
+// Verifies that resuming the build queue is attempted but not retried once
+// the client's context is done, so that it doesn't hold up shutdown
+func TestDrone_QueueResumeCancelled(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	droneClient := mocks.NewMockClient(ctrl)
+	droneClient.EXPECT().QueueResume().Return(errTransient)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c := NewDroneClient(
+		ctx,
+		droneClient,
+		NewDependency("drone", Policy{MaxAttempts: 1}, NewBreaker("drone", 1, time.Minute)),
+		Policy{MaxAttempts: 5, BaseDelay: time.Hour, MaxDelay: time.Hour},
+	)
+	if err := c.QueueResume(); err != errTransient {
+		t.Errorf("Want resuming queue to fail without retries, got %v", err)
+	}
+}
+
+// Verifies that looking up a build is retried upon transient failures
+func TestDrone_Build(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	droneClient := mocks.NewMockClient(ctrl)
+	failed := droneClient.EXPECT().Build("octocat", "hello", 42).Return(nil, errTransient)
+	droneClient.EXPECT().Build("octocat", "hello", 42).Return(&drone.Build{Number: 42}, nil).After(failed)
+
+	policy := Policy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	c := NewDroneClient(context.TODO(), droneClient, NewDependency("drone", policy, NewBreaker("drone", 3, time.Minute)), Policy{})
+	build, err := c.Build("octocat", "hello", 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if build.Number != 42 {
+		t.Errorf("Want build 42, got %v", build)
+	}
+}
+
+// Verifies that calls not guarded by the client are passed through
+func TestDrone_PassThrough(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	droneClient := mocks.NewMockClient(ctrl)
+	droneClient.EXPECT().Self().Return(nil, nil)
+
+	c := NewDroneClient(context.TODO(), droneClient, NewDependency("drone", Policy{MaxAttempts: 1}, NewBreaker("drone", 1, time.Minute)), Policy{})
+	if _, err := c.Self(); err != nil {
+		t.Error(err)
+	}
+}
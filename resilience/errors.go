@@ -0,0 +1,59 @@
+// Package resilience retries transient failures of the autoscaler's
+// dependencies with jittered exponential backoff, and stops calling a
+// dependency that keeps failing via a circuit breaker.
+package resilience
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/drone/drone-go/drone"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+// drone-go doesn't expose the status code of failed requests other than
+// in the error message
+var droneStatusRegexp = regexp.MustCompile(`^client error (\d{3}):`)
+
+// Retryable returns true if the given error is transient, ie- AWS
+// throttling, server side (5xx) & rate limiting (429) errors of AWS and
+// Drone, network errors and attempts that exceeded their own timeout.
+// Calls cancelled or timed out by the caller aren't retryable.
+func Retryable(err error) bool {
+	var timeoutErr *TimeoutError
+	if errors.As(err, &timeoutErr) {
+		return true
+	}
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) && retryableStatus(reqErr.StatusCode()) {
+		return true
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		return request.IsErrorThrottle(awsErr) || request.IsErrorRetryable(awsErr)
+	}
+
+	var droneErr *drone.Error
+	if errors.As(err, &droneErr) {
+		return retryableStatus(droneErr.Code)
+	}
+	if m := droneStatusRegexp.FindStringSubmatch(err.Error()); m != nil {
+		code, _ := strconv.Atoi(m[1])
+		return retryableStatus(code)
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+func retryableStatus(code int) bool {
+	return code >= http.StatusInternalServerError || code == http.StatusTooManyRequests
+}
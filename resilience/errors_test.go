@@ -0,0 +1,42 @@
+package resilience
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/drone/drone-go/drone"
+	"net"
+	"net/url"
+	"testing"
+)
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{context.Canceled, false},
+		{fmt.Errorf("failed: %w", context.DeadlineExceeded), false},
+		{awserr.New("Throttling", "Rate exceeded", nil), true},
+		{awserr.New("RequestLimitExceeded", "Request limit exceeded", nil), true},
+		{fmt.Errorf("failed to fetch info: %w", awserr.New("Throttling", "Rate exceeded", nil)), true},
+		{awserr.New("ValidationError", "Invalid instance", nil), false},
+		{awserr.NewRequestFailure(awserr.New("InternalFailure", "", nil), 500, "req-1"), true},
+		{awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "", nil), 503, "req-1"), true},
+		{awserr.NewRequestFailure(awserr.New("AccessDenied", "", nil), 403, "req-1"), false},
+		{errors.New("client error 502: Bad Gateway"), true},
+		{errors.New("client error 429: Too Many Requests"), true},
+		{errors.New("client error 404: Not Found"), false},
+		{&drone.Error{Code: 503, Message: "unavailable"}, true},
+		{&drone.Error{Code: 401, Message: "unauthorized"}, false},
+		{&url.Error{Op: "Get", URL: "http://drone", Err: &net.OpError{Op: "dial", Err: errors.New("refused")}}, true},
+		{errors.New("something went wrong"), false},
+	}
+	for _, test := range tests {
+		if got := Retryable(test.err); got != test.want {
+			t.Errorf("Want retryable %v for %v, got %v", test.want, test.err, got)
+		}
+	}
+}
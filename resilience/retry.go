@@ -0,0 +1,85 @@
+package resilience
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Policy controls how many times & how often a failing call is retried
+type Policy struct {
+	// Maximum number of attempts, including the first one
+	MaxAttempts int
+
+	// Upper bound of the delay before the first retry. It doubles with
+	// every subsequent retry, up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// Deadline of every attempt. Zero means attempts are only bound by
+	// the caller's context.
+	Timeout time.Duration
+}
+
+// TimeoutError is returned for attempts that exceeded the policy's timeout
+// while the caller's context was still alive. Unlike the caller's deadline,
+// it's retryable.
+type TimeoutError struct {
+	Timeout time.Duration
+	Err     error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("call timed out after %v: %v", e.Timeout, e.Err)
+}
+
+// attempt calls fn with a context bound by the policy's timeout
+func (p Policy) attempt(ctx context.Context, fn func(context.Context) error) error {
+	if p.Timeout <= 0 {
+		return fn(ctx)
+	}
+	callCtx, cancel := context.WithTimeout(ctx, p.Timeout)
+	defer cancel()
+	err := fn(callCtx)
+	if err != nil && ctx.Err() == nil && callCtx.Err() == context.DeadlineExceeded {
+		return &TimeoutError{Timeout: p.Timeout, Err: err}
+	}
+	return err
+}
+
+// Backoff returns a random delay before the given retry (starting at 1),
+// drawn from [0, min(MaxDelay, BaseDelay * 2^(retry-1))]. Full jitter
+// prevents several clients from retrying in lockstep.
+func (p Policy) Backoff(retry int) time.Duration {
+	ceiling := p.MaxDelay
+	if retry < 32 {
+		if d := p.BaseDelay << uint(retry-1); d > 0 && d < ceiling {
+			ceiling = d
+		}
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// Retry calls fn until it succeeds, returns an error that isn't retryable
+// or the policy's attempts are exhausted. The error of the last attempt
+// is returned. onRetry, if not nil, is called before every retry.
+func Retry(ctx context.Context, p Policy, fn func(context.Context) error, onRetry func(retry int, err error)) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = p.attempt(ctx, fn); err == nil || !Retryable(err) || attempt >= p.MaxAttempts {
+			return err
+		}
+		if onRetry != nil {
+			onRetry(attempt, err)
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(p.Backoff(attempt)):
+		}
+	}
+}
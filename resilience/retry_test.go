@@ -0,0 +1,110 @@
+package resilience
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var errTransient = errors.New("client error 503: Service Unavailable")
+
+func TestPolicy_Backoff(t *testing.T) {
+	p := Policy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	ceilings := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}
+	for i, ceiling := range ceilings {
+		for j := 0; j < 100; j++ {
+			if d := p.Backoff(i + 1); d < 0 || d > ceiling {
+				t.Fatalf("Want backoff of retry %d within [0, %v], got %v", i+1, ceiling, d)
+			}
+		}
+	}
+	if d := p.Backoff(100); d < 0 || d > time.Second {
+		t.Errorf("Want backoff capped at max delay, got %v", d)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	p := Policy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+	calls := 0
+	err := Retry(context.TODO(), p, func(context.Context) error {
+		calls++
+		if calls < 3 {
+			return errTransient
+		}
+		return nil
+	}, nil)
+	if err != nil || calls != 3 {
+		t.Errorf("Want success after 3 calls, got %v after %d calls", err, calls)
+	}
+
+	calls, retries := 0, 0
+	err = Retry(context.TODO(), p, func(context.Context) error {
+		calls++
+		return errTransient
+	}, func(int, error) { retries++ })
+	if err != errTransient || calls != 3 || retries != 2 {
+		t.Errorf("Want last error after 3 calls & 2 retries, got %v after %d calls & %d retries", err, calls, retries)
+	}
+
+	calls = 0
+	permanent := errors.New("client error 400: Bad Request")
+	err = Retry(context.TODO(), p, func(context.Context) error {
+		calls++
+		return permanent
+	}, nil)
+	if err != permanent || calls != 1 {
+		t.Errorf("Want permanent error to not be retried, got %v after %d calls", err, calls)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls = 0
+	p.BaseDelay, p.MaxDelay = time.Hour, time.Hour
+	err = Retry(ctx, p, func(context.Context) error {
+		calls++
+		return errTransient
+	}, nil)
+	if err != errTransient || calls != 1 {
+		t.Errorf("Want retries to stop once context is done, got %v after %d calls", err, calls)
+	}
+}
+
+func TestRetry_Timeout(t *testing.T) {
+	p := Policy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, Timeout: 5 * time.Millisecond}
+	hang := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	// attempts exceeding their own timeout are retried
+	calls := 0
+	err := Retry(context.TODO(), p, func(ctx context.Context) error {
+		calls++
+		return hang(ctx)
+	}, nil)
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) || calls != 2 {
+		t.Errorf("Want timeout error after 2 calls, got %v after %d calls", err, calls)
+	}
+
+	// attempts cut short by the caller's deadline aren't
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	calls = 0
+	err = Retry(ctx, p, func(ctx context.Context) error {
+		calls++
+		return hang(ctx)
+	}, nil)
+	if err != context.DeadlineExceeded || calls != 1 {
+		t.Errorf("Want caller's deadline to end retries, got %v after %d calls", err, calls)
+	}
+}
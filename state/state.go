@@ -0,0 +1,80 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Shuttl-Tech/drone-autoscaler/cluster"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Agents is the state of agents tracked across cycles, which must survive
+// restarts of the app
+type Agents struct {
+	// time every agent was last seen running a build
+	LastBusy map[cluster.NodeId]time.Time `json:"last_busy"`
+}
+
+// Store persists the state of agents
+type Store interface {
+	// Load returns the persisted state, which is empty if none was saved
+	Load(ctx context.Context) (Agents, error)
+
+	// Save persists the given state, replacing the previous one
+	Save(ctx context.Context, agents Agents) error
+}
+
+type fileStore struct {
+	path string
+}
+
+// NewFileStore returns a Store that keeps the state in a JSON file at the
+// given path
+func NewFileStore(path string) Store {
+	return fileStore{path: path}
+}
+
+func (s fileStore) Load(ctx context.Context) (Agents, error) {
+	res := Agents{}
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return res, nil
+	}
+	if err != nil {
+		return res, fmt.Errorf("failed to read state file %s: %w", s.path, err)
+	}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return res, fmt.Errorf("failed to parse state file %s: %w", s.path, err)
+	}
+	return res, nil
+}
+
+// Save writes the state to a temporary file that then replaces the state
+// file, so that a crash never leaves a partially written state behind
+func (s fileStore) Save(ctx context.Context, agents Agents) error {
+	data, err := json.Marshal(agents)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create state file: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Rename(f.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to replace state file %s: %w", s.path, err)
+	}
+	return nil
+}
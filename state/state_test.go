@@ -0,0 +1,45 @@
+package state
+
+import (
+	"context"
+	"github.com/Shuttl-Tech/drone-autoscaler/cluster"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scaler-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := NewFileStore(filepath.Join(dir, "state.json"))
+
+	got, err := s.Load(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.LastBusy) != 0 {
+		t.Errorf("Want empty state without state file, got %v", got)
+	}
+
+	busy := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	want := Agents{LastBusy: map[cluster.NodeId]time.Time{"i-100": busy}}
+	if err := s.Save(context.TODO(), want); err != nil {
+		t.Fatal(err)
+	}
+	got, err = s.Load(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.LastBusy["i-100"].Equal(busy) || len(got.LastBusy) != 1 {
+		t.Errorf("Want state %v, got %v", want, got)
+	}
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("Want only the state file to be left behind, got %d files", len(files))
+	}
+}
@@ -0,0 +1,103 @@
+package state
+
+import (
+	"context"
+	"github.com/Shuttl-Tech/drone-autoscaler/cluster"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"time"
+)
+
+// tagStore keeps the state of every agent in its well-known EC2 tags. Only
+// agents whose state changed since it was last loaded or saved are tagged.
+type tagStore struct {
+	fleet cluster.Cluster
+
+	// last busy time of every agent as last loaded or saved, and the
+	// agents last tagged as busy
+	saved map[cluster.NodeId]time.Time
+	busy  map[cluster.NodeId]struct{}
+}
+
+// NewTagStore returns a Store that keeps the state of every agent of the
+// given cluster in its EC2 tags
+func NewTagStore(fleet cluster.Cluster) Store {
+	return &tagStore{fleet: fleet}
+}
+
+// Load rebuilds the state from the tags of the running agents. Tags that
+// can't be parsed are ignored.
+func (s *tagStore) Load(ctx context.Context) (Agents, error) {
+	res := Agents{LastBusy: make(map[cluster.NodeId]time.Time)}
+	agents, err := s.fleet.List(ctx)
+	if err != nil {
+		return res, err
+	}
+	tags, err := s.fleet.TagsOf(ctx, agents, []string{cluster.TagLastBusy})
+	if err != nil {
+		return res, err
+	}
+
+	s.saved = make(map[cluster.NodeId]time.Time, len(tags))
+	for id, t := range tags {
+		busy, err := time.Parse(time.RFC3339, t[cluster.TagLastBusy])
+		if err != nil {
+			log.
+				WithError(err).
+				WithField("id", id).
+				Warnln("Ignoring malformed last busy tag of agent")
+			continue
+		}
+		res.LastBusy[id] = busy
+		s.saved[id] = busy
+	}
+	return res, nil
+}
+
+// Save tags agents whose last busy time changed as busy, along with that
+// time. Agents that were tagged as busy and whose last busy time stayed the
+// same are tagged as idle. Agents seen busy at the same time are tagged at
+// once.
+func (s *tagStore) Save(ctx context.Context, agents Agents) error {
+	changed := make(map[time.Time][]cluster.NodeId)
+	var idle []cluster.NodeId
+	for id, busy := range agents.LastBusy {
+		if prev, ok := s.saved[id]; !ok || !prev.Equal(busy) {
+			changed[busy] = append(changed[busy], id)
+		} else if _, ok := s.busy[id]; ok {
+			idle = append(idle, id)
+		}
+	}
+
+	busyAgents := make(map[cluster.NodeId]struct{})
+	for busy, ids := range changed {
+		sortIds(ids)
+		err := s.fleet.Tag(ctx, ids, map[string]string{
+			cluster.TagLastBusy: busy.UTC().Format(time.RFC3339),
+			cluster.TagState:    cluster.AgentStateBusy,
+		})
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			busyAgents[id] = struct{}{}
+		}
+	}
+	if len(idle) > 0 {
+		sortIds(idle)
+		if err := s.fleet.Tag(ctx, idle, map[string]string{cluster.TagState: cluster.AgentStateIdle}); err != nil {
+			return err
+		}
+	}
+
+	s.saved = make(map[cluster.NodeId]time.Time, len(agents.LastBusy))
+	for id, busy := range agents.LastBusy {
+		s.saved[id] = busy
+	}
+	s.busy = busyAgents
+	return nil
+}
+
+func sortIds(ids []cluster.NodeId) {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+}
@@ -0,0 +1,103 @@
+package state
+
+import (
+	"context"
+	"github.com/Shuttl-Tech/drone-autoscaler/cluster"
+	"github.com/Shuttl-Tech/drone-autoscaler/mocks"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/golang/mock/gomock"
+	"testing"
+	"time"
+)
+
+func TestTagStore(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	asg := mocks.NewMockAutoScalingAPI(ctrl)
+	asg.
+		EXPECT().
+		DescribeAutoScalingGroupsWithContext(gomock.Any(), gomock.Any()).
+		Return(&autoscaling.DescribeAutoScalingGroupsOutput{
+			AutoScalingGroups: []*autoscaling.Group{
+				{
+					Instances: []*autoscaling.Instance{
+						{InstanceId: aws.String("i-100"), HealthStatus: aws.String("Healthy")},
+						{InstanceId: aws.String("i-200"), HealthStatus: aws.String("Healthy")},
+						{InstanceId: aws.String("i-300"), HealthStatus: aws.String("Healthy")},
+					},
+				},
+			},
+		}, nil)
+
+	busy := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	ec2Client := mocks.NewMockEC2API(ctrl)
+	ec2Client.
+		EXPECT().
+		DescribeTagsWithContext(gomock.Any(), &ec2.DescribeTagsInput{
+			Filters: []*ec2.Filter{
+				{Name: aws.String("resource-id"), Values: aws.StringSlice([]string{"i-100", "i-200", "i-300"})},
+				{Name: aws.String("key"), Values: aws.StringSlice([]string{cluster.TagLastBusy})},
+			},
+		}).
+		Return(&ec2.DescribeTagsOutput{
+			Tags: []*ec2.TagDescription{
+				{ResourceId: aws.String("i-100"), Key: aws.String(cluster.TagLastBusy), Value: aws.String("2020-01-02T03:04:05Z")},
+				{ResourceId: aws.String("i-200"), Key: aws.String(cluster.TagLastBusy), Value: aws.String("yesterday")},
+			},
+		}, nil)
+
+	s := NewTagStore(cluster.New("test-asg", ec2Client, asg))
+	agents, err := s.Load(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(agents.LastBusy) != 1 || !agents.LastBusy["i-100"].Equal(busy) {
+		t.Errorf("Want i-100 last busy at %v, got %v", busy, agents.LastBusy)
+	}
+
+	// only the agents whose last busy time changed are tagged
+	now := busy.Add(time.Hour)
+	ec2Client.
+		EXPECT().
+		CreateTagsWithContext(gomock.Any(), &ec2.CreateTagsInput{
+			Resources: aws.StringSlice([]string{"i-200", "i-300"}),
+			Tags: []*ec2.Tag{
+				{Key: aws.String(cluster.TagLastBusy), Value: aws.String("2020-01-02T04:04:05Z")},
+				{Key: aws.String(cluster.TagState), Value: aws.String(cluster.AgentStateBusy)},
+			},
+		}).
+		Return(nil, nil)
+	agents.LastBusy["i-200"] = now
+	agents.LastBusy["i-300"] = now
+	if err := s.Save(context.TODO(), agents); err != nil {
+		t.Fatal(err)
+	}
+
+	// agents that are no longer busy are tagged as idle
+	ec2Client.
+		EXPECT().
+		CreateTagsWithContext(gomock.Any(), &ec2.CreateTagsInput{
+			Resources: aws.StringSlice([]string{"i-300"}),
+			Tags: []*ec2.Tag{
+				{Key: aws.String(cluster.TagState), Value: aws.String(cluster.AgentStateIdle)},
+			},
+		}).
+		Return(nil, nil)
+	ec2Client.
+		EXPECT().
+		CreateTagsWithContext(gomock.Any(), &ec2.CreateTagsInput{
+			Resources: aws.StringSlice([]string{"i-200"}),
+			Tags: []*ec2.Tag{
+				{Key: aws.String(cluster.TagLastBusy), Value: aws.String("2020-01-02T05:04:05Z")},
+				{Key: aws.String(cluster.TagState), Value: aws.String(cluster.AgentStateBusy)},
+			},
+		}).
+		Return(nil, nil)
+	agents.LastBusy["i-200"] = now.Add(time.Hour)
+	if err := s.Save(context.TODO(), agents); err != nil {
+		t.Fatal(err)
+	}
+}